@@ -5,9 +5,11 @@ var bus = new Vue();
 var BOOKS = 'books', AUTHORS = 'authors', SERIES = 'series';
 var BOUQUINS_TYPES = {
   books: { icon: 'book', singular: 'livre', plural: 'livres',
-    tab_cols:  [ { id: 'title',   name: 'Titre', sort: 'title' },
+    tab_cols:  [ { id: 'cover',   name: '' },
+                 { id: 'title',   name: 'Titre', sort: 'title' },
                  { id: 'authors', name: 'Auteur(s)' },
-                 { id: 'series',  name: 'Serie' } ] },
+                 { id: 'series',  name: 'Serie' },
+                 { id: 'rating',  name: 'Note', sort: 'rating' } ] },
   authors: { icon: 'user', singular: 'auteur', plural: 'auteurs',
     tab_cols: [ { id: 'author_name', name: 'Nom', sort: 'name' },
                 { id: 'count',       name: 'Livre(s)' } ] },
@@ -31,6 +33,13 @@ function url(type, id) {
   if (id) return ty(type) ? '/'+type+'/'+id:'';
   return ty(type) ? '/'+type+'/':'';
 }
+function thumbUrl(id, size) {
+  return '/books/' + id + '/thumb/' + size;
+}
+function stars(rating) {
+  var r = Math.round(rating);
+  return '★★★★★'.substring(0, r) + '☆☆☆☆☆'.substring(r);
+}
 function label(type, count) {
   return count == 1 ? ty(type).singular : ty(type).plural;
 }
@@ -61,6 +70,28 @@ function sendQuery(url, error, success) {
   xmh.setRequestHeader('Accept','application/json');
   xmh.send(null);
 }
+function csrfToken() {
+  var meta = document.querySelector('meta[name="csrf-token"]');
+  return meta ? meta.getAttribute('content') : '';
+}
+function sendData(method, url, data, error) {
+  var xmh = new XMLHttpRequest();
+  xmh.onreadystatechange = function() {
+    if (xmh.readyState === 4 && xmh.status >= 300 && null !== error)
+      error(xmh.status, xmh.responseText);
+  };
+  xmh.open(method, url, true);
+  xmh.setRequestHeader('Content-Type','application/json');
+  xmh.setRequestHeader('X-CSRF-Token', csrfToken());
+  xmh.send(JSON.stringify(data));
+}
+function flattenToc(entries, depth, list) {
+  for (var i = 0; i < entries.length; i++) {
+    list.push({ href: entries[i].href, label: '\u00a0\u00a0'.repeat(depth) + entries[i].label });
+    if (entries[i].children) flattenToc(entries[i].children, depth + 1, list);
+  }
+  return list;
+}
 
 // COMPONENTS //
 
@@ -121,6 +152,11 @@ Vue.component('result-cell', {
         return this.link(h, SERIES, this.item.name, this.item.id);
       case 'count':
         return this.item.count;
+      case 'cover':
+        // books without cover get a generated placeholder
+        return [ h('a', { attrs: { href: url(BOOKS, this.item.id) } }, [
+          h('img', { attrs: { src: thumbUrl(this.item.id, 120), alt: '', width: 60, class: 'img-rounded', loading: 'lazy' } })
+        ]) ];
       case 'title':
         return this.link(h, BOOKS, this.item.title, this.item.id);
       case 'authors':
@@ -141,6 +177,15 @@ Vue.component('result-cell', {
           ];
         }
         return '';
+      case 'rating':
+        var elts = [];
+        if (this.item.ratings) {
+          elts.push(h('span', { attrs: { title: this.item.avg_rating.toFixed(1) + ' / 5 (' + this.item.ratings + ')' } }, stars(this.item.avg_rating)));
+        }
+        if (this.item.rating) {
+          elts.push(' ', h('small', { attrs: { class: 'text-muted', title: 'Ma note' } }, stars(this.item.rating)));
+        }
+        return elts;
       default:
         console.log('ERROR unknown col: ' + this.col.id)
         return '';
@@ -173,6 +218,9 @@ if (document.getElementById("index")) {
       more: false,
       sort_by: null,
       order_desc: false,
+      status: '',
+      minrating: '',
+      loan: '',
       cols: [],
       results: []
     },
@@ -204,8 +252,21 @@ if (document.getElementById("index")) {
       paginate: function(query) {
         return query + '?page=' + this.page + '&perpage=' + this.perpage;
       },
+      filter: function(query) {
+        if (!this.isBooks()) return query;
+        return query + (this.status ? '&status=' + this.status : '') +
+          (this.minrating ? '&minrating=' + this.minrating : '') +
+          (this.loan ? '&loan=' + this.loan : '');
+      },
       params: function(url) {
-        return this.order(this.sort(this.paginate(url)));
+        return this.filter(this.order(this.sort(this.paginate(url))));
+      },
+      isBooks: function() {
+        return this.url == url(BOOKS);
+      },
+      filterStatus: function() {
+        this.page = 0;
+        this.updateResults();
       },
       updateResults: function() {
         sendQuery(this.params(this.url), stdError, this.loadResults);
@@ -370,3 +431,195 @@ if (document.getElementById("search")) {
     }
   });
 }
+if (document.getElementById("reader")) {
+  new Vue({
+    el: '#reader',
+    data: {
+      book: 0,
+      spine: [],
+      toc: [],
+      index: 0,
+      fraction: 0,
+      chapter: '',
+      timer: null
+    },
+    methods: {
+      frame: function() {
+        return this.$refs.frame;
+      },
+      scroller: function() {
+        var doc = this.frame().contentDocument;
+        return doc ? (doc.scrollingElement || doc.documentElement) : null;
+      },
+      spineIndex: function(href) {
+        var path = href.split('#')[0];
+        for (var i = 0; i < this.spine.length; i++) {
+          if (this.spine[i].href == path) return i;
+        }
+        return -1;
+      },
+      show: function(i, fraction) {
+        this.index = i;
+        this.fraction = fraction;
+        this.frame().src = this.spine[i].href;
+      },
+      goto: function(href) {
+        if (!href) return;
+        var i = this.spineIndex(href);
+        if (i < 0) return;
+        this.index = i;
+        this.fraction = 0;
+        this.frame().src = href;
+      },
+      prev: function() {
+        if (this.index > 0) this.show(this.index - 1, 0);
+      },
+      next: function() {
+        if (this.index < this.spine.length - 1) this.show(this.index + 1, 0);
+      },
+      percentage: function() {
+        if (!this.spine.length) return 0;
+        return Math.round((this.index + this.fraction) / this.spine.length * 100);
+      },
+      save: function() {
+        if (!this.spine.length) return;
+        sendData('PUT', '/read/' + this.book + '/position', {
+          href: this.spine[this.index].href,
+          fraction: this.fraction,
+          percentage: (this.index + this.fraction) / this.spine.length
+        }, stdError);
+      },
+      scrolled: function() {
+        var s = this.scroller();
+        var height = s.scrollHeight - s.clientHeight;
+        this.fraction = height > 0 ? Math.min(1, s.scrollTop / height) : 0;
+        clearTimeout(this.timer);
+        this.timer = setTimeout(this.save, 2000);
+      },
+      frameLoaded: function() {
+        var s = this.scroller();
+        if (!s) return;
+        // links between chapters are followed inside the frame
+        var i = this.spineIndex(this.frame().contentWindow.location.pathname);
+        if (i >= 0 && i != this.index) {
+          this.index = i;
+          this.fraction = 0;
+        }
+        if (this.fraction > 0) {
+          s.scrollTop = this.fraction * (s.scrollHeight - s.clientHeight);
+        }
+        this.frame().contentWindow.addEventListener('scroll', this.scrolled);
+        this.save();
+      },
+      loadBook: function(book) {
+        this.spine = book.spine;
+        this.toc = flattenToc(book.toc, 0, []);
+        if (!this.spine.length) return;
+        var i = 0, fraction = 0;
+        if (book.position) {
+          i = this.spineIndex(book.position.href);
+          fraction = book.position.fraction;
+          if (i < 0) {
+            i = 0;
+            fraction = 0;
+          }
+        }
+        this.show(i, fraction);
+      }
+    },
+    mounted: function() {
+      this.book = this.$el.getAttribute('data-book');
+      sendQuery('/read/' + this.book + '/book', stdError, this.loadBook);
+    }
+  });
+}
+if (document.getElementById("comic")) {
+  new Vue({
+    el: '#comic',
+    data: {
+      book: 0,
+      format: '',
+      pages: [],
+      widths: [],
+      index: 0,
+      double: false
+    },
+    methods: {
+      shown: function() {
+        if (!this.pages.length) return [];
+        // cover alone, then spreads of two pages
+        if (this.double && this.index > 0 && this.index < this.pages.length - 1) {
+          return [this.index, this.index + 1];
+        }
+        return [this.index];
+      },
+      last: function() {
+        var shown = this.shown();
+        return shown.length ? shown[shown.length - 1] : 0;
+      },
+      width: function() {
+        var available = this.$refs.pages.clientWidth * (window.devicePixelRatio || 1);
+        if (this.double) available = available / 2;
+        for (var i = 0; i < this.widths.length; i++) {
+          if (this.widths[i] >= available) return this.widths[i];
+        }
+        return this.widths[this.widths.length - 1];
+      },
+      pageUrl: function(i) {
+        return this.pages[i] + '&width=' + this.width();
+      },
+      goto: function(i) {
+        i = Math.max(0, Math.min(i, this.pages.length - 1));
+        if (this.double && i > 0 && i % 2 == 0) i--;
+        this.index = i;
+        window.scrollTo(0, 0);
+        this.save();
+      },
+      prev: function() {
+        this.goto(this.double && this.index > 1 ? this.index - 2 : this.index - 1);
+      },
+      next: function() {
+        if (this.last() < this.pages.length - 1) this.goto(this.last() + 1);
+      },
+      toggleDouble: function() {
+        this.double = !this.double;
+        this.goto(this.index);
+      },
+      clicked: function(event) {
+        var bounds = this.$refs.pages.getBoundingClientRect();
+        if (event.clientX - bounds.left < bounds.width / 2) this.prev();
+        else this.next();
+      },
+      keydown: function(event) {
+        if (event.target.tagName == 'SELECT') return;
+        if (event.key == 'ArrowLeft') this.prev();
+        else if (event.key == 'ArrowRight' || event.key == ' ') {
+          event.preventDefault();
+          this.next();
+        }
+      },
+      save: function() {
+        if (!this.pages.length) return;
+        sendData('PUT', '/comic/' + this.book + '/position', {
+          page: this.index,
+          double: this.double,
+          percentage: (this.last() + 1) / this.pages.length
+        }, stdError);
+      },
+      loadBook: function(book) {
+        this.widths = book.widths;
+        this.pages = book.pages;
+        if (book.position) {
+          this.double = book.position.double;
+          this.index = Math.min(book.position.page, Math.max(0, this.pages.length - 1));
+        }
+      }
+    },
+    mounted: function() {
+      this.book = this.$el.getAttribute('data-book');
+      this.format = this.$el.getAttribute('data-format');
+      window.addEventListener('keydown', this.keydown);
+      sendQuery('/comic/' + this.book + '/pages?format=' + this.format, stdError, this.loadBook);
+    }
+  });
+}
@@ -1,23 +1,31 @@
-var bus=new Vue();var BOOKS='books',AUTHORS='authors',SERIES='series';var BOUQUINS_TYPES={books:{icon:'book',singular:'livre',plural:'livres',tab_cols:[{id:'title',name:'Titre',sort:'title'},{id:'authors',name:'Auteur(s)'},{id:'series',name:'Serie'}]},authors:{icon:'user',singular:'auteur',plural:'auteurs',tab_cols:[{id:'author_name',name:'Nom',sort:'name'},{id:'count',name:'Livre(s)'}]},series:{icon:'list',singular:'serie',plural:'series',tab_cols:[{id:'serie_name',name:'Nom',sort:'name'},{id:'count',name:'Livre(s)'},{id:'authors',name:'Auteur(s)'}]}};function ty(type){if(BOUQUINS_TYPES[type])return BOUQUINS_TYPES[type]
+var bus=new Vue();var BOOKS='books',AUTHORS='authors',SERIES='series';var BOUQUINS_TYPES={books:{icon:'book',singular:'livre',plural:'livres',tab_cols:[{id:'cover',name:''},{id:'title',name:'Titre',sort:'title'},{id:'authors',name:'Auteur(s)'},{id:'series',name:'Serie'},{id:'rating',name:'Note',sort:'rating'}]},authors:{icon:'user',singular:'auteur',plural:'auteurs',tab_cols:[{id:'author_name',name:'Nom',sort:'name'},{id:'count',name:'Livre(s)'}]},series:{icon:'list',singular:'serie',plural:'series',tab_cols:[{id:'serie_name',name:'Nom',sort:'name'},{id:'count',name:'Livre(s)'},{id:'authors',name:'Auteur(s)'}]}};function ty(type){if(BOUQUINS_TYPES[type])return BOUQUINS_TYPES[type]
 console.log("ERROR: Unknown type: "+type);return{}}
 function icon(type){return ty(type).icon;}
 function iconClass(type){return'glyphicon glyphicon-'+icon(type);}
 function url(type,id){if(id)return ty(type)?'/'+type+'/'+id:'';return ty(type)?'/'+type+'/':'';}
-function label(type,count){return count==1?ty(type).singular:ty(type).plural;}
+function thumbUrl(id,size){return'/books/'+id+'/thumb/'+size}function stars(rating){var r=Math.round(rating);return'★★★★★'.substring(0,r)+'☆☆☆☆☆'.substring(r);}function label(type,count){return count==1?ty(type).singular:ty(type).plural;}
 function stdError(code,resp){console.log('ERROR '+code+': '+resp);}
 function sendQuery(url,error,success){var xmh=new XMLHttpRequest();var v;xmh.onreadystatechange=function(){v=xmh.responseText;if(xmh.readyState===4&&xmh.status===200){var res;try{res=JSON.parse(v);}catch(err){if(null!==error)
 error(err.name,err.message);}
 if(null!==success)
 success(res);}else if(xmh.readyState===4){if(null!==error)
-error(xmh.status,v);}};xmh.open('GET',url,true);xmh.setRequestHeader('Accept','application/json');xmh.send(null);}
-Vue.component('results-list',{template:'#results-list-template',props:['results','count','type'],methods:{url:function(item){return url(this.type,item.id);},label:function(item){switch(this.type){case BOOKS:return item.title;case AUTHORS:case SERIES:return item.name;default:return'';}},iconClass:function(){return iconClass(this.type);},countlabel:function(){return label(this.type,this.count);}}});Vue.component('results',{template:'#results-template',props:['results','cols','sort_by','order_desc'],methods:{sortBy:function(col){bus.$emit('sort-on',col);}}});Vue.component('result-cell',{render:function(h){return h('td',this.cellContent(h));},props:['item','col'],methods:{link:function(h,type,text,id){return[h('span',{attrs:{class:iconClass(type)}},''),' ',h('a',{attrs:{href:url(type,id)}},text)];},badge:function(h,num){return h('span',{attrs:{class:'badge'}},num);},cellContent:function(h){switch(this.col.id){case'author_name':return this.link(h,AUTHORS,this.item.name,this.item.id);case'serie_name':return this.link(h,SERIES,this.item.name,this.item.id);case'count':return this.item.count;case'title':return this.link(h,BOOKS,this.item.title,this.item.id);case'authors':var elts=[];var authors=this.item.authors;if(authors){for(i=0;i<authors.length;i++){elts[i]=this.link(h,AUTHORS,authors[i].name,authors[i].id);}}
+error(xmh.status,v);}};xmh.open('GET',url,true);xmh.setRequestHeader('Accept','application/json');xmh.send(null);}function csrfToken(){var meta=document.querySelector('meta[name="csrf-token"]');return meta?meta.getAttribute('content'):'';}function sendData(method,url,data,error){var xmh=new XMLHttpRequest();xmh.onreadystatechange=function(){if(xmh.readyState===4&&xmh.status>=300&&null!==error)error(xmh.status,xmh.responseText);};xmh.open(method,url,true);xmh.setRequestHeader('Content-Type','application/json');xmh.setRequestHeader('X-CSRF-Token',csrfToken());xmh.send(JSON.stringify(data));}function flattenToc(entries,depth,list){for(var i=0;i<entries.length;i++){list.push({href:entries[i].href,label:'\u00a0\u00a0'.repeat(depth)+entries[i].label});if(entries[i].children)flattenToc(entries[i].children,depth+1,list);}return list;}
+Vue.component('results-list',{template:'#results-list-template',props:['results','count','type'],methods:{url:function(item){return url(this.type,item.id);},label:function(item){switch(this.type){case BOOKS:return item.title;case AUTHORS:case SERIES:return item.name;default:return'';}},iconClass:function(){return iconClass(this.type);},countlabel:function(){return label(this.type,this.count);}}});Vue.component('results',{template:'#results-template',props:['results','cols','sort_by','order_desc'],methods:{sortBy:function(col){bus.$emit('sort-on',col);}}});Vue.component('result-cell',{render:function(h){return h('td',this.cellContent(h));},props:['item','col'],methods:{link:function(h,type,text,id){return[h('span',{attrs:{class:iconClass(type)}},''),' ',h('a',{attrs:{href:url(type,id)}},text)];},badge:function(h,num){return h('span',{attrs:{class:'badge'}},num);},cellContent:function(h){switch(this.col.id){case'author_name':return this.link(h,AUTHORS,this.item.name,this.item.id);case'serie_name':return this.link(h,SERIES,this.item.name,this.item.id);case'count':return this.item.count;case'cover':return[h('a',{attrs:{href:url(BOOKS,this.item.id)}},[h('img',{attrs:{src:thumbUrl(this.item.id,120),alt:'',width:60,class:'img-rounded',loading:'lazy'}})])];case'title':return this.link(h,BOOKS,this.item.title,this.item.id);case'authors':var elts=[];var authors=this.item.authors;if(authors){for(i=0;i<authors.length;i++){elts[i]=this.link(h,AUTHORS,authors[i].name,authors[i].id);}}
 return elts;case'series':var series=this.item.series;if(series){return[this.link(h,SERIES,series.name,series.id),h('span',{attrs:{class:'badge'}},this.item.series_idx)];}
-return'';default:console.log('ERROR unknown col: '+this.col.id)
-return'';}}}});Vue.component('paginate',{template:'#paginate-template',props:['page','more'],methods:{prevPage:function(){if(this.page>1)bus.$emit('update-page',-1);},nextPage:function(){if(this.more)bus.$emit('update-page',1);}}});if(document.getElementById("index")){new Vue({el:'#index',data:{url:'',page:0,perpage:20,more:false,sort_by:null,order_desc:false,cols:[],results:[]},methods:{sortBy:function(col){if(this.sort_by==col){if(this.order_desc){this.order_desc=false;this.sort_by=null;}else{this.order_desc=true;}}else{this.order_desc=false;this.sort_by=col;}
-this.updateResults();},updatePage:function(p){this.page+=p;this.updateResults();},order:function(query){return query+(this.order_desc?'&order=desc':'');},sort:function(query){return query+(this.sort_by?'&sort='+this.sort_by:'');},paginate:function(query){return query+'?page='+this.page+'&perpage='+this.perpage;},params:function(url){return this.order(this.sort(this.paginate(url)));},updateResults:function(){sendQuery(this.params(this.url),stdError,this.loadResults);},showSeries:function(){this.url=url(SERIES);this.updateResults();},showAuthors:function(){this.url=url(AUTHORS);this.updateResults();},showBooks:function(){this.url=url(BOOKS);this.updateResults();},loadCols:function(type){this.cols=ty(type).tab_cols;},loadResults(resp){this.results=[];this.more=resp.more;this.loadCols(resp.type);if(resp.results){this.results=resp.results;if(this.page==0)this.page=1;}else{this.page=0;}}},mounted:function(){bus.$on('sort-on',this.sortBy);bus.$on('update-page',this.updatePage);}});}
+return'';case'rating':var elts=[];if(this.item.ratings){elts.push(h('span',{attrs:{title:this.item.avg_rating.toFixed(1)+' / 5 ('+this.item.ratings+')'}},stars(this.item.avg_rating)));}
+if(this.item.rating){elts.push(' ',h('small',{attrs:{class:'text-muted',title:'Ma note'}},stars(this.item.rating)));}
+return elts;default:console.log('ERROR unknown col: '+this.col.id)
+return'';}}}});Vue.component('paginate',{template:'#paginate-template',props:['page','more'],methods:{prevPage:function(){if(this.page>1)bus.$emit('update-page',-1);},nextPage:function(){if(this.more)bus.$emit('update-page',1);}}});if(document.getElementById("index")){new Vue({el:'#index',data:{url:'',page:0,perpage:20,more:false,sort_by:null,order_desc:false,status:'',minrating:'',loan:'',cols:[],results:[]},methods:{sortBy:function(col){if(this.sort_by==col){if(this.order_desc){this.order_desc=false;this.sort_by=null;}else{this.order_desc=true;}}else{this.order_desc=false;this.sort_by=col;}
+this.updateResults();},updatePage:function(p){this.page+=p;this.updateResults();},order:function(query){return query+(this.order_desc?'&order=desc':'');},sort:function(query){return query+(this.sort_by?'&sort='+this.sort_by:'');},paginate:function(query){return query+'?page='+this.page+'&perpage='+this.perpage;},filter:function(query){if(!this.isBooks())return query;return query+(this.status?'&status='+this.status:'')+(this.minrating?'&minrating='+this.minrating:'')+(this.loan?'&loan='+this.loan:'');},params:function(url){return this.filter(this.order(this.sort(this.paginate(url))));},isBooks:function(){return this.url==url(BOOKS);},filterStatus:function(){this.page=0;this.updateResults();},updateResults:function(){sendQuery(this.params(this.url),stdError,this.loadResults);},showSeries:function(){this.url=url(SERIES);this.updateResults();},showAuthors:function(){this.url=url(AUTHORS);this.updateResults();},showBooks:function(){this.url=url(BOOKS);this.updateResults();},loadCols:function(type){this.cols=ty(type).tab_cols;},loadResults(resp){this.results=[];this.more=resp.more;this.loadCols(resp.type);if(resp.results){this.results=resp.results;if(this.page==0)this.page=1;}else{this.page=0;}}},mounted:function(){bus.$on('sort-on',this.sortBy);bus.$on('update-page',this.updatePage);}});}
 if(document.getElementById("author")){new Vue({el:'#author',data:{tab:BOOKS},methods:{showBooks:function(){this.tab=BOOKS;},showAuthors:function(){this.tab=AUTHORS;},showSeries:function(){this.tab=SERIES;}}});}
 if(document.getElementById("search")){new Vue({el:'#search',data:{urlParams:[],authors:[],books:[],series:[],authorsCount:0,booksCount:0,seriesCount:0,q:'',which:'all',all:false,perpage:10},methods:{searchParams:function(url){var res=url+'?perpage='+this.perpage;for(var i=0;i<this.terms.length;i++){var t=this.terms[i];if(t.trim())
 res+='&term='+encodeURIComponent(t.trim());}
 return res;},searchAuthorsSuccess:function(res){this.authorsCount=res.count;this.authors=res.results;},searchAuthors:function(){sendQuery(this.searchParams(url(AUTHORS)),stdError,this.searchAuthorsSuccess);},searchBooksSuccess:function(res){this.booksCount=res.count;this.books=res.results;},searchBooks:function(){sendQuery(this.searchParams(url(BOOKS)),stdError,this.searchBooksSuccess);},searchSeriesSuccess:function(res){this.seriesCount=res.count;this.series=res.results;},searchSeries:function(){sendQuery(this.searchParams(url(SERIES)),stdError,this.searchSeriesSuccess);},searchAll:function(){this.searchAuthors();this.searchBooks();this.searchSeries();},clear:function(){this.authors=[];this.books=[];this.series=[];this.authorsCount=0;this.booksCount=0;this.seriesCount=0;},searchFull:function(){if(this.q){this.terms=this.q.split(' ');this.clear();switch(this.which){case AUTHORS:this.searchAuthors();break;case BOOKS:this.searchBooks();break;case SERIES:this.searchSeries();break;default:this.searchAll();break;}}
 return false;},searchUrl:function(){if(this.urlParams.q){this.terms=this.urlParams.q.split(' ');this.clear();this.searchAll();this.q=this.urlParams.q;}},urlParse:function(){var match,pl=/\+/g,search=/([^&=]+)=?([^&]*)/g,decode=function(s){return decodeURIComponent(s.replace(pl," "));},query=window.location.search.substring(1);while(match=search.exec(query))
-this.urlParams[decode(match[1])]=decode(match[2]);}},created:function(){this.urlParse();},mounted:function(){this.searchUrl();}});}
+this.urlParams[decode(match[1])]=decode(match[2]);}},created:function(){this.urlParse();},mounted:function(){this.searchUrl();}});}if(document.getElementById("reader")){new Vue({el:'#reader',data:{book:0,spine:[],toc:[],index:0,fraction:0,chapter:'',timer:null},methods:{frame:function(){return this.$refs.frame;},scroller:function(){var doc=this.frame().contentDocument;return doc?(doc.scrollingElement||doc.documentElement):null;},spineIndex:function(href){var path=href.split('#')[0];for(var i=0;i<this.spine.length;i++){if(this.spine[i].href==path)return i;}return-1;},show:function(i,fraction){this.index=i;this.fraction=fraction;this.frame().src=this.spine[i].href;},goto:function(href){if(!href)return;var i=this.spineIndex(href);if(i<0)return;this.index=i;this.fraction=0;this.frame().src=href;},prev:function(){if(this.index>0)this.show(this.index-1,0);},next:function(){if(this.index<this.spine.length-1)this.show(this.index+1,0);},percentage:function(){if(!this.spine.length)return 0;return Math.round((this.index+this.fraction)/this.spine.length*100);},save:function(){if(!this.spine.length)return;sendData('PUT','/read/'+this.book+'/position',{href:this.spine[this.index].href,fraction:this.fraction,percentage:(this.index+this.fraction)/this.spine.length},stdError);},scrolled:function(){var s=this.scroller();var height=s.scrollHeight-s.clientHeight;this.fraction=height>0?Math.min(1,s.scrollTop/height):0;clearTimeout(this.timer);this.timer=setTimeout(this.save,2000);},frameLoaded:function(){var s=this.scroller();if(!s)return;var i=this.spineIndex(this.frame().contentWindow.location.pathname);if(i>=0&&i!=this.index){this.index=i;this.fraction=0;}
+if(this.fraction>0){s.scrollTop=this.fraction*(s.scrollHeight-s.clientHeight);}
+this.frame().contentWindow.addEventListener('scroll',this.scrolled);this.save();},loadBook:function(book){this.spine=book.spine;this.toc=flattenToc(book.toc,0,[]);if(!this.spine.length)return;var i=0,fraction=0;if(book.position){i=this.spineIndex(book.position.href);fraction=book.position.fraction;if(i<0){i=0;fraction=0;}}
+this.show(i,fraction);}},mounted:function(){this.book=this.$el.getAttribute('data-book');sendQuery('/read/'+this.book+'/book',stdError,this.loadBook);}});}
+if(document.getElementById("comic")){new Vue({el:'#comic',data:{book:0,format:'',pages:[],widths:[],index:0,double:false},methods:{shown:function(){if(!this.pages.length)return[];if(this.double&&this.index>0&&this.index<this.pages.length-1){return[this.index,this.index+1];}
+return[this.index];},last:function(){var shown=this.shown();return shown.length?shown[shown.length-1]:0;},width:function(){var available=this.$refs.pages.clientWidth*(window.devicePixelRatio||1);if(this.double)available=available/2;for(var i=0;i<this.widths.length;i++){if(this.widths[i]>=available)return this.widths[i];}
+return this.widths[this.widths.length-1];},pageUrl:function(i){return this.pages[i]+'&width='+this.width();},goto:function(i){i=Math.max(0,Math.min(i,this.pages.length-1));if(this.double&&i>0&&i%2==0)i--;this.index=i;window.scrollTo(0,0);this.save();},prev:function(){this.goto(this.double&&this.index>1?this.index-2:this.index-1);},next:function(){if(this.last()<this.pages.length-1)this.goto(this.last()+1);},toggleDouble:function(){this.double=!this.double;this.goto(this.index);},clicked:function(event){var bounds=this.$refs.pages.getBoundingClientRect();if(event.clientX-bounds.left<bounds.width/2)this.prev();else this.next();},keydown:function(event){if(event.target.tagName=='SELECT')return;if(event.key=='ArrowLeft')this.prev();else if(event.key=='ArrowRight'||event.key==' '){event.preventDefault();this.next();}},save:function(){if(!this.pages.length)return;sendData('PUT','/comic/'+this.book+'/position',{page:this.index,double:this.double,percentage:(this.last()+1)/this.pages.length},stdError);},loadBook:function(book){this.widths=book.widths;this.pages=book.pages;if(book.position){this.double=book.position.double;this.index=Math.min(book.position.page,Math.max(0,this.pages.length-1));}}},mounted:function(){this.book=this.$el.getAttribute('data-book');this.format=this.$el.getAttribute('data-format');window.addEventListener('keydown',this.keydown);sendQuery('/comic/'+this.book+'/pages?format='+this.format,stdError,this.loadBook);}});}
\ No newline at end of file
@@ -0,0 +1,105 @@
+package bouquins
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// RoleAdmin is the role of administrators
+	RoleAdmin = "admin"
+
+	pAccount = "account"
+)
+
+// AccountAdmin extends UserAccount with administration data
+type AccountAdmin struct {
+	UserAccount
+	Sessions int64
+}
+
+// AdminModel is the model of administration page
+type AdminModel struct {
+	Model
+	Accounts    []*AccountAdmin
+	Invitations []*Invitation
+	InviteURL   string
+	Shares      []*Share
+	Downloads   *DownloadsReport
+	Loans       []*Loan
+	Message     string
+}
+
+// IsAdmin checks if logged in user is an administrator
+func (app *Bouquins) IsAdmin(req *http.Request) bool {
+	account := app.AccountID(req)
+	if account == "" {
+		return false
+	}
+	admin, err := HasRole(account, RoleAdmin)
+	return err == nil && admin
+}
+
+// admin page actions
+func (app *Bouquins) adminAction(model *AdminModel, req *http.Request) error {
+	switch req.PostFormValue(pAction) {
+	case "logout":
+		if err := RevokeAllSessions(req.PostFormValue(pAccount)); err != nil {
+			return err
+		}
+		model.Message = "Sessions révoquées"
+	case "unshare":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		if err = DeleteShare(id); err != nil {
+			return err
+		}
+		model.Message = "Lien de partage révoqué"
+	default:
+		return app.invitationAction(model, req)
+	}
+	return nil
+}
+
+// AdminPage displays administration page: user accounts
+func (app *Bouquins) AdminPage(res http.ResponseWriter, req *http.Request) error {
+	if !app.IsAdmin(req) {
+		http.Error(res, "403 Forbidden", http.StatusForbidden)
+		return nil
+	}
+	model := &AdminModel{Model: *app.NewModel("Administration", "admin", req)}
+	if req.Method == http.MethodPost {
+		if err := app.adminAction(model, req); err != nil {
+			return err
+		}
+	}
+	return app.adminPage(res, req, model)
+}
+
+// adminPage loads and displays administration page data, with the message of an action
+func (app *Bouquins) adminPage(res http.ResponseWriter, req *http.Request, model *AdminModel) error {
+	var err error
+	model.Accounts, err = Accounts()
+	if err != nil {
+		return err
+	}
+	model.Invitations, err = Invitations()
+	if err != nil {
+		return err
+	}
+	model.Shares, err = Shares()
+	if err != nil {
+		return err
+	}
+	model.Downloads, err = downloadsReport(downloadsDays(req))
+	if err != nil {
+		return err
+	}
+	model.Loans, err = app.currentLoans(req)
+	if err != nil {
+		return err
+	}
+	return app.render(res, tplAdmin, model)
+}
@@ -0,0 +1,590 @@
+package bouquins
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	urlAnnotationsMarkdown = "markdown"
+
+	pLocation = "location"
+	pText     = "text"
+	pColour   = "colour"
+	pSidecar  = "sidecar"
+
+	defaultColour       = "yellow"
+	maxLocationLength   = 1024
+	maxAnnotationText   = 8000
+	maxAnnotationNote   = 4000
+	maxAnnotationBody   = 64 << 10
+	maxSidecarSize      = 4 << 20
+	maxSidecarDepth     = 32 // nested tables of sidecar files
+	sidecarDateFormat   = "2006-01-02 15:04:05"
+	markdownDateFormat  = "02/01/2006 15:04"
+	markdownContentType = "text/markdown; charset=utf-8"
+)
+
+// errSidecar is returned for a file which is not a KOReader sidecar (metadata.*.lua)
+var errSidecar = errors.New("invalid KOReader sidecar file")
+
+// AnnotationColour is a highlight colour, names of KOReader colours
+type AnnotationColour struct {
+	ID    string
+	Label string
+}
+
+// AnnotationColours are available highlight colours
+var AnnotationColours = []*AnnotationColour{
+	{"yellow", "Jaune"},
+	{"red", "Rouge"},
+	{"orange", "Orange"},
+	{"green", "Vert"},
+	{"olive", "Olive"},
+	{"cyan", "Cyan"},
+	{"blue", "Bleu"},
+	{"purple", "Violet"},
+	{"gray", "Gris"},
+}
+
+// Annotation is a highlight and/or note of a book by an user account
+type Annotation struct {
+	ID       int64  `json:"id"`
+	Book     int64  `json:"book"`
+	Location string `json:"location"` // EPUB CFI, KOReader xpointer or page
+	Text     string `json:"text"`     // highlighted text
+	Note     string `json:"note"`
+	Colour   string `json:"colour"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+}
+
+// validColour checks a highlight colour
+func validColour(colour string) bool {
+	for _, c := range AnnotationColours {
+		if c.ID == colour {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateRunes limits a string to max characters
+func truncateRunes(s string, max int) string {
+	if r := []rune(s); len(r) > max {
+		return string(r[:max])
+	}
+	return s
+}
+
+// clean trims and limits fields of an annotation, returns false if it has neither text nor note
+func (a *Annotation) clean() bool {
+	a.Location = truncateRunes(strings.TrimSpace(a.Location), maxLocationLength)
+	a.Text = truncateRunes(strings.TrimSpace(a.Text), maxAnnotationText)
+	a.Note = truncateRunes(strings.TrimSpace(a.Note), maxAnnotationNote)
+	a.Colour = strings.ToLower(a.Colour)
+	if !validColour(a.Colour) {
+		a.Colour = defaultColour
+	}
+	return a.Text != "" || a.Note != ""
+}
+
+// annotationsMarkdown exports annotations of a book as Markdown: highlights quoted, notes as paragraphs
+func annotationsMarkdown(book *BookFull, annotations []*Annotation) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", book.Title)
+	names := make([]string, 0, len(book.Authors))
+	for _, a := range book.Authors {
+		names = append(names, a.Name)
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(&b, "*%s*\n\n", strings.Join(names, ", "))
+	}
+	for _, a := range annotations {
+		if a.Text != "" {
+			for _, line := range strings.Split(a.Text, "\n") {
+				b.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+			}
+			b.WriteString("\n")
+		}
+		if a.Note != "" {
+			b.WriteString(a.Note + "\n\n")
+		}
+		fmt.Fprintf(&b, "*%s*\n\n---\n\n", time.Unix(a.Created, 0).Format(markdownDateFormat))
+	}
+	return b.Bytes()
+}
+
+// annotationsMarkdownPage sends annotations of a book as a Markdown file
+func annotationsMarkdownPage(res http.ResponseWriter, book *BookFull, annotations []*Annotation) error {
+	author := ""
+	if len(book.Authors) > 0 {
+		author = book.Authors[0].Name
+	}
+	name := downloadName(book.Title, author, strconv.FormatInt(book.ID, 10)) + ".md"
+	res.Header().Set("Content-Type", markdownContentType)
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	_, err := res.Write(annotationsMarkdown(book, annotations))
+	return err
+}
+
+// luaParser reads Lua table literals of KOReader sidecar files
+type luaParser struct {
+	s     string
+	i     int
+	depth int // nested tables being read
+}
+
+// skip skips spaces and comments
+func (p *luaParser) skip() {
+	for p.i < len(p.s) {
+		switch {
+		case strings.HasPrefix(p.s[p.i:], "--"):
+			if end := strings.IndexByte(p.s[p.i:], '\n'); end >= 0 {
+				p.i += end + 1
+			} else {
+				p.i = len(p.s)
+			}
+		case unicode.IsSpace(rune(p.s[p.i])):
+			p.i++
+		default:
+			return
+		}
+	}
+}
+
+// value reads a table, string, number or boolean (nil for nil)
+func (p *luaParser) value() (interface{}, error) {
+	p.skip()
+	if p.i >= len(p.s) {
+		return nil, errSidecar
+	}
+	switch c := p.s[p.i]; {
+	case c == '{':
+		return p.table()
+	case c == '"' || c == '\'':
+		return p.str(c)
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		start := p.i
+		for p.i < len(p.s) && strings.IndexByte("0123456789+-.eE", p.s[p.i]) >= 0 {
+			p.i++
+		}
+		return strconv.ParseFloat(p.s[start:p.i], 64)
+	}
+	word := p.name()
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "nil":
+		return nil, nil
+	}
+	return nil, errSidecar
+}
+
+// name reads an identifier
+func (p *luaParser) name() string {
+	start := p.i
+	for p.i < len(p.s) && (p.s[p.i] == '_' || unicode.IsLetter(rune(p.s[p.i])) || unicode.IsDigit(rune(p.s[p.i]))) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// str reads a quoted string with escapes
+func (p *luaParser) str(quote byte) (string, error) {
+	var b strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		if c == quote {
+			p.i++
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if p.i++; p.i >= len(p.s) {
+			break
+		}
+		switch c = p.s[p.i]; c {
+		case 'n', '\n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a', 'b', 'f', 'v':
+		default:
+			if c >= '0' && c <= '9' {
+				// decimal escape of up to 3 digits
+				end := p.i + 1
+				for end < len(p.s) && end < p.i+3 && p.s[end] >= '0' && p.s[end] <= '9' {
+					end++
+				}
+				code, _ := strconv.Atoi(p.s[p.i:end])
+				b.WriteByte(byte(code))
+				p.i = end - 1
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return "", errSidecar
+}
+
+// table reads a table as a map, keys of list items are their positions (from 1), up to maxSidecarDepth nested tables
+func (p *luaParser) table() (map[string]interface{}, error) {
+	if p.depth++; p.depth > maxSidecarDepth {
+		return nil, errSidecar
+	}
+	defer func() { p.depth-- }()
+	t := make(map[string]interface{})
+	p.i++
+	for n := 1; ; {
+		p.skip()
+		if p.i >= len(p.s) {
+			return nil, errSidecar
+		}
+		if p.s[p.i] == '}' {
+			p.i++
+			return t, nil
+		}
+		var key string
+		switch start := p.i; {
+		case p.s[p.i] == '[':
+			p.i++
+			k, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			key = luaString(k)
+			if p.skip(); p.i >= len(p.s) || p.s[p.i] != ']' {
+				return nil, errSidecar
+			}
+			p.i++
+			if p.skip(); p.i >= len(p.s) || p.s[p.i] != '=' {
+				return nil, errSidecar
+			}
+			p.i++
+		default:
+			if name := p.name(); name != "" {
+				if p.skip(); p.i < len(p.s) && p.s[p.i] == '=' {
+					key = name
+					p.i++
+					break
+				}
+			}
+			// list item
+			p.i = start
+			key = strconv.Itoa(n)
+			n++
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		t[key] = v
+		if p.skip(); p.i < len(p.s) && (p.s[p.i] == ',' || p.s[p.i] == ';') {
+			p.i++
+		}
+	}
+}
+
+// luaString converts a string or number value to a string
+func luaString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	}
+	return ""
+}
+
+// luaItems returns table values which are tables, in key order
+func luaItems(t map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+	items := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		if item, ok := t[k].(map[string]interface{}); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sidecarAnnotation converts a KOReader highlight, page is used as location without xpointer
+func sidecarAnnotation(item map[string]interface{}, page string) *Annotation {
+	a := &Annotation{Text: luaString(item["text"]), Note: luaString(item["note"]), Colour: luaString(item["color"])}
+	if pos, ok := item["pos0"].(string); ok {
+		a.Location = pos
+	} else if p, ok := item["page"].(string); ok {
+		a.Location = p
+	} else if p := luaString(item["page"]); p != "" {
+		a.Location = "page " + p
+	} else if page != "" {
+		a.Location = "page " + page
+	}
+	if t, err := time.ParseInLocation(sidecarDateFormat, luaString(item["datetime"]), time.Local); err == nil {
+		a.Created = t.Unix()
+	}
+	return a
+}
+
+// sidecarAnnotations reads highlights and notes of a KOReader sidecar file:
+// annotations list (KOReader 2024 and later) or highlights by page (older versions, without notes)
+func sidecarAnnotations(data string) ([]*Annotation, error) {
+	p := &luaParser{s: data}
+	if p.skip(); p.name() != "return" {
+		return nil, errSidecar
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errSidecar
+	}
+	annotations := make([]*Annotation, 0)
+	if list, ok := root["annotations"].(map[string]interface{}); ok {
+		for _, item := range luaItems(list) {
+			annotations = append(annotations, sidecarAnnotation(item, ""))
+		}
+		return annotations, nil
+	}
+	if pages, ok := root["highlight"].(map[string]interface{}); ok {
+		keys := make([]string, 0, len(pages))
+		for k := range pages {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return naturalLess(keys[i], keys[j]) })
+		for _, page := range keys {
+			if list, ok := pages[page].(map[string]interface{}); ok {
+				for _, item := range luaItems(list) {
+					annotations = append(annotations, sidecarAnnotation(item, page))
+				}
+			}
+		}
+	}
+	return annotations, nil
+}
+
+// importSidecar adds annotations of an uploaded KOReader sidecar file to a book, returns the number of new annotations
+func importSidecar(account string, book int64, req *http.Request) (int, error) {
+	f, _, err := req.FormFile(pSidecar)
+	if err != nil {
+		return 0, errSidecar
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSidecarSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > maxSidecarSize {
+		return 0, errSidecar
+	}
+	annotations, err := sidecarAnnotations(string(data))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, a := range annotations {
+		a.Book = book
+		if !a.clean() {
+			continue
+		}
+		exists, err := AnnotationExists(account, a)
+		if err != nil {
+			return count, err
+		}
+		if exists {
+			continue
+		}
+		if err = AddAnnotation(account, a); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// annotationsForm changes annotations of a book from book page forms: add (default), delete or import
+func annotationsForm(account string, book int64, res http.ResponseWriter, req *http.Request) error {
+	switch req.PostFormValue(pAction) {
+	case "delete":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		if err = DeleteAnnotation(account, id); err != nil {
+			return err
+		}
+	case "import":
+		if _, err := importSidecar(account, book, req); err == errSidecar {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	default:
+		a := &Annotation{
+			Book:     book,
+			Location: req.PostFormValue(pLocation),
+			Text:     req.PostFormValue(pText),
+			Note:     req.PostFormValue(pNote),
+			Colour:   req.PostFormValue(pColour),
+		}
+		if a.clean() {
+			if err := AddAnnotation(account, a); err != nil {
+				return err
+			}
+		}
+	}
+	http.Redirect(res, req, URLBooks+strconv.FormatInt(book, 10)+"#annotations", http.StatusSeeOther)
+	return nil
+}
+
+// decodeAnnotation reads an annotation sent as JSON
+func decodeAnnotation(req *http.Request) (*Annotation, error) {
+	a := new(Annotation)
+	err := json.NewDecoder(io.LimitReader(req.Body, maxAnnotationBody)).Decode(a)
+	return a, err
+}
+
+// annotationPage reads, updates (note and colour) or deletes an annotation of logged in user
+func annotationPage(account string, book int64, idParam string, res http.ResponseWriter, req *http.Request) error {
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.NotFound(res, req)
+		return nil
+	}
+	a, err := AnnotationByID(account, id)
+	if err == nil && a.Book != book {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return writeJSON(res, a)
+	case http.MethodPut:
+		update, err := decodeAnnotation(req)
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		a.Note, a.Colour = update.Note, update.Colour
+		if !a.clean() {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		if err = UpdateAnnotation(account, a); err != nil {
+			return err
+		}
+		return writeJSON(res, a)
+	case http.MethodDelete:
+		if err = DeleteAnnotation(account, id); err != nil {
+			return err
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	return nil
+}
+
+// AnnotationsPage lists, creates, exports and imports highlights and notes of logged in user:
+// /annotations/ (all books), /annotations/{book}, /annotations/{book}/markdown, /annotations/{book}/{id}
+func (app *Bouquins) AnnotationsPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		unauthorized(res)
+		return nil
+	}
+	if req.URL.Path == URLAnnotations {
+		annotations, err := Annotations(account)
+		if err != nil {
+			return err
+		}
+		return writeJSON(res, annotations)
+	}
+	id, action, ok := readerPath(req, URLAnnotations)
+	if !ok {
+		http.NotFound(res, req)
+		return nil
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	book, err := app.BookFull(filter, id)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "" && req.Method == http.MethodPost:
+		if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+			return annotationsForm(account, id, res, req)
+		}
+		a, err := decodeAnnotation(req)
+		if err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		if a.ID, a.Book, a.Created = 0, id, 0; !a.clean() {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		if err = AddAnnotation(account, a); err != nil {
+			return err
+		}
+		res.Header().Set("Location", URLAnnotations+strconv.FormatInt(id, 10)+"/"+strconv.FormatInt(a.ID, 10))
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(res).Encode(a)
+	case action == "" && req.Method == http.MethodGet:
+		annotations, err := BookAnnotations(account, id)
+		if err != nil {
+			return err
+		}
+		return writeJSON(res, annotations)
+	case action == urlAnnotationsMarkdown && req.Method == http.MethodGet:
+		annotations, err := BookAnnotations(account, id)
+		if err != nil {
+			return err
+		}
+		return annotationsMarkdownPage(res, book, annotations)
+	case action != "":
+		return annotationPage(account, id, action, res, req)
+	}
+	http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	return nil
+}
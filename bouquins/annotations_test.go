@@ -0,0 +1,90 @@
+package bouquins
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSidecar = `-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["chapter"] = "Chapitre 1",
+            ["color"] = "red",
+            ["datetime"] = "2024-03-01 10:20:30",
+            ["note"] = 'Une note',
+            ["pos0"] = "/body/DocFragment[2]/body/p[3]/text().0",
+            ["text"] = "Texte \"surlign\195\169\"\
+suite",
+        },
+        [2] = {
+            ["page"] = 12,
+            ["text"] = "Page",
+        },
+    },
+    ["doc_props"] = {
+        ["title"] = "Livre",
+    },
+    ["percent_finished"] = 0.25,
+    ["summary"] = { status = "reading"; modified = "2024-03-01" },
+}
+`
+
+const testOldSidecar = `return {
+    ["highlight"] = {
+        [10] = {
+            [1] = { ["text"] = "Dix", ["datetime"] = "2020-01-02 03:04:05" },
+        },
+        [2] = {
+            { text = "Deux" },
+        },
+    },
+}
+`
+
+func TestSidecarAnnotations(t *testing.T) {
+	annotations, err := sidecarAnnotations(testSidecar)
+	if err != nil || len(annotations) != 2 {
+		t.Fatalf("annotations %v (%v)", annotations, err)
+	}
+	a := annotations[0]
+	created := time.Date(2024, 3, 1, 10, 20, 30, 0, time.Local).Unix()
+	if a.Text != "Texte \"surligné\"\nsuite" || a.Note != "Une note" || a.Colour != "red" ||
+		a.Location != "/body/DocFragment[2]/body/p[3]/text().0" || a.Created != created {
+		t.Errorf("annotation %+v", a)
+	}
+	if a = annotations[1]; a.Text != "Page" || a.Location != "page 12" {
+		t.Errorf("annotation %+v", a)
+	}
+
+	if annotations, err = sidecarAnnotations(testOldSidecar); err != nil || len(annotations) != 2 {
+		t.Fatalf("old annotations %v (%v)", annotations, err)
+	}
+	if annotations[0].Text != "Deux" || annotations[0].Location != "page 2" || annotations[1].Location != "page 10" {
+		t.Errorf("old annotations %+v %+v", annotations[0], annotations[1])
+	}
+}
+
+func TestSidecarInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":          "",
+		"no return":      `{ ["text"] = "a" }`,
+		"not a table":    `return "a"`,
+		"unclosed table": `return { ["text"] = "a"`,
+		"unclosed str":   `return { ["text"] = "a }`,
+		"missing value":  `return { ["text"] = }`,
+		"bad key":        `return { ["text" = "a" }`,
+		"expression":     `return { text = os.exit() }`,
+		"too deep":       "return " + strings.Repeat("{", maxSidecarDepth+1) + strings.Repeat("}", maxSidecarDepth+1),
+		"very deep":      "return " + strings.Repeat("{ a = ", 1000000),
+	} {
+		if _, err := sidecarAnnotations(data); err != errSidecar {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	deepest := "return " + strings.Repeat("{", maxSidecarDepth) + strings.Repeat("}", maxSidecarDepth)
+	if _, err := sidecarAnnotations(deepest); err != nil {
+		t.Errorf("%d nested tables: %v", maxSidecarDepth, err)
+	}
+}
@@ -0,0 +1,255 @@
+package bouquins
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	authBearer = "Bearer "
+	authRealm  = `Basic realm="Bouquins"`
+
+	pAction   = "action"
+	pName     = "name"
+	pID       = "id"
+	pPassword = "password"
+	pCurrent  = "current"
+
+	minPasswordLength = 8
+)
+
+// key of request context values
+type contextKey int
+
+const (
+	ctxAccount contextKey = iota
+	ctxCSRF
+	ctxAPIClient
+)
+
+// SettingsModel is the model of user settings page
+type SettingsModel struct {
+	Model
+	Tokens      []*APIToken
+	NewToken    string
+	HasPassword bool
+	Identities  []string
+	Providers   []OAuth2Provider
+	Downloads   []*Download
+	Shelves     []*Shelf
+	KoboShelves map[int64]bool
+	KoboToken   int64 // creation date of Kobo sync token, 0 if none
+	NewKoboURL  string
+	SendEnabled bool
+	Devices     []*Device
+	Deliveries  []*Delivery
+	Message     string
+}
+
+// requestAccount returns user account authenticated by request Authorization header:
+// Bearer API token or Basic auth with API token or local password
+func requestAccount(req *http.Request) (*UserAccount, bool) {
+	header := req.Header.Get("Authorization")
+	if bearerAuth(req) {
+		account, err := TokenAccount(strings.TrimPrefix(header, authBearer))
+		return account, err == nil
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		if account, err := TokenAccount(password); err == nil {
+			return account, true
+		}
+		account, err := PasswordAccount(user, password)
+		return account, err == nil
+	}
+	return nil, false
+}
+
+// contextAccount returns user account authenticated by Authorization header or trusted proxy
+func contextAccount(req *http.Request) *UserAccount {
+	account, _ := req.Context().Value(ctxAccount).(*UserAccount)
+	return account
+}
+
+// bearerAuth checks if request is authenticated by a Bearer token, never sent automatically by browsers
+func bearerAuth(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), authBearer)
+}
+
+// apiClient checks if request is authenticated by a Bearer token or device credentials (no cookies)
+func apiClient(req *http.Request) bool {
+	client, _ := req.Context().Value(ctxAPIClient).(bool)
+	return client
+}
+
+// unauthorized responds with 401 and a Basic auth challenge
+func unauthorized(res http.ResponseWriter) {
+	res.Header().Set("WWW-Authenticate", authRealm)
+	http.Error(res, "401 Unauthorized", http.StatusUnauthorized)
+}
+
+// WithAuth authenticates requests with headers of a trusted proxy, or an Authorization header (API clients)
+func (app *Bouquins) WithAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, URLKosync) {
+			// KOReader sync API: own headers, errors answered by the API
+			ctx := context.WithValue(req.Context(), ctxAPIClient, true)
+			if account, ok := kosyncAccount(req); ok {
+				ctx = context.WithValue(ctx, ctxAccount, account)
+			}
+			next.ServeHTTP(res, req.WithContext(ctx))
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, URLKobo) {
+			// Kobo devices: Kobo sync token in URL
+			account, ok := koboAccount(req)
+			if !ok {
+				log.Println("Invalid Kobo token")
+				unauthorized(res)
+				return
+			}
+			ctx := context.WithValue(req.Context(), ctxAccount, account)
+			next.ServeHTTP(res, req.WithContext(context.WithValue(ctx, ctxAPIClient, true)))
+			return
+		}
+		if identity := app.proxyIdentity(req); identity != "" {
+			account, err := app.proxyAccount(identity)
+			if err != nil {
+				log.Println("Unknown proxy user", identity, err)
+				http.Error(res, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), ctxAccount, account)))
+			return
+		}
+		if req.Header.Get("Authorization") == "" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		account, ok := requestAccount(req)
+		if !ok {
+			log.Println("Invalid credentials", req.URL.Path)
+			unauthorized(res)
+			return
+		}
+		ctx := context.WithValue(req.Context(), ctxAccount, account)
+		if bearerAuth(req) {
+			// Basic credentials are cached and sent by browsers, only Bearer tokens skip CSRF check
+			ctx = context.WithValue(ctx, ctxAPIClient, true)
+		}
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// settings page actions
+func (app *Bouquins) settingsAction(model *SettingsModel, req *http.Request) error {
+	account := app.AccountID(req)
+	switch req.PostFormValue(pAction) {
+	case "token":
+		name := strings.TrimSpace(req.PostFormValue(pName))
+		if name == "" {
+			model.Message = "Nom du jeton obligatoire"
+			return nil
+		}
+		token, err := CreateToken(account, name)
+		if err != nil {
+			return err
+		}
+		model.NewToken = token
+	case "revoke":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		return RevokeToken(account, id)
+	case "password":
+		password := req.PostFormValue(pPassword)
+		if len(password) < minPasswordLength {
+			model.Message = "Mot de passe trop court"
+			return nil
+		}
+		// an existing password is changed only with the current one
+		hasPassword, err := HasPassword(account)
+		if err != nil {
+			return err
+		}
+		if hasPassword && CheckPassword(account, req.PostFormValue(pCurrent)) != nil {
+			model.Message = "Mot de passe actuel incorrect"
+			return nil
+		}
+		if err := SetPassword(account, password); err != nil {
+			return err
+		}
+		if err := kosyncPassword(account, password); err != nil {
+			return err
+		}
+		model.Message = "Mot de passe enregistré"
+	case "unlink":
+		return app.unlinkIdentity(model, req)
+	case "kobo":
+		return koboSettings(model, account, req)
+	case "kobo-token", "kobo-revoke":
+		return app.koboTokenSettings(model, account, req)
+	case "device", "device-delete":
+		return deviceAction(model, account, req)
+	}
+	return nil
+}
+
+// SettingsPage displays user settings: API tokens and local password
+func (app *Bouquins) SettingsPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	model := &SettingsModel{Model: *app.NewModel("Paramètres", "settings", req), Providers: Providers}
+	if req.Method == http.MethodPost {
+		if req.PostFormValue(pAction) == "link" {
+			return app.startLink(res, req)
+		}
+		if err := app.settingsAction(model, req); err != nil {
+			return err
+		}
+	}
+	var err error
+	model.Tokens, err = Tokens(account)
+	if err != nil {
+		return err
+	}
+	model.HasPassword, err = HasPassword(account)
+	if err != nil {
+		return err
+	}
+	model.Identities, err = Authentifiers(account)
+	if err != nil {
+		return err
+	}
+	model.Downloads, err = AccountDownloads(account, recentDownloads)
+	if err != nil {
+		return err
+	}
+	model.Shelves, err = userShelves(account)
+	if err != nil {
+		return err
+	}
+	model.KoboShelves, err = KoboShelves(account)
+	if err != nil {
+		return err
+	}
+	model.KoboToken, err = KoboToken(account)
+	if err != nil {
+		return err
+	}
+	if model.SendEnabled = app.sendEnabled(); model.SendEnabled {
+		if model.Devices, err = Devices(account); err != nil {
+			return err
+		}
+		if model.Deliveries, err = AccountDeliveries(account, recentDownloads); err != nil {
+			return err
+		}
+	}
+	return app.render(res, tplSettings, model)
+}
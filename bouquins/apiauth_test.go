@@ -0,0 +1,108 @@
+package bouquins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAPIAuth(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	token, err := CreateToken(account.ID, "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetPassword(account.ID, "local password"); err != nil {
+		t.Fatal(err)
+	}
+	server := app.WithAuth(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(app.AccountID(req)))
+	}))
+	request := func(header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, URLBooks, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res
+	}
+	basic := func(user, password string) string {
+		req := httptest.NewRequest(http.MethodGet, URLBooks, nil)
+		req.SetBasicAuth(user, password)
+		return req.Header.Get("Authorization")
+	}
+	for name, c := range map[string]struct {
+		header  string
+		account string
+	}{
+		"anonymous":      {"", ""},
+		"bearer":         {authBearer + token, "a1"},
+		"basic token":    {basic("anyone", token), "a1"},
+		"basic password": {basic("reader@example.org", "local password"), "a1"},
+	} {
+		if res := request(c.header); res.Code != http.StatusOK || res.Body.String() != c.account {
+			t.Errorf("%s: status %d, account %q", name, res.Code, res.Body.String())
+		}
+	}
+	for name, header := range map[string]string{
+		"unknown bearer": authBearer + "unknown",
+		"wrong password": basic("reader@example.org", "wrong"),
+		"unknown user":   basic("nobody@example.org", "local password"),
+	} {
+		if res := request(header); res.Code != http.StatusUnauthorized || res.Header().Get("WWW-Authenticate") != authRealm {
+			t.Errorf("%s: status %d", name, res.Code)
+		}
+	}
+
+	tokens, err := Tokens(account.ID)
+	if err != nil || len(tokens) != 1 || tokens[0].Name != "script" || tokens[0].LastUsed == 0 {
+		t.Fatalf("tokens %+v (%v)", tokens, err)
+	}
+	if err = RevokeToken(account.ID, tokens[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if res := request(authBearer + token); res.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d", res.Code)
+	}
+}
+
+func TestSettingsPassword(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	post := func(form url.Values) string {
+		req := sessionRequest(t, app, http.MethodPost, URLSettings, account)
+		req.PostForm = form
+		res := httptest.NewRecorder()
+		if err := app.SettingsPage(res, req); err != nil {
+			t.Fatal(err)
+		}
+		return res.Body.String()
+	}
+	if body := post(url.Values{pAction: {"password"}, pPassword: {"short"}}); !strings.Contains(body, "Mot de passe trop court") {
+		t.Error("short password accepted")
+	}
+	if body := post(url.Values{pAction: {"password"}, pPassword: {"first password"}}); !strings.Contains(body, "Mot de passe enregistré") {
+		t.Error("first password not set")
+	}
+	// current password required to change it
+	for _, current := range []string{"", "wrong"} {
+		body := post(url.Values{pAction: {"password"}, pPassword: {"second password"}, pCurrent: {current}})
+		if !strings.Contains(body, "Mot de passe actuel incorrect") {
+			t.Errorf("password changed with current password %q", current)
+		}
+	}
+	if err := CheckPassword(account.ID, "first password"); err != nil {
+		t.Error(err)
+	}
+	body := post(url.Values{pAction: {"password"}, pPassword: {"second password"}, pCurrent: {"first password"}})
+	if !strings.Contains(body, "Mot de passe enregistré") {
+		t.Error("password not changed")
+	}
+	if _, err := PasswordAccount("reader@example.org", "second password"); err != nil {
+		t.Error(err)
+	}
+}
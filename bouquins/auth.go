@@ -1,9 +1,14 @@
 package bouquins
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 
 	"github.com/gorilla/sessions"
@@ -11,11 +16,18 @@ import (
 )
 
 const (
-	alphanums            = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 	sessionName          = "bouquins"
 	sessionOAuthState    = "oauthState"
+	sessionOAuthVerifier = "oauthVerifier"
 	sessionOAuthProvider = "provider"
 	sessionUser          = "username"
+	sessionAccount       = "account"
+
+	sessionMaxAge = 30 * 24 * 3600
+
+	// labels to derive cookie keys from cookie secret
+	keySigning    = "bouquins session signing"
+	keyEncryption = "bouquins session encryption"
 
 	pProvider = "provider"
 )
@@ -29,11 +41,20 @@ var (
 type LoginModel struct {
 	Model
 	Providers []OAuth2Provider
+	LDAP      string // label of LDAP login form, empty if disabled
+	Message   string
 }
 
 // NewLoginModel constructor for LoginModel
 func (app *Bouquins) NewLoginModel(req *http.Request) *LoginModel {
-	return &LoginModel{*app.NewModel("Authentification", "provider", req), Providers}
+	model := &LoginModel{Model: *app.NewModel("Authentification", "provider", req), Providers: Providers}
+	if app.Conf.LDAP != nil {
+		model.LDAP = app.Conf.LDAP.Label
+		if model.LDAP == "" {
+			model.LDAP = "Annuaire"
+		}
+	}
+	return model
 }
 
 // OAuth2Provider allows to get a user from an OAuth2 token
@@ -45,23 +66,33 @@ type OAuth2Provider interface {
 	Icon() string
 }
 
-// generates a 16 characters long random string
-func securedRandString() string {
-	b := make([]byte, 16)
-	for i := range b {
-		b[i] = alphanums[rand.Intn(len(alphanums))]
+// generates a random string (URL safe base64) from length random bytes
+func securedRandString(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return string(b)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// derives a 32 bytes key from secret
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
 }
 
 // Session returns current session
 func (app *Bouquins) Session(req *http.Request) *sessions.Session {
-	session, _ := app.Cookies.Get(req, sessionName)
+	session, _ := app.Sessions.Get(req, sessionName)
 	return session
 }
 
 // Username returns logged in username
 func (app *Bouquins) Username(req *http.Request) string {
+	if account := contextAccount(req); account != nil {
+		return account.DisplayName
+	}
 	username := app.Session(req).Values[sessionUser]
 	if username != nil {
 		return username.(string)
@@ -69,6 +100,18 @@ func (app *Bouquins) Username(req *http.Request) string {
 	return ""
 }
 
+// AccountID returns logged in user account ID
+func (app *Bouquins) AccountID(req *http.Request) string {
+	if account := contextAccount(req); account != nil {
+		return account.ID
+	}
+	account := app.Session(req).Values[sessionAccount]
+	if account != nil {
+		return account.(string)
+	}
+	return ""
+}
+
 // SessionSet sets a value in session
 func (app *Bouquins) SessionSet(name string, value string, res http.ResponseWriter, req *http.Request) {
 	session := app.Session(req)
@@ -76,15 +119,27 @@ func (app *Bouquins) SessionSet(name string, value string, res http.ResponseWrit
 	session.Save(req, res)
 }
 
-// LoginPage redirects to OAuth login page (github)
+// LoginPage redirects to OAuth login page (github), or authenticates LDAP login form
 func (app *Bouquins) LoginPage(res http.ResponseWriter, req *http.Request) error {
+	if req.Method == http.MethodPost && app.Conf.LDAP != nil && req.PostFormValue(pProvider) == providerLDAP {
+		return app.ldapLogin(res, req)
+	}
 	provider := req.URL.Query().Get(pProvider)
 	oauth := app.OAuthConf[provider]
 	if oauth != nil {
-		app.SessionSet(sessionOAuthProvider, provider, res, req)
-		state := securedRandString()
-		app.SessionSet(sessionOAuthState, state, res, req)
-		url := oauth.AuthCodeURL(state)
+		state, err := securedRandString(16)
+		if err != nil {
+			return err
+		}
+		verifier := oauth2.GenerateVerifier()
+		session := app.Session(req)
+		session.Values[sessionOAuthProvider] = provider
+		session.Values[sessionOAuthState] = state
+		session.Values[sessionOAuthVerifier] = verifier
+		if err = session.Save(req, res); err != nil {
+			return err
+		}
+		url := oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
 		log.Println("OAuth redirect", url)
 		http.Redirect(res, req, url, http.StatusTemporaryRedirect)
 		return nil
@@ -93,33 +148,50 @@ func (app *Bouquins) LoginPage(res http.ResponseWriter, req *http.Request) error
 	return app.render(res, tplProvider, app.NewLoginModel(req))
 }
 
-// LogoutPage logout connected user
+// LogoutPage logout connected user (POST only)
 func (app *Bouquins) LogoutPage(res http.ResponseWriter, req *http.Request) error {
-	app.SessionSet(sessionUser, "", res, req)
-	return RedirectHome(res, req)
+	if req.Method != http.MethodPost {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	session := app.Session(req)
+	delete(session.Values, sessionUser)
+	delete(session.Values, sessionAccount)
+	delete(session.Values, sessionCSRF)
+	if err := session.Save(req, res); err != nil {
+		return err
+	}
+	http.Redirect(res, req, URLIndex, http.StatusSeeOther)
+	return nil
 }
 
 // CallbackPage handle OAuth 2 callback
 func (app *Bouquins) CallbackPage(res http.ResponseWriter, req *http.Request) error {
-	savedState := app.Session(req).Values[sessionOAuthState]
-	providerParam := app.Session(req).Values[sessionOAuthProvider]
-	if savedState == "" || providerParam == "" {
+	session := app.Session(req)
+	savedState, _ := session.Values[sessionOAuthState].(string)
+	verifier, _ := session.Values[sessionOAuthVerifier].(string)
+	providerName, _ := session.Values[sessionOAuthProvider].(string)
+	// OAuth data are single use
+	delete(session.Values, sessionOAuthState)
+	delete(session.Values, sessionOAuthVerifier)
+	delete(session.Values, sessionOAuthProvider)
+	if err := session.Save(req, res); err != nil {
+		return err
+	}
+	if savedState == "" || verifier == "" || providerName == "" {
 		return fmt.Errorf("missing oauth data")
 	}
-	providerName := providerParam.(string)
 	oauth := app.OAuthConf[providerName]
 	provider := findProvider(providerName)
 	if oauth == nil || provider == nil {
 		return fmt.Errorf("missing oauth configuration")
 	}
-	app.SessionSet(sessionOAuthState, "", res, req)
-	app.SessionSet(sessionOAuthProvider, "", res, req)
 	state := req.FormValue("state")
-	if state != savedState {
-		return fmt.Errorf("invalid oauth state, expected '%s', got '%s'", "state", state)
+	if subtle.ConstantTimeCompare([]byte(state), []byte(savedState)) != 1 {
+		return fmt.Errorf("invalid oauth state")
 	}
 	code := req.FormValue("code")
-	token, err := oauth.Exchange(oauth2.NoContext, code)
+	token, err := oauth.Exchange(req.Context(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return fmt.Errorf("Code exchange failed with '%s'", err)
 	}
@@ -127,12 +199,55 @@ func (app *Bouquins) CallbackPage(res http.ResponseWriter, req *http.Request) er
 	if err != nil {
 		return err
 	}
-	user, err := Account(userEmail)
+	if userEmail == "" {
+		return fmt.Errorf("no verified email")
+	}
+	link, _ := session.Values[sessionLink].(string)
+	delete(session.Values, sessionLink)
+	if link != "" && link == app.AccountID(req) {
+		// new identity for logged in user
+		return app.linkIdentity(link, userEmail, res, req)
+	}
+	user, err := app.loginAccount(userEmail, req)
 	if err != nil {
 		log.Println("Error loading user", err)
 		return fmt.Errorf("Unknown user")
 	}
-	app.SessionSet(sessionUser, user.DisplayName, res, req)
+	return app.startSession(user, res, req)
+}
+
+// loginAccount returns user account of an authenticated identity,
+// unknown user is registered with pending invitation or allowed domain
+func (app *Bouquins) loginAccount(authentifier string, req *http.Request) (*UserAccount, error) {
+	session := app.Session(req)
+	invite, _ := session.Values[sessionInvite].(string)
+	delete(session.Values, sessionInvite)
+	user, err := Account(authentifier)
+	if err == sql.ErrNoRows {
+		user, err = app.register(invite, authentifier)
+	}
+	return user, err
+}
+
+// startSession logs in user account in current session
+func (app *Bouquins) startSession(user *UserAccount, res http.ResponseWriter, req *http.Request) error {
+	session := app.Session(req)
+	// new session ID for logged in user
+	if renewer, ok := app.Sessions.(interface {
+		Renew(*sessions.Session) error
+	}); ok {
+		if err := renewer.Renew(session); err != nil {
+			return err
+		}
+	}
+	session.Values[sessionUser] = user.DisplayName
+	session.Values[sessionAccount] = user.ID
+	// new CSRF token for logged in user
+	delete(session.Values, sessionCSRF)
+	if err := session.Save(req, res); err != nil {
+		return err
+	}
+	clearAnonymousCSRF(res)
 	log.Println("User logged in", user.DisplayName)
 	return RedirectHome(res, req)
 }
@@ -0,0 +1,114 @@
+package bouquins
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// testProvider is an OAuth2 provider returning a fixed email
+type testProvider struct {
+	email string
+}
+
+func (p *testProvider) GetUser(token *oauth2.Token) (string, error) { return p.email, nil }
+func (p *testProvider) Config(conf *Conf) *oauth2.Config            { return nil }
+func (p *testProvider) Name() string                                { return "test" }
+func (p *testProvider) Label() string                               { return "Test" }
+func (p *testProvider) Icon() string                                { return "" }
+
+// withCookies returns a request to target with cookies of a response (last value of each cookie, like browsers)
+func withCookies(target string, res *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range res.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestOAuthLogin(t *testing.T) {
+	app := newTestApp(t)
+	testAccount(t, app, "a1", "reader@example.org")
+	var verifier string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		verifier = req.PostFormValue("code_verifier")
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(map[string]string{"access_token": "access", "token_type": "bearer"})
+	}))
+	defer tokenServer.Close()
+	saved := Providers
+	Providers = []OAuth2Provider{&testProvider{"reader@example.org"}}
+	defer func() { Providers = saved }()
+	app.OAuthConf["test"] = &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://provider.test/auth", TokenURL: tokenServer.URL},
+	}
+
+	login := httptest.NewRecorder()
+	if err := app.LoginPage(login, httptest.NewRequest(http.MethodGet, "/login?provider=test", nil)); err != nil {
+		t.Fatal(err)
+	}
+	redirect, err := url.Parse(login.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := redirect.Query().Get("state")
+	if state == "" || redirect.Query().Get("code_challenge") == "" || redirect.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("OAuth redirect without state or PKCE challenge: %s", redirect)
+	}
+	for _, c := range login.Result().Cookies() {
+		if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Secure {
+			t.Errorf("session cookie flags: %+v", c)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	if err = app.CallbackPage(res, withCookies("/callback?code=c&state=forged", login)); err == nil {
+		t.Error("callback with invalid state accepted")
+	}
+	// state is single use, even after a failed attempt
+	if err = app.CallbackPage(httptest.NewRecorder(), withCookies("/callback?code=c&state="+state, res)); err == nil {
+		t.Error("callback accepted a consumed state")
+	}
+
+	login = httptest.NewRecorder()
+	if err = app.LoginPage(login, httptest.NewRequest(http.MethodGet, "/login?provider=test", nil)); err != nil {
+		t.Fatal(err)
+	}
+	redirect, _ = url.Parse(login.Header().Get("Location"))
+	res = httptest.NewRecorder()
+	if err = app.CallbackPage(res, withCookies("/callback?code=c&state="+redirect.Query().Get("state"), login)); err != nil {
+		t.Fatal(err)
+	}
+	if verifier == "" {
+		t.Error("code exchange without PKCE verifier")
+	}
+	if account := app.AccountID(withCookies(URLIndex, res)); account != "a1" {
+		t.Errorf("logged in account %q, expected a1", account)
+	}
+}
+
+func TestNewSessionStore(t *testing.T) {
+	store, err := NewSessionStore(&Conf{CookieSecret: "secret", ExternalURL: "https://bouquins.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Options.Secure || !store.Options.HttpOnly {
+		t.Errorf("https cookies without Secure or HttpOnly flag: %+v", store.Options)
+	}
+	conf := &Conf{}
+	if _, err = NewSessionStore(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.CookieSecret == "" {
+		t.Error("no random secret without cookie-secret")
+	}
+}
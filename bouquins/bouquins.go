@@ -4,13 +4,13 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 
@@ -29,6 +29,16 @@ const (
 	tplSearch   = "search.html"
 	tplAbout    = "about.html"
 	tplProvider = "provider.html"
+	tplSettings = "settings.html"
+	tplSessions = "sessions.html"
+	tplAdmin    = "admin.html"
+	tplInvite   = "invite.html"
+	tplShare    = "share.html"
+	tplShelves  = "shelves.html"
+	tplShelf    = "shelf.html"
+	tplReading  = "reading.html"
+	tplReader   = "reader.html"
+	tplComic    = "comic.html"
 
 	pList    = "list"
 	pOrder   = "order"
@@ -55,19 +65,44 @@ const (
 	URLSearch = "/search/"
 	// URLAbout url of about page
 	URLAbout = "/about/"
+	// URLSettings url of user settings page
+	URLSettings = "/settings/"
+	// URLSessions url of user active sessions page
+	URLSessions = "/sessions/"
+	// URLAdmin url of administration page
+	URLAdmin = "/admin/"
+	// URLInvite url of invitation links
+	URLInvite = "/invite/"
+	// URLShare url of share links page
+	URLShare = "/share/"
+	// URLShelves url of user shelves pages
+	URLShelves = "/shelves/"
+	// URLReading url of read status and year in books page
+	URLReading = "/reading/"
+	// URLReviews url of ratings and reviews changes
+	URLReviews = "/reviews/"
+	// URLKosync url prefix of KOReader progress sync API
+	URLKosync = "/kosync/"
+	// URLKobo url prefix of Kobo store sync API, followed by an API token
+	URLKobo = "/kobo/"
+	// URLSend url of book files sending to e-readers by email
+	URLSend = "/send/"
+	// URLRead url of in-browser reader pages
+	URLRead = "/read/"
+	// URLComic url of comic reader pages
+	URLComic = "/comic/"
+	// URLAnnotations url of highlights and notes of books
+	URLAnnotations = "/annotations/"
+	// URLLoans url of physical book loans
+	URLLoans = "/loans/"
 	// URLJs url of js assets
 	URLJs = "/" + Version + "/js/"
 	// URLCss url of css assets
 	URLCss = "/" + Version + "/css/"
 	// URLFonts url of fonts assets
 	URLFonts = "/" + Version + "/fonts/"
-	// URLCalibre url of calibre resources (covers, ebooks files)
-	URLCalibre = "/calibre/"
 )
 
-// UnprotectedCalibreSuffix lists suffixe of calibre file not protected by auth
-var UnprotectedCalibreSuffix = [1]string{"jpg"}
-
 // Conf App configuration
 type Conf struct {
 	BindAddress   string         `json:"bind-address"`
@@ -78,6 +113,16 @@ type Conf struct {
 	CookieSecret  string         `json:"cookie-secret"`
 	ExternalURL   string         `json:"external-url"`
 	ProvidersConf []ProviderConf `json:"providers"`
+	// RegistrationDomains email domains allowed to create an account without invitation
+	RegistrationDomains []string `json:"registration-domains"`
+	// ProxyAuth enables authentication by a trusted reverse proxy
+	ProxyAuth *ProxyAuthConf `json:"proxy-auth"`
+	// LDAP enables authentication by LDAP bind
+	LDAP *LDAPConf `json:"ldap"`
+	// ThumbnailsPath is the cache directory of covers thumbnails
+	ThumbnailsPath string `json:"thumbnails-path"`
+	// SMTP enables sending book files to e-readers by email
+	SMTP *SMTPConf `json:"smtp"`
 }
 
 // ProviderConf OAuth2 provider configuration
@@ -94,7 +139,11 @@ type Bouquins struct {
 	UserDB *sql.DB
 	*Conf
 	OAuthConf map[string]*oauth2.Config
-	Cookies   *sessions.CookieStore
+	Sessions  sessions.Store
+
+	trustedProxies []*net.IPNet
+	mailWake       chan struct{}   // wakes up mail queue
+	comics         comicPagesCache // page lists of comic book files
 }
 
 // UserAccount is an user account
@@ -103,6 +152,14 @@ type UserAccount struct {
 	DisplayName string
 }
 
+// APIToken is a token allowing an user to authenticate non-browser clients
+type APIToken struct {
+	ID       int64
+	Name     string
+	Created  int64
+	LastUsed int64
+}
+
 // Series is a book series.
 type Series struct {
 	ID   int64  `json:"id,omitempty"`
@@ -115,6 +172,7 @@ type Book struct {
 	Title       string  `json:"title,omitempty"`
 	SeriesIndex float64 `json:"series_idx,omitempty"`
 	Series      *Series `json:"series,omitempty"`
+	HasCover    bool    `json:"has_cover,omitempty"`
 }
 
 // Author contains basic data on author
@@ -139,8 +197,11 @@ type BookData struct {
 // BookAdv extends Book with authors and tags
 type BookAdv struct {
 	Book
-	Authors []*Author `json:"authors,omitempty"`
-	Tags    []string  `json:"tags,omitempty"`
+	Authors   []*Author `json:"authors,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Rating    int       `json:"rating,omitempty"`     // rating of logged in user
+	AvgRating float64   `json:"avg_rating,omitempty"` // average rating of all users
+	Ratings   int       `json:"ratings,omitempty"`    // number of ratings
 }
 
 // AuthorFull extends Author with books, series and co-authors
@@ -161,9 +222,9 @@ type BookFull struct {
 	Lccn      string      `json:"lccn,omitempty"`
 	Path      string      `json:"path,omitempty"`
 	UUID      string      `json:"uuid,omitempty"`
-	HasCover  bool        `json:"has_cover,omitempty"`
 	Lang      string      `json:"lang,omitempty"`
 	Publisher string      `json:"publisher,omitempty"`
+	Reviews   []*Review   `json:"reviews,omitempty"`
 }
 
 // SeriesAdv extends Series with count of books and authors
@@ -181,19 +242,23 @@ type SeriesFull struct {
 
 // Model is basic page model
 type Model struct {
-	Title    string
-	Page     string
-	Version  string
-	Username string
+	Title     string
+	Page      string
+	Version   string
+	Username  string
+	Admin     bool
+	CSRFToken string
 }
 
 // NewModel constructor for Model
 func (app *Bouquins) NewModel(title, page string, req *http.Request) *Model {
 	return &Model{
-		Title:    title,
-		Page:     page,
-		Version:  Version,
-		Username: app.Username(req),
+		Title:     title,
+		Page:      page,
+		Version:   Version,
+		Username:  app.Username(req),
+		Admin:     app.IsAdmin(req),
+		CSRFToken: csrfToken(req),
 	}
 }
 
@@ -257,18 +322,34 @@ func NewSeriesResultsModel(series []*SeriesAdv, more bool, count int) *SeriesRes
 type BookModel struct {
 	Model
 	*BookFull
+	Shelves  []*Shelf  // shelves of logged in user
+	Reading  *Reading  // read status of logged in user
+	Review   *Review   // rating and review of logged in user
+	Progress *Progress // KOReader reading position of logged in user
+	// highlights and notes of logged in user
+	Annotations []*Annotation
+	// current loan of the physical book, user accounts for new loans (administrators)
+	Loan     *Loan
+	Accounts []*AccountAdmin
+	// e-readers and last deliveries of logged in user, if sending by email is configured
+	SendEnabled bool
+	Devices     []*Device
+	Deliveries  []*Delivery
 }
 
 // SeriesModel is the model for single series page
 type SeriesModel struct {
 	Model
 	*SeriesFull
+	Statuses map[int64]*Reading // read status of logged in user by book
+	Read     int                // number of finished books
 }
 
 // AuthorModel is the model for single author page
 type AuthorModel struct {
 	Model
 	*AuthorFull
+	Statuses map[int64]*Reading // read status of logged in user by book
 }
 
 // ReqParams contains request parameters for searches and lists
@@ -279,6 +360,7 @@ type ReqParams struct {
 	Order    string
 	Terms    []string
 	AllWords bool
+	Filter   *BookFilter
 }
 
 // TemplatesFunc adds functions to templates
@@ -294,12 +376,38 @@ func TemplatesFunc(prod bool) *template.Template {
 		"humanSize": func(sz int64) string {
 			return datasize.ByteSize(sz).HumanReadable()
 		},
+		"csrfField": csrfField,
+		"formatDate": func(ts int64) string {
+			return time.Unix(ts, 0).Format("02/01/2006 15:04")
+		},
+		"formatDay": formatDay,
+		"readStatuses": func() []*ReadStatus {
+			return ReadStatuses
+		},
+		"annotationColours": func() []*AnnotationColour {
+			return AnnotationColours
+		},
+		"stars": func(rating interface{}) string {
+			switch r := rating.(type) {
+			case int:
+				return stars(r)
+			case float64:
+				return stars(int(r + 0.5))
+			}
+			return ""
+		},
+		"ratings": func() []int {
+			r := make([]int, maxRating)
+			for i := range r {
+				r[i] = i + 1
+			}
+			return r
+		},
 		"bookCover": func(book *BookFull) string {
-			fmt.Println(book.Path)
-			return "/calibre/" + url.PathEscape(book.Path) + "/cover.jpg"
+			return bookCoverURL(book.ID)
 		},
 		"bookLink": func(data *BookData, book *BookFull) string {
-			return "/calibre/" + url.PathEscape(book.Path) + "/" + url.PathEscape(data.Name) + "." + strings.ToLower(data.Format)
+			return bookFileURL(book.ID, data.Format)
 		},
 	})
 }
@@ -351,7 +459,7 @@ func paramOrder(req *http.Request) string {
 }
 
 // get common request parameters
-func params(req *http.Request) *ReqParams {
+func params(req *http.Request, filter *BookFilter) *ReqParams {
 	page, perpage := paramInt(pPage, req), paramInt(pPerPage, req)
 	limit := perpage
 	if perpage == 0 {
@@ -364,7 +472,7 @@ func params(req *http.Request) *ReqParams {
 	sort := req.URL.Query().Get(pSort)
 	order := paramOrder(req)
 	terms := req.URL.Query()[pTerm]
-	return &ReqParams{limit, offset, sort, order, terms, false}
+	return &ReqParams{limit, offset, sort, order, terms, false, filter}
 }
 
 // single element or list elements page
@@ -385,17 +493,45 @@ func listOrID(res http.ResponseWriter, req *http.Request, url string,
 
 func (app *Bouquins) booksListPage(res http.ResponseWriter, req *http.Request) error {
 	if isJSON(req) {
-		books, count, more, err := app.BooksAdv(params(req))
+		filter, err := app.UserFilter(req)
 		if err != nil {
 			return err
 		}
+		if filter, err = app.statusFilter(filter, req); err != nil {
+			return err
+		}
+		if filter, err = app.ratingFilter(filter, req); err != nil {
+			return err
+		}
+		if filter, err = app.loanFilter(filter, req); err != nil {
+			return err
+		}
+		p := params(req, filter)
+		var books []*BookAdv
+		var count int
+		var more bool
+		if p.Sort == sortRating && len(p.Terms) == 0 {
+			books, count, more, err = app.booksByRating(p)
+		} else {
+			books, count, more, err = app.BooksAdv(p)
+		}
+		if err != nil {
+			return err
+		}
+		if err = app.assignRatings(books, app.AccountID(req)); err != nil {
+			return err
+		}
 		return writeJSON(res, NewBooksResultsModel(books, more, count))
 	}
 	return errors.New("Invalid mime")
 }
 func (app *Bouquins) authorsListPage(res http.ResponseWriter, req *http.Request) error {
 	if isJSON(req) {
-		authors, count, more, err := app.AuthorsAdv(params(req))
+		filter, err := app.UserFilter(req)
+		if err != nil {
+			return err
+		}
+		authors, count, more, err := app.AuthorsAdv(params(req, filter))
 		if err != nil {
 			return err
 		}
@@ -405,7 +541,11 @@ func (app *Bouquins) authorsListPage(res http.ResponseWriter, req *http.Request)
 }
 func (app *Bouquins) seriesListPage(res http.ResponseWriter, req *http.Request) error {
 	if isJSON(req) {
-		series, count, more, err := app.SeriesAdv(params(req))
+		filter, err := app.UserFilter(req)
+		if err != nil {
+			return err
+		}
+		series, count, more, err := app.SeriesAdv(params(req, filter))
 		if err != nil {
 			return err
 		}
@@ -421,40 +561,109 @@ func (app *Bouquins) bookPage(idParam string, res http.ResponseWriter, req *http
 	if err != nil {
 		return err
 	}
-	book, err := app.BookFull(int64(id))
+	filter, err := app.UserFilter(req)
 	if err != nil {
 		return err
 	}
-	return app.render(res, tplBooks, &BookModel{*app.NewModel(book.Title, "book", req), book})
+	book, err := app.BookFull(filter, int64(id))
+	if err != nil {
+		return err
+	}
+	account := app.AccountID(req)
+	if err = app.assignRatings([]*BookAdv{&book.BookAdv}, account); err != nil {
+		return err
+	}
+	if book.Reviews, err = BookReviews(book.ID); err != nil {
+		return err
+	}
+	if isJSON(req) {
+		return writeJSON(res, book)
+	}
+	model := &BookModel{Model: *app.NewModel(book.Title, "book", req), BookFull: book}
+	if account != "" {
+		if model.Shelves, err = bookShelves(account, book.ID); err != nil {
+			return err
+		}
+		if model.Reading, err = ReadingStatus(account, book.ID); err != nil {
+			return err
+		}
+		if model.Review, err = AccountReview(account, book.ID); err != nil {
+			return err
+		}
+		if model.Progress, err = BookProgress(account, book.ID); err != nil {
+			return err
+		}
+		if model.Annotations, err = BookAnnotations(account, book.ID); err != nil {
+			return err
+		}
+		if model.Loan, err = BookLoan(book.ID); err != nil {
+			return err
+		}
+		if model.Admin && model.Loan == nil {
+			if model.Accounts, err = Accounts(); err != nil {
+				return err
+			}
+		}
+		if model.SendEnabled = app.sendEnabled(); model.SendEnabled {
+			if model.Devices, err = Devices(account); err != nil {
+				return err
+			}
+			if model.Deliveries, err = BookDeliveries(account, book.ID, recentDeliveries); err != nil {
+				return err
+			}
+		}
+	}
+	return app.render(res, tplBooks, model)
 }
 func (app *Bouquins) authorPage(idParam string, res http.ResponseWriter, req *http.Request) error {
 	id, err := strconv.Atoi(idParam)
 	if err != nil {
 		return err
 	}
-	author, err := app.AuthorFull(int64(id))
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	author, err := app.AuthorFull(filter, int64(id))
 	if err != nil {
 		return err
 	}
-	return app.render(res, tplAuthors, &AuthorModel{*app.NewModel(author.Name, "author", req), author})
+	statuses, err := app.userReadings(req)
+	if err != nil {
+		return err
+	}
+	return app.render(res, tplAuthors, &AuthorModel{*app.NewModel(author.Name, "author", req), author, statuses})
 }
 func (app *Bouquins) seriePage(idParam string, res http.ResponseWriter, req *http.Request) error {
 	id, err := strconv.Atoi(idParam)
 	if err != nil {
 		return err
 	}
-	series, err := app.SeriesFull(int64(id))
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	series, err := app.SeriesFull(filter, int64(id))
 	if err != nil {
 		return err
 	}
-	return app.render(res, tplSeries, &SeriesModel{*app.NewModel(series.Name, "series", req), series})
+	model := &SeriesModel{Model: *app.NewModel(series.Name, "series", req), SeriesFull: series}
+	if model.Statuses, err = app.userReadings(req); err != nil {
+		return err
+	}
+	for _, book := range series.Books {
+		if r := model.Statuses[book.ID]; r != nil && r.Status == StatusFinished {
+			model.Read++
+		}
+	}
+	return app.render(res, tplSeries, model)
 }
 
 // ROUTES //
 
 // BooksPage displays a single books or a returns a list of books
 func (app *Bouquins) BooksPage(res http.ResponseWriter, req *http.Request) error {
-	return listOrID(res, req, URLBooks, app.booksListPage, app.bookPage)
+	return listOrID(res, req, URLBooks, app.booksListPage, app.bookResource)
 }
 
 // AuthorsPage displays a single author or returns a list of authors
@@ -479,7 +688,11 @@ func (app *Bouquins) AboutPage(res http.ResponseWriter, req *http.Request) error
 
 // IndexPage displays index page: list of books/authors/series
 func (app *Bouquins) IndexPage(res http.ResponseWriter, req *http.Request) error {
-	count, err := app.BookCount()
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	count, err := app.BookCount(filter)
 	if err != nil {
 		return err
 	}
@@ -489,21 +702,3 @@ func (app *Bouquins) IndexPage(res http.ResponseWriter, req *http.Request) error
 	}
 	return app.render(res, tplIndex, model)
 }
-
-func (app *Bouquins) CalibreFileServer() http.Handler {
-	calibre := app.Conf.CalibrePath
-	handler := http.StripPrefix(URLCalibre, http.FileServer(http.Dir(calibre)))
-	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		for _, suffix := range UnprotectedCalibreSuffix {
-			if strings.HasSuffix(req.URL.Path, suffix) {
-				handler.ServeHTTP(res, req)
-			}
-		}
-		// check auth
-		if app.Username(req) == "" {
-			http.Error(res, "401 Unauthorized", http.StatusUnauthorized)
-		} else {
-			handler.ServeHTTP(res, req)
-		}
-	})
-}
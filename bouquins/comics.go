@@ -0,0 +1,474 @@
+package bouquins
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif" // comic pages may be GIF
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nwaples/rardecode"
+	_ "golang.org/x/image/webp" // comic pages may be WebP
+)
+
+const (
+	urlComicPages    = "pages"
+	urlComicPage     = "page/"
+	urlComicPosition = "position"
+
+	comicDocument = "comic:" // prefix of progress documents of comic reader (book ID)
+	comicCache    = "comics" // sub directory of thumbnails-path for scaled pages
+	maxComicPage  = 64 << 20
+	maxPagePixels = 40 << 20 // decoded RGBA image of 160 MB
+	maxComicFiles = 256      // comic book files of page lists cache
+	pWidth        = "width"
+)
+
+// ComicPageSizes are allowed widths (pixels) of scaled comic pages
+var ComicPageSizes = []int{800, 1200, 1600}
+
+// comic book formats, in order of preference: PDF files are read for their JPEG images (scanned pages)
+var comicFormats = []string{"CBZ", "CBR", "PDF"}
+
+// image types of comic pages
+var pageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// ComicBook is the reading manifest of a comic book archive: page images in reading order
+type ComicBook struct {
+	ID       int64          `json:"id"`
+	Format   string         `json:"format"`
+	Pages    []string       `json:"pages"`  // page image URLs
+	Widths   []int          `json:"widths"` // allowed width parameter of page URLs
+	Position *ComicPosition `json:"position,omitempty"`
+}
+
+// ComicPosition is the reading position of comic reader
+type ComicPosition struct {
+	Page       int     `json:"page"`       // first displayed page, from 0
+	Double     bool    `json:"double"`     // double page mode
+	Percentage float64 `json:"percentage"` // position in book
+	Updated    int64   `json:"updated,omitempty"`
+}
+
+// ComicModel is the model of comic reader page
+type ComicModel struct {
+	Model
+	ID     int64
+	Format string
+}
+
+// comicURL returns the URL of the comic reader page of a book
+func comicURL(id int64) string {
+	return URLComic + strconv.FormatInt(id, 10)
+}
+
+// comicPageURL returns the URL of a page image of a comic book archive
+func comicPageURL(id int64, format string, page int) string {
+	return comicURL(id) + "/" + urlComicPage + strconv.Itoa(page) + "?" + pFormat + "=" + format
+}
+
+// comicPageWidth checks requested page width
+func comicPageWidth(param string) (int, bool) {
+	width, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, false
+	}
+	for _, w := range ComicPageSizes {
+		if w == width {
+			return width, true
+		}
+	}
+	return 0, false
+}
+
+// isComicPage checks if a file of an archive is a page image: hidden files and macOS metadata are ignored
+func isComicPage(name string) bool {
+	if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+		return false
+	}
+	_, ok := pageTypes[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// naturalLess compares file names with numbers in numeric order (page2 before page10)
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digitPrefix returns the length of leading digits of a string
+func digitPrefix(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// comicPages lists page images of a CBZ, CBR or PDF file, in reading order
+func comicPages(file, format string) ([]string, error) {
+	if format == "PDF" {
+		return pdfPages(file)
+	}
+	pages := make([]string, 0)
+	if format == "CBR" {
+		r, err := rardecode.OpenReader(file, "")
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !h.IsDir && isComicPage(h.Name) {
+				pages = append(pages, h.Name)
+			}
+		}
+	} else {
+		r, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() && isComicPage(f.Name) {
+				pages = append(pages, f.Name)
+			}
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+	return pages, nil
+}
+
+// comicPagesEntry is the page list of a comic book file, at a modification date
+type comicPagesEntry struct {
+	modified time.Time
+	size     int64
+	pages    []string
+}
+
+// comicPagesCache keeps page lists of comic book files: archives are only listed again when modified
+type comicPagesCache struct {
+	mu    sync.Mutex
+	files map[string]*comicPagesEntry
+}
+
+// pages returns the page list and modification date of a comic book file
+func (c *comicPagesCache) pages(file, format string) ([]string, time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c.mu.Lock()
+	e, ok := c.files[file]
+	c.mu.Unlock()
+	if ok && e.modified.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.pages, e.modified, nil
+	}
+	pages, err := comicPages(file, format)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = make(map[string]*comicPagesEntry)
+	}
+	if _, ok = c.files[file]; !ok && len(c.files) >= maxComicFiles {
+		// drop any other book
+		for f := range c.files {
+			delete(c.files, f)
+			break
+		}
+	}
+	c.files[file] = &comicPagesEntry{info.ModTime(), info.Size(), pages}
+	return pages, info.ModTime(), nil
+}
+
+// readComicPage reads a page image of a CBZ, CBR or PDF file, RAR archives are read up to the page
+func readComicPage(file, format, name string) ([]byte, time.Time, error) {
+	if format == "PDF" {
+		return readPDFPage(file, name)
+	}
+	if format == "CBR" {
+		r, err := rardecode.OpenReader(file, "")
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		defer r.Close()
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				return nil, time.Time{}, os.ErrNotExist
+			}
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			if h.Name == name {
+				data, err := ioutil.ReadAll(io.LimitReader(r, maxComicPage))
+				return data, h.ModificationTime, err
+			}
+		}
+	}
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer r.Close()
+	f := zipEntry(r, name)
+	if f == nil {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	data, err := readZipEntry(f, maxComicPage)
+	return data, f.Modified, err
+}
+
+// comicFile returns the path and format of a comic book file: requested format or first available
+func (app *Bouquins) comicFile(filter *BookFilter, id int64, format string) (string, string, error) {
+	formats := comicFormats
+	if format != "" {
+		formats = []string{strings.ToUpper(format)}
+	}
+	for _, f := range formats {
+		if !isComicFormat(f) {
+			break
+		}
+		file, _, _, err := app.bookFile(filter, id, f)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		return file, f, err
+	}
+	return "", "", sql.ErrNoRows
+}
+
+// isComicFormat checks if a book file format is read by the comic reader
+func isComicFormat(format string) bool {
+	for _, f := range comicFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// scaledPageFile returns the path of a cached scaled page, book file changes update its modification date
+func (app *Bouquins) scaledPageFile(id int64, format string, modified int64, page, width int) string {
+	return filepath.Join(app.Conf.ThumbnailsPath, comicCache, fmt.Sprintf("%d-%s-%d-%d-%d.jpg", id, format, modified, page, width))
+}
+
+// comicPagePage sends a page image scaled to requested width, largest one by default (generated on first request),
+// original image if it can not be scaled
+func (app *Bouquins) comicPagePage(id int64, format, file, pageParam string, res http.ResponseWriter, req *http.Request) error {
+	page, err := strconv.Atoi(pageParam)
+	if err != nil {
+		http.NotFound(res, req)
+		return nil
+	}
+	pages, modified, err := app.comics.pages(file, format)
+	if err != nil {
+		return err
+	}
+	if page < 0 || page >= len(pages) {
+		http.NotFound(res, req)
+		return nil
+	}
+	width := ComicPageSizes[len(ComicPageSizes)-1]
+	if widthParam := req.URL.Query().Get(pWidth); widthParam != "" {
+		var ok bool
+		if width, ok = comicPageWidth(widthParam); !ok {
+			http.NotFound(res, req)
+			return nil
+		}
+	}
+	res.Header().Set("Cache-Control", "private, max-age=86400")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	scaled := app.scaledPageFile(id, format, modified.Unix(), page, width)
+	if _, err = os.Stat(scaled); os.IsNotExist(err) {
+		err = app.scalePage(file, format, pages[page], scaled, width)
+	}
+	if err == nil {
+		f, err := os.Open(scaled)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		res.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(res, req, filepath.Base(scaled), modified, f)
+		return nil
+	}
+	// unsupported or too large image: original page is sent
+	log.Println("Error scaling comic page", id, format, page, err)
+	data, pageModified, err := readComicPage(file, format, pages[page])
+	if err != nil {
+		return err
+	}
+	res.Header().Set("Content-Type", pageTypes[strings.ToLower(path.Ext(pages[page]))])
+	http.ServeContent(res, req, path.Base(pages[page]), pageModified, bytes.NewReader(data))
+	return nil
+}
+
+// scalePage scales a page image and writes it in cache, images too large to decode are refused
+func (app *Bouquins) scalePage(file, format, name, scaled string, width int) error {
+	data, _, err := readComicPage(file, format, name)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxPagePixels {
+		return fmt.Errorf("page image of %dx%d pixels", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return writeScaled(src, scaled, width)
+}
+
+// comicPosition returns the position of comic reader of a book for an user account, nil if none
+func comicPosition(account string, id int64) (*ComicPosition, error) {
+	p, err := DocumentProgress(account, comicDocument+strconv.FormatInt(id, 10))
+	if err != nil || p == nil {
+		return nil, err
+	}
+	pos := new(ComicPosition)
+	if err = json.Unmarshal([]byte(p.Progress), pos); err != nil {
+		return nil, nil
+	}
+	pos.Percentage, pos.Updated = p.Percentage, p.Timestamp
+	return pos, nil
+}
+
+// saveComicPosition stores the position of comic reader sent as JSON
+func saveComicPosition(account string, id int64, req *http.Request) error {
+	pos := new(ComicPosition)
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxPositionLength)).Decode(pos); err != nil {
+		return err
+	}
+	if pos.Page < 0 {
+		pos.Page = 0
+	}
+	if pos.Percentage < 0 || pos.Percentage > 1 {
+		pos.Percentage = 0
+	}
+	data, err := json.Marshal(&ComicPosition{Page: pos.Page, Double: pos.Double})
+	if err != nil {
+		return err
+	}
+	return SetProgress(account, &Progress{
+		Document:   comicDocument + strconv.FormatInt(id, 10),
+		Progress:   string(data),
+		Percentage: pos.Percentage,
+		Device:     readerDevice,
+		Timestamp:  time.Now().Unix(),
+		Book:       id,
+	})
+}
+
+// ComicPage displays the comic reader of a CBZ, CBR or PDF book and serves its pages and position
+func (app *Bouquins) ComicPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		if isJSON(req) || req.Method != http.MethodGet {
+			unauthorized(res)
+			return nil
+		}
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	id, action, ok := readerPath(req, URLComic)
+	if !ok {
+		http.NotFound(res, req)
+		return nil
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	file, format, err := app.comicFile(filter, id, req.URL.Query().Get(pFormat))
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "":
+		book, err := app.BookFull(filter, id)
+		if err != nil {
+			return err
+		}
+		return app.render(res, tplComic, &ComicModel{*app.NewModel(book.Title, "comic", req), id, format})
+	case action == urlComicPages:
+		pages, _, err := app.comics.pages(file, format)
+		if err != nil {
+			return err
+		}
+		book := &ComicBook{ID: id, Format: format, Pages: make([]string, len(pages)), Widths: ComicPageSizes}
+		for i := range pages {
+			book.Pages[i] = comicPageURL(id, format, i)
+		}
+		if book.Position, err = comicPosition(account, id); err != nil {
+			return err
+		}
+		return writeJSON(res, book)
+	case action == urlComicPosition && (req.Method == http.MethodPut || req.Method == http.MethodPost):
+		if err = saveComicPosition(account, id, req); err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return nil
+	case strings.HasPrefix(action, urlComicPage):
+		return app.comicPagePage(id, format, file, strings.TrimPrefix(action, urlComicPage), res, req)
+	}
+	http.NotFound(res, req)
+	return nil
+}
@@ -0,0 +1,209 @@
+package bouquins
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPNG encodes a PNG image of a size
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugePNG returns a PNG image header claiming a size of billions of pixels
+func hugePNG(t *testing.T) []byte {
+	data := testPNG(t, 1, 1)
+	// IHDR chunk: length, type, width, height... then CRC of type and data
+	binary.BigEndian.PutUint32(data[16:], 100000)
+	binary.BigEndian.PutUint32(data[20:], 100000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+// testCBZ builds a CBZ archive of page images by name
+func testCBZ(t *testing.T, pages map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range pages {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestComicPagesCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "book.cbz")
+	page := testPNG(t, 10, 10)
+	if err := os.WriteFile(file, testCBZ(t, map[string][]byte{"p10.png": page, "p2.png": page, ".hidden.png": page}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cache comicPagesCache
+	pages, _, err := cache.pages(file, "CBZ")
+	if err != nil || len(pages) != 2 || pages[0] != "p2.png" || pages[1] != "p10.png" {
+		t.Fatalf("pages %v (%v)", pages, err)
+	}
+	cached, _, err := cache.pages(file, "CBZ")
+	if err != nil || &cached[0] != &pages[0] {
+		t.Errorf("archive listed again (%v)", err)
+	}
+	// modified book file
+	if err = os.WriteFile(file, testCBZ(t, map[string][]byte{"p1.png": page}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	pages, modified, err := cache.pages(file, "CBZ")
+	if err != nil || len(pages) != 1 || pages[0] != "p1.png" || !modified.Equal(later) {
+		t.Errorf("pages of modified file %v %v (%v)", pages, modified, err)
+	}
+}
+
+func TestComicPage(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	cbz := testCBZ(t, map[string][]byte{"01.png": testPNG(t, 2000, 100), "02.png": hugePNG(t)})
+	testBook(t, app, 1, "Comic", "Author", map[string][]byte{"CBZ": cbz})
+	get := func(target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		if err := app.ComicPage(res, accountRequest(http.MethodGet, target, account)); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// largest width by default, then from cache
+	res := get("/comic/1/page/0")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("default page: status %d %v", res.Code, res.Header())
+	}
+	img, _, err := image.Decode(res.Body)
+	if err != nil || img.Bounds().Dx() != ComicPageSizes[len(ComicPageSizes)-1] {
+		t.Errorf("default page %v (%v)", img.Bounds(), err)
+	}
+	scaled, err := filepath.Glob(filepath.Join(app.Conf.ThumbnailsPath, comicCache, "1-CBZ-*-0-1600.jpg"))
+	if err != nil || len(scaled) != 1 {
+		t.Fatalf("scaled pages %v (%v)", scaled, err)
+	}
+	if err = os.WriteFile(scaled[0], []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if res = get("/comic/1/page/0"); res.Body.String() != "cached" {
+		t.Error("scaled page not served from cache")
+	}
+	if res = get("/comic/1/page/0?width=800"); res.Code != http.StatusOK {
+		t.Errorf("800 pixels page: status %d", res.Code)
+	} else if img, _, err = image.Decode(res.Body); err != nil || img.Bounds().Dx() != 800 {
+		t.Errorf("800 pixels page %v (%v)", img, err)
+	}
+	if res = get("/comic/1/page/0?width=1000"); res.Code != http.StatusNotFound {
+		t.Errorf("unknown width: status %d", res.Code)
+	}
+	if res = get("/comic/1/page/2"); res.Code != http.StatusNotFound {
+		t.Errorf("unknown page: status %d", res.Code)
+	}
+
+	// too many pixels to decode: original image
+	res = get("/comic/1/page/1")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/png" || !bytes.Equal(res.Body.Bytes(), hugePNG(t)) {
+		t.Errorf("huge page: status %d %v", res.Code, res.Header())
+	}
+}
+
+// testJPEG encodes a JPEG image of a size
+func testJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testPDF builds a PDF file of image streams (dictionary and data), returns the file and offsets of data
+func testPDF(streams [][2][]byte) ([]byte, [][2]int) {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([][2]int, len(streams))
+	for i, s := range streams {
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s >>\nstream\r\n", i+1, s[0])
+		offsets[i][0] = buf.Len()
+		buf.Write(s[1])
+		offsets[i][1] = buf.Len()
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+	buf.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return buf.Bytes(), offsets
+}
+
+func TestComicPDF(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	first, second := testJPEG(t, 800, 20), testJPEG(t, 1000, 30)
+	content := []byte("BT /F1 12 Tf (stream) Tj ET")
+	pdf, offsets := testPDF([][2][]byte{
+		{[]byte(fmt.Sprintf("/Length %d", len(content))), content},
+		{[]byte(fmt.Sprintf("/Type /XObject /Subtype /Image /Width 800 /Height 20 /Filter /DCTDecode /Length %d", len(first))), first},
+		{[]byte("/Type /XObject /Subtype /Image /Width 100 /Height 10 /Filter /DCTDecode /Length 10"), testJPEG(t, 100, 10)[:10]},
+		{[]byte("/Subtype /Image /Width 800 /Height 20 /Filter [/FlateDecode /DCTDecode] /Length 4"), []byte("data")},
+		{[]byte("/Subtype/Image/Width 1000/Height 30/Filter[/DCTDecode]/Length 9 0 R"), second},
+	})
+	testBook(t, app, 1, "Comic", "Author", map[string][]byte{"PDF": pdf})
+	file := filepath.Join(app.Conf.CalibrePath, "Author", "Comic (1)", "Comic - Author.pdf")
+
+	pages, err := comicPages(file, "PDF")
+	expected := []string{fmt.Sprintf("%d-%d.jpg", offsets[1][0], offsets[1][1]), fmt.Sprintf("%d-%d.jpg", offsets[4][0], offsets[4][1])}
+	if err != nil || len(pages) != 2 || pages[0] != expected[0] || pages[1] != expected[1] {
+		t.Fatalf("pages %v, expected %v (%v)", pages, expected, err)
+	}
+	for i, page := range [][]byte{first, second} {
+		if data, _, err := readComicPage(file, "PDF", pages[i]); err != nil || !bytes.Equal(data, page) {
+			t.Errorf("page %d: %d bytes (%v)", i, len(data), err)
+		}
+	}
+	if _, _, err = readComicPage(file, "PDF", fmt.Sprintf("0-%d.jpg", len(pdf)+1)); err == nil {
+		t.Error("range out of file read")
+	}
+
+	res := httptest.NewRecorder()
+	if err = app.ComicPage(res, accountRequest(http.MethodGet, "/comic/1/pages", account)); err != nil {
+		t.Fatal(err)
+	}
+	var book ComicBook
+	if err = json.Unmarshal(res.Body.Bytes(), &book); err != nil || book.Format != "PDF" || len(book.Pages) != 2 {
+		t.Fatalf("pages of PDF book: %s (%v)", res.Body.String(), err)
+	}
+	res = httptest.NewRecorder()
+	if err = app.ComicPage(res, accountRequest(http.MethodGet, book.Pages[1], account)); err != nil {
+		t.Fatal(err)
+	}
+	if img, _, err := image.Decode(res.Body); err != nil || img.Bounds().Dx() != 1000 {
+		t.Errorf("PDF page: status %d (%v)", res.Code, err)
+	}
+}
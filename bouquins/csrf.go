@@ -0,0 +1,142 @@
+package bouquins
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	sessionCSRF = "csrf"
+	// pCSRF is the form field containing CSRF token
+	pCSRF = "csrf_token"
+	// headerCSRF is the request header containing CSRF token (javascript)
+	headerCSRF = "X-CSRF-Token"
+
+	csrfTokenLength = 32
+
+	// csrfCookie contains the signed CSRF token of visitors without session
+	csrfCookie       = "bouquins-csrf"
+	csrfCookieMaxAge = 24 * 3600
+	keyCSRF          = "bouquins csrf signing"
+)
+
+// safe methods do not change state, no CSRF check
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// validCSRF checks request token (form field or header) against session token
+func validCSRF(expected string, req *http.Request) bool {
+	if expected == "" {
+		return false
+	}
+	token := req.Header.Get(headerCSRF)
+	if token == "" {
+		token = req.PostFormValue(pCSRF)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// csrfToken returns CSRF token of current request (empty for API clients)
+func csrfToken(req *http.Request) string {
+	token, _ := req.Context().Value(ctxCSRF).(string)
+	return token
+}
+
+// csrfCodec signs CSRF cookie of visitors without session, with a key derived from cookie secret
+func (app *Bouquins) csrfCodec() *securecookie.SecureCookie {
+	codec := securecookie.New(deriveKey([]byte(app.Conf.CookieSecret), keyCSRF), nil)
+	codec.MaxAge(csrfCookieMaxAge)
+	return codec
+}
+
+// anonymousCSRF returns CSRF token from signed cookie, empty if none or invalid
+func (app *Bouquins) anonymousCSRF(req *http.Request) string {
+	c, err := req.Cookie(csrfCookie)
+	if err != nil {
+		return ""
+	}
+	var token string
+	if err = app.csrfCodec().Decode(csrfCookie, c.Value, &token); err != nil {
+		return ""
+	}
+	return token
+}
+
+// setAnonymousCSRF sends CSRF token in a signed cookie
+func (app *Bouquins) setAnonymousCSRF(res http.ResponseWriter, token string) error {
+	encoded, err := app.csrfCodec().Encode(csrfCookie, token)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(res, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   csrfCookieMaxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.Conf.ExternalURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearAnonymousCSRF deletes CSRF cookie (logged in users get a token in session)
+func clearAnonymousCSRF(res http.ResponseWriter) {
+	http.SetCookie(res, &http.Cookie{Name: csrfCookie, Path: "/", MaxAge: -1})
+}
+
+// CSRF protects state-changing requests with a token stored in session, or in a signed cookie for visitors
+// without session (no session created for each visitor).
+// Requests authenticated by a Bearer token (API clients) don't use cookies and are not checked,
+// Basic credentials are cached by browsers and are checked like cookies.
+func (app *Bouquins) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if apiClient(req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		session := app.Session(req)
+		token, _ := session.Values[sessionCSRF].(string)
+		account, _ := session.Values[sessionAccount].(string)
+		if token == "" && account == "" {
+			token = app.anonymousCSRF(req)
+		}
+		if !safeMethod(req.Method) && !validCSRF(token, req) {
+			log.Println("Invalid CSRF token", req.Method, req.URL.Path)
+			http.Error(res, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		if token == "" {
+			var err error
+			token, err = securedRandString(csrfTokenLength)
+			if err == nil && session.IsNew {
+				err = app.setAnonymousCSRF(res, token)
+			} else if err == nil {
+				session.Values[sessionCSRF] = token
+				err = session.Save(req, res)
+			}
+			if err != nil {
+				log.Println(err)
+				http.Error(res, err.Error(), 500)
+				return
+			}
+		}
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), ctxCSRF, token)))
+	})
+}
+
+// csrfField is a template helper: hidden form field with CSRF token
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + pCSRF + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,106 @@
+package bouquins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfServer returns the authentication and CSRF middlewares around a handler recording CSRF token
+func csrfServer(app *Bouquins, token *string) http.Handler {
+	return app.WithAuth(app.CSRF(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		*token = csrfToken(req)
+		res.WriteHeader(http.StatusOK)
+	})))
+}
+
+// crossSitePost returns a form POST sent by another site
+func crossSitePost(form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/settings/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example")
+	return req
+}
+
+func TestCSRF(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	if err := SetPassword(account.ID, "secret password"); err != nil {
+		t.Fatal(err)
+	}
+	apiToken, err := CreateToken(account.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	server := csrfServer(app, &token)
+	form := url.Values{pAction: {"password"}, pPassword: {"new password"}}
+
+	tests := []struct {
+		name   string
+		auth   func(req *http.Request)
+		status int
+	}{
+		{"anonymous", func(req *http.Request) {}, http.StatusForbidden},
+		{"basic password", func(req *http.Request) { req.SetBasicAuth("reader@example.org", "secret password") }, http.StatusForbidden},
+		{"basic token", func(req *http.Request) { req.SetBasicAuth("any", apiToken) }, http.StatusForbidden},
+		{"bearer token", func(req *http.Request) { req.Header.Set("Authorization", authBearer+apiToken) }, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := crossSitePost(form)
+		test.auth(req)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%s: cross-site POST status %d, expected %d", test.name, res.Code, test.status)
+		}
+	}
+
+	// browser: token of the page sent back with cookies
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/settings/", nil))
+	if res.Code != http.StatusOK || token == "" {
+		t.Fatalf("GET status %d, token %q", res.Code, token)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie {
+		t.Errorf("GET without session: cookies %v, expected only %s", cookies, csrfCookie)
+	}
+	var stored int
+	if err = app.UserDB.QueryRow("SELECT count(*) FROM sessions").Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("GET without session: %d sessions stored (%v)", stored, err)
+	}
+	for _, sent := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"wrong", http.StatusForbidden},
+		{token, http.StatusOK},
+	} {
+		values := url.Values{pAction: {"password"}, pCSRF: {sent.token}}
+		req := crossSitePost(values)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		res = httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		if res.Code != sent.status {
+			t.Errorf("POST with token %q: status %d, expected %d", sent.token, res.Code, sent.status)
+		}
+	}
+
+	// javascript header
+	req := httptest.NewRequest(http.MethodDelete, "/shelves/1", nil)
+	req.Header.Set(headerCSRF, token)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("DELETE with header token: status %d", res.Code)
+	}
+}
@@ -7,30 +7,53 @@ import (
 )
 
 const (
-	sqlBooks0 = `SELECT books.id AS id,title,series_index,name as series_name,series.id AS series_id 
+	sqlBooks0 = `SELECT books.id AS id,title,series_index,name as series_name,series.id AS series_id,has_cover 
     FROM books LEFT OUTER JOIN books_series_link ON books.id = books_series_link.book 
     LEFT OUTER JOIN series ON series.id = books_series_link.series `
 	sqlBooksTags0 = `SELECT name, books_tags_link.book as book FROM tags, books_tags_link 
-    WHERE tags.id = books_tags_link.tag AND books_tags_link.book IN ( SELECT id FROM books `
+    WHERE tags.id = books_tags_link.tag AND books_tags_link.book IN ( SELECT id FROM books/*where:books.id*/ `
 	sqlBooksAuthors0 = `SELECT authors.id, authors.name, books_authors_link.book as book 
     FROM authors, books_authors_link WHERE books_authors_link.author = authors.id 
-    AND books_authors_link.book IN ( SELECT id FROM books `
-	sqlBooksTerm = " books.sort like ? "
+    AND books_authors_link.book IN ( SELECT id FROM books/*where:books.id*/ `
+	sqlBooksList0       = sqlBooks0 + "/*where:books.id*/ "
+	sqlBooksByID0       = sqlBooks0 + " WHERE books.id IN (%s)/*and:books.id*/"
+	sqlBooksByIDAuthors = `SELECT authors.id, authors.name, books_authors_link.book 
+    FROM authors, books_authors_link WHERE books_authors_link.author = authors.id 
+    AND books_authors_link.book IN (%s) ORDER BY books_authors_link.id`
+	sqlBooksByIDTags = `SELECT name, books_tags_link.book FROM tags, books_tags_link 
+    WHERE tags.id = books_tags_link.tag AND books_tags_link.book IN (%s)`
+	sqlBooksByIDVisible = "SELECT books.id FROM books WHERE books.id IN (%s)/*and:books.id*/"
+	sqlBooksByIDDetails = `SELECT books.id, strftime('%%s', timestamp), strftime('%%Y', pubdate), uuid, 
+    languages.lang_code, publishers.name FROM books 
+    LEFT OUTER JOIN books_languages_link ON books_languages_link.book = books.id 
+    LEFT OUTER JOIN languages ON languages.id = books_languages_link.lang_code 
+    LEFT OUTER JOIN books_publishers_link ON books.id = books_publishers_link.book 
+    LEFT OUTER JOIN publishers ON publishers.id = books_publishers_link.publisher 
+    WHERE books.id IN (%s)`
+	sqlBooksByIDData = "SELECT book, name, format, uncompressed_size FROM data WHERE book IN (%s)"
+	sqlBooksTerm     = " books.sort like ? "
+	sqlBooksFilter   = "/*and:books.id*/"
 
 	sqlSeries0 = `SELECT series.id, series.name, count(book) FROM series 
-    LEFT OUTER JOIN books_series_link ON books_series_link.series = series.id 
-    GROUP BY series.id `
+    LEFT OUTER JOIN books_series_link ON books_series_link.series = series.id/*and:books_series_link.book*/ 
+    GROUP BY series.id/*nonempty:book*/ `
 	sqlSeriesAuthors0 = `SELECT DISTINCT authors.id, authors.name, books_series_link.series 
     FROM authors, books_authors_link, books_series_link 
-    WHERE books_authors_link.book = books_series_link.book AND books_authors_link.author = authors.id 
-    AND books_series_link.series IN ( SELECT id FROM series `
+    WHERE books_authors_link.book = books_series_link.book AND books_authors_link.author = authors.id/*and:books_series_link.book*/ 
+    AND books_series_link.series IN ( SELECT series.id FROM series 
+    LEFT OUTER JOIN books_series_link AS visible ON visible.series = series.id/*and:visible.book*/ 
+    GROUP BY series.id/*nonempty:visible.book*/ `
 	sqlSeriesSearch = "SELECT series.id, series.name FROM series WHERE "
 	sqlSeriesTerm   = " series.sort like ? "
+	sqlSeriesFilter = ` AND EXISTS (SELECT 1 FROM books_series_link 
+    WHERE books_series_link.series = series.id/*and:books_series_link.book*/)`
 
 	sqlAuthors0 = `SELECT authors.id, authors.name, count(book) as count FROM authors, books_authors_link 
-    WHERE authors.id = books_authors_link.author GROUP BY author `
+    WHERE authors.id = books_authors_link.author/*and:books_authors_link.book*/ GROUP BY author `
 	sqlAuthorsSearch = "SELECT id, name FROM authors WHERE "
 	sqlAuthorsTerm   = " sort like ? "
+	sqlAuthorsFilter = ` AND EXISTS (SELECT 1 FROM books_authors_link 
+    WHERE books_authors_link.author = authors.id/*and:books_authors_link.book*/)`
 
 	sqlPage  = " LIMIT ? OFFSET ?"
 	sqlWhere = " WHERE "
@@ -41,7 +64,7 @@ const (
 	sqlAuthorsOrder = " ORDER BY authors.sort"
 	sqlSeriesOrder  = " ORDER BY series.sort"
 
-	sqlBooksCount = "SELECT count(id) FROM books"
+	sqlBooksCount = "SELECT count(id) FROM books/*where:books.id*/"
 	sqlBook       = `SELECT books.id AS id,title, series_index, series.name AS series_name, series.id AS series_id, 
     strftime('%s', timestamp), strftime('%Y', pubdate), isbn,lccn,path,uuid,has_cover, 
     languages.lang_code, publishers.name AS pubname FROM books 
@@ -52,16 +75,16 @@ const (
     LEFT OUTER JOIN series ON series.id = books_series_link.series 
     LEFT OUTER JOIN books_publishers_link ON books.id = books_publishers_link.book 
     LEFT OUTER JOIN publishers ON publishers.id = books_publishers_link.publisher 
-    WHERE books.id = ?`
+    WHERE books.id = ?/*and:books.id*/`
 	sqlBookTags    = "SELECT name FROM tags, books_tags_link WHERE tags.id = books_tags_link.tag AND books_tags_link.book = ?"
 	sqlBookAuthors = `SELECT authors.id, authors.name, books_authors_link.book as book 
     FROM authors, books_authors_link WHERE books_authors_link.author = authors.id 
     AND books_authors_link.book = ?`
 	sqlBookData              = "SELECT data.name, data.format, data.uncompressed_size FROM data WHERE data.book = ?"
-	sqlBooksIDAsc            = sqlBooks0 + " ORDER BY id" + sqlPage
-	sqlBooksIDDesc           = sqlBooks0 + "ORDER BY id DESC" + sqlPage
-	sqlBooksTitleAsc         = sqlBooks0 + "ORDER BY books.sort" + sqlPage
-	sqlBooksTitleDesc        = sqlBooks0 + "ORDER BY books.sort DESC" + sqlPage
+	sqlBooksIDAsc            = sqlBooksList0 + " ORDER BY id" + sqlPage
+	sqlBooksIDDesc           = sqlBooksList0 + "ORDER BY id DESC" + sqlPage
+	sqlBooksTitleAsc         = sqlBooksList0 + "ORDER BY books.sort" + sqlPage
+	sqlBooksTitleDesc        = sqlBooksList0 + "ORDER BY books.sort DESC" + sqlPage
 	sqlBooksTagsIDAsc        = sqlBooksTags0 + "ORDER BY id" + sqlPage + ")"
 	sqlBooksTagsIDDesc       = sqlBooksTags0 + "ORDER BY id DESC" + sqlPage + ")"
 	sqlBooksTagsTitleAsc     = sqlBooksTags0 + "ORDER BY books.sort" + sqlPage + ")"
@@ -82,11 +105,11 @@ const (
 	sqlSerie                 = "SELECT series.id, series.name FROM series WHERE series.id = ?"
 	sqlSerieBooks            = `SELECT books.id, title, series_index FROM books 
     LEFT OUTER JOIN books_series_link ON books.id = books_series_link.book 
-    WHERE books_series_link.series = ? ORDER BY series_index ASC`
+    WHERE books_series_link.series = ?/*and:books.id*/ ORDER BY series_index ASC`
 	sqlSerieAuthors = `SELECT DISTINCT authors.id, authors.name 
     FROM authors, books_authors_link, books_series_link 
     WHERE books_authors_link.book = books_series_link.book AND books_authors_link.author = authors.id 
-    AND books_series_link.series = ?`
+    AND books_series_link.series = ?/*and:books_series_link.book*/`
 
 	sqlAuthorsIDAsc    = sqlAuthors0 + "ORDER BY authors.id " + sqlPage
 	sqlAuthorsIDDesc   = sqlAuthors0 + "ORDER BY authors.id DESC " + sqlPage
@@ -96,15 +119,185 @@ const (
     FROM books LEFT OUTER JOIN books_series_link ON books.id = books_series_link.book 
     LEFT OUTER JOIN series ON series.id = books_series_link.series 
     LEFT OUTER JOIN books_authors_link ON books.id = books_authors_link.book 
-    WHERE books_authors_link.author = ? ORDER BY id`
+    WHERE books_authors_link.author = ?/*and:books.id*/ ORDER BY id`
 	sqlAuthorAuthors = `SELECT DISTINCT authors.id, authors.name
     FROM authors, books_authors_link WHERE books_authors_link.author = authors.id 
     AND books_authors_link.book IN ( SELECT books.id FROM books LEFT OUTER JOIN books_authors_link 
-			ON books.id = books_authors_link.book WHERE books_authors_link.author = ? ORDER BY books.id)
+			ON books.id = books_authors_link.book WHERE books_authors_link.author = ?/*and:books.id*/ ORDER BY books.id)
 		AND authors.id != ? ORDER BY authors.id`
 	sqlAuthor = "SELECT name FROM authors WHERE id = ?"
 
-	sqlAccount = "SELECT accounts.id, name FROM accounts, authentifiers WHERE authentifiers.id = accounts.id AND authentifiers.authentifier = ?"
+	sqlCustomColumn = "SELECT id, normalized FROM custom_columns WHERE label = ?"
+	sqlBookFile     = `SELECT books.path, data.name, data.format, data.uncompressed_size, books.title, 
+    (SELECT name FROM authors, books_authors_link WHERE books_authors_link.author = authors.id 
+    AND books_authors_link.book = books.id ORDER BY books_authors_link.id LIMIT 1) FROM books, data 
+    WHERE data.book = books.id AND books.id = ? AND data.format = ?/*and:books.id*/`
+	sqlBookCover = "SELECT path, has_cover, strftime('%s', last_modified) FROM books WHERE id = ?/*and:books.id*/"
+	sqlKoboBooks = "SELECT id, uuid, strftime('%s', timestamp), strftime('%s', last_modified) FROM books WHERE id > 0/*and:books.id*/"
+	sqlBookUUID  = "SELECT id FROM books WHERE uuid = ?/*and:books.id*/"
+
+	sqlAccount      = "SELECT accounts.id, name FROM accounts, authentifiers WHERE authentifiers.id = accounts.id AND authentifiers.authentifier = ?"
+	sqlAccountByID  = "SELECT id, name FROM accounts WHERE id = ?"
+	sqlRestrictions = "SELECT field, value, exclude FROM restrictions WHERE account = ?"
+	sqlTokens       = "SELECT id, name, created, last_used FROM tokens WHERE account = ? ORDER BY created"
+	sqlTokenAccount = "SELECT accounts.id, accounts.name, tokens.id FROM accounts, tokens WHERE tokens.account = accounts.id AND tokens.hash = ?"
+	sqlTokenAdd     = "INSERT INTO tokens (account, name, hash, created, last_used) VALUES (?, ?, ?, ?, 0)"
+	sqlTokenUsed    = "UPDATE tokens SET last_used = ? WHERE id = ?"
+	sqlTokenRevoke  = "DELETE FROM tokens WHERE account = ? AND id = ?"
+	sqlPassword     = "SELECT hash FROM passwords WHERE account = ?"
+	sqlPasswordSet  = "INSERT OR REPLACE INTO passwords (account, hash) VALUES (?, ?)"
+	sqlRoles        = "SELECT role FROM roles WHERE account = ?"
+	sqlRoleAdd      = "INSERT OR IGNORE INTO roles (account, role) VALUES (?, ?)"
+	sqlRoleDel      = "DELETE FROM roles WHERE account = ? AND role = ?"
+	sqlAccountAdd   = "INSERT INTO accounts (id, name) VALUES (?, ?)"
+	sqlAuthAdd      = "INSERT INTO authentifiers (id, authentifier) VALUES (?, ?)"
+	sqlAuths        = "SELECT authentifier FROM authentifiers WHERE id = ? ORDER BY authentifier"
+	sqlAuthDel      = `DELETE FROM authentifiers WHERE id = ? AND authentifier = ? 
+    AND (SELECT count(*) FROM authentifiers WHERE id = ?) > 1`
+	sqlAccounts = `SELECT accounts.id, accounts.name, count(sessions.id) FROM accounts 
+    LEFT OUTER JOIN sessions ON sessions.account = accounts.id AND sessions.expires > ? 
+    GROUP BY accounts.id ORDER BY accounts.name`
+
+	sqlSession     = "SELECT data, last_seen FROM sessions WHERE id = ? AND expires > ?"
+	sqlSessionSave = `INSERT INTO sessions (id, account, data, created, expires, last_seen, user_agent, address) 
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(id) DO UPDATE SET account = excluded.account, 
+    data = excluded.data, expires = excluded.expires, last_seen = excluded.last_seen`
+	sqlSessionSeen         = "UPDATE sessions SET last_seen = ? WHERE id = ?"
+	sqlSessionDelete       = "DELETE FROM sessions WHERE id = ?"
+	sqlSessionsExpired     = "DELETE FROM sessions WHERE expires <= ?"
+	sqlAccountSessions     = "SELECT rowid, id, created, last_seen, user_agent, address FROM sessions WHERE account = ? AND expires > ? ORDER BY last_seen DESC"
+	sqlSessionRevoke       = "DELETE FROM sessions WHERE account = ? AND rowid = ?"
+	sqlSessionsRevokeOther = "DELETE FROM sessions WHERE account = ? AND id != ?"
+	sqlSessionsRevokeAll   = "DELETE FROM sessions WHERE account = ?"
+
+	sqlInvitations     = "SELECT id, note, created_by, created, expires FROM invitations WHERE used_by IS NULL AND expires > ? ORDER BY created"
+	sqlInvitationValid = "SELECT count(*) FROM invitations WHERE hash = ? AND used_by IS NULL AND expires > ?"
+	sqlInvitationAdd   = "INSERT INTO invitations (hash, note, created_by, created, expires) VALUES (?, ?, ?, ?, ?)"
+	sqlInvitationUse   = "UPDATE invitations SET used_by = ?, used = ? WHERE hash = ? AND used_by IS NULL AND expires > ?"
+	sqlInvitationDel   = "DELETE FROM invitations WHERE id = ?"
+
+	sqlShareActive = "expires > ? AND (max_downloads = 0 OR downloads < max_downloads)"
+	sqlShares      = "SELECT id, account, book, format, title, created, expires, max_downloads, downloads FROM shares WHERE " +
+		sqlShareActive + " ORDER BY created"
+	sqlAccountShares = "SELECT id, account, book, format, title, created, expires, max_downloads, downloads FROM shares WHERE account = ? AND " +
+		sqlShareActive + " ORDER BY created"
+	sqlShareAdd   = "INSERT INTO shares (account, book, format, title, created, expires, max_downloads, downloads) VALUES (?, ?, ?, ?, ?, ?, ?, 0)"
+	sqlShareValid = "SELECT count(*) FROM shares WHERE id = ? AND book = ? AND format = ? AND expires = ? AND " + sqlShareActive
+	// one download per file size served, whatever the ranges requested
+	sqlShareServed = "UPDATE shares SET downloads = downloads + (bytes % ? + ?) / ?, bytes = bytes + ? WHERE id = ?"
+	sqlShareRevoke = "DELETE FROM shares WHERE account = ? AND id = ?"
+	sqlShareDel    = "DELETE FROM shares WHERE id = ?"
+
+	sqlDownloadAdd     = "INSERT INTO downloads (account, book, format, name, time, client) VALUES (?, ?, ?, ?, ?, ?)"
+	sqlAccountDownload = "SELECT book, format, name, time, client FROM downloads WHERE account = ? ORDER BY time DESC LIMIT ?"
+	sqlDownloadCounts  = "SELECT book, format, max(name), count(*) FROM downloads WHERE time >= ? GROUP BY book, format"
+
+	sqlShelves0 = `SELECT shelves.id, shelves.account, coalesce(accounts.name, ''), shelves.name, 
+    EXISTS (SELECT 1 FROM shelf_shares WHERE shelf_shares.shelf = shelves.id), shelves.created, 
+    (SELECT count(*) FROM shelf_books WHERE shelf_books.shelf = shelves.id) FROM shelves 
+    LEFT OUTER JOIN accounts ON accounts.id = shelves.account `
+	sqlShelfVisible = "(shelves.account = ? OR shelves.id IN (SELECT shelf FROM shelf_shares WHERE shelf_shares.account = ?))"
+	sqlShelves      = sqlShelves0 + "WHERE " + sqlShelfVisible + " ORDER BY shelves.account != ?, shelves.name"
+	sqlShelf        = sqlShelves0 + "WHERE shelves.id = ? AND " + sqlShelfVisible
+	// books of visible shelves, counted with restrictions
+	sqlShelvesBooks     = "SELECT shelf_books.shelf, shelf_books.book FROM shelf_books, shelves WHERE shelves.id = shelf_books.shelf AND " + sqlShelfVisible
+	sqlShelfAdd         = "INSERT INTO shelves (account, name, created) VALUES (?, ?, ?)"
+	sqlShelfUpdate      = "UPDATE shelves SET name = ? WHERE id = ? AND account = ?"
+	sqlShelfDelete      = "DELETE FROM shelves WHERE id = ? AND account = ?"
+	sqlShelfShares      = "SELECT accounts.id, accounts.name FROM shelf_shares, accounts WHERE accounts.id = shelf_shares.account AND shelf_shares.shelf = ? ORDER BY accounts.name"
+	sqlShelfShareAdd    = "INSERT OR IGNORE INTO shelf_shares (shelf, account) SELECT id, ? FROM shelves WHERE id = ? AND account = ? AND account != ?"
+	sqlShelfShareRemove = `DELETE FROM shelf_shares WHERE shelf = ? AND account = ? 
+    AND shelf IN (SELECT id FROM shelves WHERE account = ?)`
+	sqlShelfSharesDelete = "DELETE FROM shelf_shares WHERE shelf = ? AND shelf IN (SELECT id FROM shelves WHERE account = ?)"
+	sqlShelfBooks        = "SELECT book, position, added FROM shelf_books WHERE shelf = ? ORDER BY position"
+	sqlShelfBooksDelete  = "DELETE FROM shelf_books WHERE shelf = ? AND shelf IN (SELECT id FROM shelves WHERE account = ?)"
+	sqlShelfBookAdd      = `INSERT OR IGNORE INTO shelf_books (shelf, book, position, added) 
+    SELECT id, ?, (SELECT coalesce(max(position), 0) + 1 FROM shelf_books WHERE shelf = shelves.id), ? 
+    FROM shelves WHERE id = ? AND account = ?`
+	sqlShelfBookRemove = `DELETE FROM shelf_books WHERE shelf = ? AND book = ? 
+    AND shelf IN (SELECT id FROM shelves WHERE account = ?)`
+	sqlShelfBookPosition = "UPDATE shelf_books SET position = ? WHERE shelf = ? AND book = ?"
+	sqlBookShelves       = `SELECT shelf_books.shelf FROM shelf_books, shelves 
+    WHERE shelves.id = shelf_books.shelf AND shelves.account = ? AND shelf_books.book = ?`
+
+	sqlReading0        = "SELECT book, status, started, finished, updated FROM reading WHERE account = ?"
+	sqlReadingStatus   = sqlReading0 + " AND book = ?"
+	sqlReadingStatuses = sqlReading0
+	sqlReadingByStatus = "SELECT book FROM reading WHERE account = ? AND status = ?"
+	sqlReadingYear     = sqlReading0 + " AND ((finished >= ? AND finished < ?) OR (started >= ? AND started < ?)) ORDER BY finished, started"
+	sqlReadingSet      = `INSERT INTO reading (account, book, status, started, finished, updated) VALUES (?, ?, ?, ?, ?, ?) 
+    ON CONFLICT(account, book) DO UPDATE SET status = excluded.status, started = excluded.started, 
+    finished = excluded.finished, updated = excluded.updated`
+	sqlReadingDelete = "DELETE FROM reading WHERE account = ? AND book = ?"
+
+	sqlReview      = "SELECT book, account, '', rating, review, created, updated FROM reviews WHERE account = ? AND book = ?"
+	sqlBookReviews = `SELECT book, account, coalesce(accounts.name, ''), rating, review, created, updated FROM reviews 
+    LEFT OUTER JOIN accounts ON accounts.id = reviews.account WHERE book = ? ORDER BY updated DESC`
+	sqlReviewSet = `INSERT INTO reviews (account, book, rating, review, created, updated) VALUES (?, ?, ?, ?, ?, ?) 
+    ON CONFLICT(account, book) DO UPDATE SET rating = excluded.rating, review = excluded.review, updated = excluded.updated`
+	sqlReviewDelete       = "DELETE FROM reviews WHERE account = ? AND book = ?"
+	sqlRatedBooks0        = "SELECT book FROM reviews WHERE rating > 0 GROUP BY book ORDER BY avg(rating)"
+	sqlRatedBooksAsc      = sqlRatedBooks0 + ", book"
+	sqlRatedBooksDesc     = sqlRatedBooks0 + " DESC, book"
+	sqlAccountRatedBooks  = "SELECT book FROM reviews WHERE account = ? AND rating >= ?"
+	sqlRatingsByBook      = "SELECT book, avg(rating), count(*) FROM reviews WHERE rating > 0 AND book IN (%s) GROUP BY book"
+	sqlAccountRatingsBook = "SELECT book, rating FROM reviews WHERE account = ? AND rating > 0 AND book IN (%s)"
+
+	sqlKosyncKey    = "SELECT hash FROM kosync_keys WHERE account = ?"
+	sqlKosyncKeySet = "INSERT OR REPLACE INTO kosync_keys (account, hash) VALUES (?, ?)"
+	sqlProgress0    = "SELECT document, progress, percentage, device, device_id, timestamp, coalesce(book, 0) FROM progress WHERE account = ?"
+	sqlProgress     = sqlProgress0 + " AND document = ?"
+	sqlBookProgress = sqlProgress0 + " AND book = ? ORDER BY timestamp DESC LIMIT 1"
+	sqlProgressSet  = `INSERT INTO progress (account, document, progress, percentage, device, device_id, timestamp, book) 
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(account, document) DO UPDATE SET progress = excluded.progress, 
+    percentage = excluded.percentage, device = excluded.device, device_id = excluded.device_id, 
+    timestamp = excluded.timestamp, book = coalesce(excluded.book, progress.book)`
+	sqlDocument    = "SELECT book FROM documents WHERE hash = ?"
+	sqlDocumentAdd = "INSERT OR IGNORE INTO documents (hash, book, format) VALUES (?, ?, ?)"
+
+	sqlKoboShelves       = "SELECT shelf FROM kobo_shelves WHERE account = ?"
+	sqlKoboShelfAdd      = "INSERT OR IGNORE INTO kobo_shelves (account, shelf) VALUES (?, ?)"
+	sqlKoboShelvesDelete = "DELETE FROM kobo_shelves WHERE account = ?"
+	sqlKoboToken         = "SELECT created FROM kobo_tokens WHERE account = ?"
+	sqlKoboTokenSet      = "INSERT OR REPLACE INTO kobo_tokens (account, hash, created) VALUES (?, ?, ?)"
+	sqlKoboTokenDelete   = "DELETE FROM kobo_tokens WHERE account = ?"
+	sqlKoboTokenAccount  = `SELECT accounts.id, accounts.name FROM kobo_tokens, accounts 
+    WHERE accounts.id = kobo_tokens.account AND kobo_tokens.hash = ?`
+	sqlKoboShelfBooks = `SELECT shelf_books.book, max(shelf_books.added) FROM shelf_books, kobo_shelves, shelves 
+    WHERE shelf_books.shelf = kobo_shelves.shelf AND shelves.id = kobo_shelves.shelf AND kobo_shelves.account = ? 
+    AND (shelves.account = kobo_shelves.account OR shelves.id IN 
+    (SELECT shelf FROM shelf_shares WHERE shelf_shares.account = kobo_shelves.account)) GROUP BY shelf_books.book`
+
+	sqlDevices0          = "SELECT id, name, email, created FROM devices WHERE account = ?"
+	sqlDevices           = sqlDevices0 + " ORDER BY name"
+	sqlDevice            = sqlDevices0 + " AND id = ?"
+	sqlDeviceAdd         = "INSERT INTO devices (account, name, email, created) VALUES (?, ?, ?, ?)"
+	sqlDeviceDelete      = "DELETE FROM devices WHERE account = ? AND id = ?"
+	sqlDeliveries0       = "SELECT id, account, book, format, name, email, status, attempts, error, created, updated, next_try FROM deliveries "
+	sqlDeliveriesPending = sqlDeliveries0 + "WHERE status = 'pending' AND next_try <= ? ORDER BY next_try, id LIMIT ?"
+	sqlAccountDeliveries = sqlDeliveries0 + "WHERE account = ? ORDER BY created DESC, id DESC LIMIT ?"
+	sqlBookDeliveries    = sqlDeliveries0 + "WHERE account = ? AND book = ? ORDER BY created DESC, id DESC LIMIT ?"
+	sqlDeliveryAdd       = `INSERT INTO deliveries (account, book, format, name, email, status, attempts, error, created, updated, next_try) 
+    VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)`
+	sqlDeliveryUpdate = "UPDATE deliveries SET status = ?, attempts = ?, error = ?, updated = ?, next_try = ? WHERE id = ?"
+
+	sqlAnnotations0     = "SELECT id, book, location, text, note, colour, created, updated FROM annotations WHERE account = ?"
+	sqlAnnotations      = sqlAnnotations0 + " ORDER BY book, created, id"
+	sqlBookAnnotations  = sqlAnnotations0 + " AND book = ? ORDER BY created, id"
+	sqlAnnotation       = sqlAnnotations0 + " AND id = ?"
+	sqlAnnotationExists = "SELECT count(*) FROM annotations WHERE account = ? AND book = ? AND location = ? AND text = ?"
+	sqlAnnotationAdd    = "INSERT INTO annotations (account, book, location, text, note, colour, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	sqlAnnotationUpdate = "UPDATE annotations SET note = ?, colour = ?, updated = ? WHERE account = ? AND id = ?"
+	sqlAnnotationDelete = "DELETE FROM annotations WHERE account = ? AND id = ?"
+
+	sqlLoans0 = `SELECT loans.id, loans.book, loans.account, loans.borrower_account, coalesce(accounts.name, loans.borrower), 
+    loans.lent, loans.due, loans.returned FROM loans LEFT JOIN accounts ON accounts.id = loans.borrower_account `
+	sqlCurrentLoans = sqlLoans0 + "WHERE loans.returned = 0 ORDER BY loans.due = 0, loans.due, loans.lent"
+	sqlBookLoan     = sqlLoans0 + "WHERE loans.book = ? AND loans.returned = 0"
+	sqlLentBooks    = "SELECT book FROM loans WHERE returned = 0"
+	sqlOverdueBooks = "SELECT book FROM loans WHERE returned = 0 AND due > 0 AND due < ?"
+	sqlLoanAdd      = "INSERT OR IGNORE INTO loans (book, account, borrower_account, borrower, lent, due, returned) VALUES (?, ?, ?, ?, ?, ?, 0)"
+	sqlLoanReturn   = "UPDATE loans SET returned = ? WHERE id = ? AND returned = 0"
 
 	defaultLimit = 10
 
@@ -125,6 +318,121 @@ const (
 	qtAuthorBooks
 	qtAuthorCoauthors
 	qtAuthors
+	qtCustomColumn
+	qtBookFile
+	qtBookCover
+	qtKoboBooks
+	qtBookUUID
+
+	// users.db
+	qtAccount
+	qtAccountByID
+	qtRestrictions
+	qtTokens
+	qtTokenAccount
+	qtTokenAdd
+	qtTokenUsed
+	qtTokenRevoke
+	qtPassword
+	qtPasswordSet
+	qtRoles
+	qtAccounts
+	qtSession
+	qtSessionSave
+	qtSessionSeen
+	qtSessionDelete
+	qtSessionsExpired
+	qtAccountSessions
+	qtSessionRevoke
+	qtSessionsRevokeOthers
+	qtSessionsRevokeAll
+	qtAccountAdd
+	qtAuthentifierAdd
+	qtInvitations
+	qtInvitationValid
+	qtInvitationAdd
+	qtInvitationUse
+	qtInvitationDelete
+	qtAuthentifiers
+	qtAuthentifierDelete
+	qtRoleAdd
+	qtRoleDelete
+	qtShares
+	qtAccountShares
+	qtShareAdd
+	qtShareValid
+	qtShareServed
+	qtShareRevoke
+	qtShareDelete
+	qtDownloadAdd
+	qtAccountDownloads
+	qtDownloadCounts
+	qtShelves
+	qtShelf
+	qtShelfAdd
+	qtShelfUpdate
+	qtShelfDelete
+	qtShelvesBooks
+	qtShelfShares
+	qtShelfShareAdd
+	qtShelfShareRemove
+	qtShelfSharesDelete
+	qtShelfBooks
+	qtShelfBooksDelete
+	qtShelfBookAdd
+	qtShelfBookRemove
+	qtShelfBookPosition
+	qtBookShelves
+	qtReadingStatus
+	qtReadingStatuses
+	qtReadingByStatus
+	qtReadingYear
+	qtReadingSet
+	qtReadingDelete
+	qtReview
+	qtBookReviews
+	qtReviewSet
+	qtReviewDelete
+	qtRatedBooksAsc
+	qtRatedBooksDesc
+	qtAccountRatedBooks
+	qtKosyncKey
+	qtKosyncKeySet
+	qtProgress
+	qtBookProgress
+	qtProgressSet
+	qtDocument
+	qtDocumentAdd
+	qtKoboShelves
+	qtKoboShelfAdd
+	qtKoboShelvesDelete
+	qtKoboToken
+	qtKoboTokenSet
+	qtKoboTokenDelete
+	qtKoboTokenAccount
+	qtKoboShelfBooks
+	qtDevices
+	qtDevice
+	qtDeviceAdd
+	qtDeviceDelete
+	qtDeliveriesPending
+	qtAccountDeliveries
+	qtBookDeliveries
+	qtDeliveryAdd
+	qtDeliveryUpdate
+	qtAnnotations
+	qtBookAnnotations
+	qtAnnotation
+	qtAnnotationExists
+	qtAnnotationAdd
+	qtAnnotationUpdate
+	qtAnnotationDelete
+	qtCurrentLoans
+	qtBookLoan
+	qtLentBooks
+	qtOverdueBooks
+	qtLoanAdd
+	qtLoanReturn
 )
 
 var queries = map[Query]string{
@@ -163,10 +471,141 @@ var queries = map[Query]string{
 	Query{qtAuthor, false, false}:          sqlAuthor,
 	Query{qtAuthorBooks, false, false}:     sqlAuthorBooks,
 	Query{qtAuthorCoauthors, false, false}: sqlAuthorAuthors,
+	Query{qtCustomColumn, false, false}:    sqlCustomColumn,
+	Query{qtBookFile, false, false}:        sqlBookFile,
+	Query{qtBookCover, false, false}:       sqlBookCover,
+	Query{qtKoboBooks, false, false}:       sqlKoboBooks,
+	Query{qtBookUUID, false, false}:        sqlBookUUID,
+}
+
+// queries on users.db
+var userQueries = map[QueryType]string{
+	qtAccount:      sqlAccount,
+	qtAccountByID:  sqlAccountByID,
+	qtRestrictions: sqlRestrictions,
+	qtTokens:       sqlTokens,
+	qtTokenAccount: sqlTokenAccount,
+	qtTokenAdd:     sqlTokenAdd,
+	qtTokenUsed:    sqlTokenUsed,
+	qtTokenRevoke:  sqlTokenRevoke,
+	qtPassword:     sqlPassword,
+	qtPasswordSet:  sqlPasswordSet,
+	qtRoles:        sqlRoles,
+	qtAccounts:     sqlAccounts,
+
+	qtSession:              sqlSession,
+	qtSessionSave:          sqlSessionSave,
+	qtSessionSeen:          sqlSessionSeen,
+	qtSessionDelete:        sqlSessionDelete,
+	qtSessionsExpired:      sqlSessionsExpired,
+	qtAccountSessions:      sqlAccountSessions,
+	qtSessionRevoke:        sqlSessionRevoke,
+	qtSessionsRevokeOthers: sqlSessionsRevokeOther,
+	qtSessionsRevokeAll:    sqlSessionsRevokeAll,
+
+	qtAccountAdd:       sqlAccountAdd,
+	qtAuthentifierAdd:  sqlAuthAdd,
+	qtInvitations:      sqlInvitations,
+	qtInvitationValid:  sqlInvitationValid,
+	qtInvitationAdd:    sqlInvitationAdd,
+	qtInvitationUse:    sqlInvitationUse,
+	qtInvitationDelete: sqlInvitationDel,
+
+	qtAuthentifiers:      sqlAuths,
+	qtAuthentifierDelete: sqlAuthDel,
+
+	qtRoleAdd:    sqlRoleAdd,
+	qtRoleDelete: sqlRoleDel,
+
+	qtShares:        sqlShares,
+	qtAccountShares: sqlAccountShares,
+	qtShareAdd:      sqlShareAdd,
+	qtShareValid:    sqlShareValid,
+	qtShareServed:   sqlShareServed,
+	qtShareRevoke:   sqlShareRevoke,
+	qtShareDelete:   sqlShareDel,
+
+	qtDownloadAdd:      sqlDownloadAdd,
+	qtAccountDownloads: sqlAccountDownload,
+	qtDownloadCounts:   sqlDownloadCounts,
+
+	qtShelves:           sqlShelves,
+	qtShelf:             sqlShelf,
+	qtShelfAdd:          sqlShelfAdd,
+	qtShelfUpdate:       sqlShelfUpdate,
+	qtShelfDelete:       sqlShelfDelete,
+	qtShelvesBooks:      sqlShelvesBooks,
+	qtShelfShares:       sqlShelfShares,
+	qtShelfShareAdd:     sqlShelfShareAdd,
+	qtShelfShareRemove:  sqlShelfShareRemove,
+	qtShelfSharesDelete: sqlShelfSharesDelete,
+	qtShelfBooks:        sqlShelfBooks,
+	qtShelfBooksDelete:  sqlShelfBooksDelete,
+	qtShelfBookAdd:      sqlShelfBookAdd,
+	qtShelfBookRemove:   sqlShelfBookRemove,
+	qtShelfBookPosition: sqlShelfBookPosition,
+	qtBookShelves:       sqlBookShelves,
+
+	qtReadingStatus:   sqlReadingStatus,
+	qtReadingStatuses: sqlReadingStatuses,
+	qtReadingByStatus: sqlReadingByStatus,
+	qtReadingYear:     sqlReadingYear,
+	qtReadingSet:      sqlReadingSet,
+	qtReadingDelete:   sqlReadingDelete,
+
+	qtReview:            sqlReview,
+	qtBookReviews:       sqlBookReviews,
+	qtReviewSet:         sqlReviewSet,
+	qtReviewDelete:      sqlReviewDelete,
+	qtRatedBooksAsc:     sqlRatedBooksAsc,
+	qtRatedBooksDesc:    sqlRatedBooksDesc,
+	qtAccountRatedBooks: sqlAccountRatedBooks,
+
+	qtKosyncKey:    sqlKosyncKey,
+	qtKosyncKeySet: sqlKosyncKeySet,
+	qtProgress:     sqlProgress,
+	qtBookProgress: sqlBookProgress,
+	qtProgressSet:  sqlProgressSet,
+	qtDocument:     sqlDocument,
+	qtDocumentAdd:  sqlDocumentAdd,
+
+	qtKoboShelves:       sqlKoboShelves,
+	qtKoboShelfAdd:      sqlKoboShelfAdd,
+	qtKoboShelvesDelete: sqlKoboShelvesDelete,
+	qtKoboToken:         sqlKoboToken,
+	qtKoboTokenSet:      sqlKoboTokenSet,
+	qtKoboTokenDelete:   sqlKoboTokenDelete,
+	qtKoboTokenAccount:  sqlKoboTokenAccount,
+	qtKoboShelfBooks:    sqlKoboShelfBooks,
+
+	qtDevices:           sqlDevices,
+	qtDevice:            sqlDevice,
+	qtDeviceAdd:         sqlDeviceAdd,
+	qtDeviceDelete:      sqlDeviceDelete,
+	qtDeliveriesPending: sqlDeliveriesPending,
+	qtAccountDeliveries: sqlAccountDeliveries,
+	qtBookDeliveries:    sqlBookDeliveries,
+	qtDeliveryAdd:       sqlDeliveryAdd,
+	qtDeliveryUpdate:    sqlDeliveryUpdate,
+
+	qtAnnotations:      sqlAnnotations,
+	qtBookAnnotations:  sqlBookAnnotations,
+	qtAnnotation:       sqlAnnotation,
+	qtAnnotationExists: sqlAnnotationExists,
+	qtAnnotationAdd:    sqlAnnotationAdd,
+	qtAnnotationUpdate: sqlAnnotationUpdate,
+	qtAnnotationDelete: sqlAnnotationDelete,
+
+	qtCurrentLoans: sqlCurrentLoans,
+	qtBookLoan:     sqlBookLoan,
+	qtLentBooks:    sqlLentBooks,
+	qtOverdueBooks: sqlOverdueBooks,
+	qtLoanAdd:      sqlLoanAdd,
+	qtLoanReturn:   sqlLoanReturn,
 }
 var (
-	stmts       = make(map[Query]*sql.Stmt)
-	stmtAccount *sql.Stmt
+	stmts     = make(map[Query]*sql.Stmt)
+	userStmts = make(map[QueryType]*sql.Stmt)
 )
 
 // QueryType is a type of query, with variants for sort and order
@@ -179,8 +618,27 @@ type Query struct {
 	Desc      bool
 }
 
-func (app *Bouquins) searchHelper(all bool, terms []string, stub, termExpr, orderExpr string) (*sql.Rows, error) {
-	query := stub
+// statement is either a prepared statement or a query restricted by a BookFilter
+type statement interface {
+	Query(args ...interface{}) (*sql.Rows, error)
+	QueryRow(args ...interface{}) *sql.Row
+}
+
+// filteredStatement is a query with book filter applied, not prepared
+type filteredStatement struct {
+	db    *sql.DB
+	query string
+}
+
+func (s *filteredStatement) Query(args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.query, args...)
+}
+func (s *filteredStatement) QueryRow(args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.query, args...)
+}
+
+func (app *Bouquins) searchHelper(filter *BookFilter, all bool, terms []string, stub, termExpr, filterExpr, orderExpr string) (*sql.Rows, error) {
+	query := stub + "("
 	queryTerms := make([]interface{}, 0, len(terms))
 	for i, term := range terms {
 		queryTerms = append(queryTerms, "%"+term+"%")
@@ -192,18 +650,14 @@ func (app *Bouquins) searchHelper(all bool, terms []string, stub, termExpr, orde
 			query += sqlOr
 		}
 	}
+	query += ")"
+	if filter.Restricted() {
+		query = filter.apply(query + filterExpr)
+	}
 	query += orderExpr
 	log.Println("Search:", query)
 
-	stmt, err := app.DB.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	rows, err := stmt.Query(queryTerms...)
-	if err != nil {
-		return nil, err
-	}
-	return rows, nil
+	return app.DB.Query(query, queryTerms...)
 }
 
 // PREPARED STATEMENTS //
@@ -220,11 +674,13 @@ func (app *Bouquins) PrepareAll() error {
 		stmts[q] = stmt
 	}
 	// users.db
-	var err error
-	stmtAccount, err = app.UserDB.Prepare(sqlAccount)
-	if err != nil {
-		log.Println(err, sqlAccount)
-		errcount++
+	for qt, v := range userQueries {
+		stmt, err := app.UserDB.Prepare(v)
+		if err != nil {
+			log.Println(err, v)
+			errcount++
+		}
+		userStmts[qt] = stmt
 	}
 	if errcount > 0 {
 		return fmt.Errorf("%d errors on queries, see logs", errcount)
@@ -233,18 +689,24 @@ func (app *Bouquins) PrepareAll() error {
 }
 
 // prepared statement with sort on books
-func (app *Bouquins) psSortBooks(qt QueryType, sort, order string) (*sql.Stmt, error) {
-	return app.psSort("title", qt, sort, order)
+func (app *Bouquins) psSortBooks(filter *BookFilter, qt QueryType, sort, order string) (statement, error) {
+	return app.psSort(filter, "title", qt, sort, order)
 }
-func (app *Bouquins) psSortAuthors(qt QueryType, sort, order string) (*sql.Stmt, error) {
-	return app.psSort("name", qt, sort, order)
+func (app *Bouquins) psSortAuthors(filter *BookFilter, qt QueryType, sort, order string) (statement, error) {
+	return app.psSort(filter, "name", qt, sort, order)
 }
-func (app *Bouquins) psSortSeries(qt QueryType, sort, order string) (*sql.Stmt, error) {
-	return app.psSort("name", qt, sort, order)
+func (app *Bouquins) psSortSeries(filter *BookFilter, qt QueryType, sort, order string) (statement, error) {
+	return app.psSort(filter, "name", qt, sort, order)
 }
-func (app *Bouquins) psSort(sortNameField string, qt QueryType, sort, order string) (*sql.Stmt, error) {
+func (app *Bouquins) psSort(filter *BookFilter, sortNameField string, qt QueryType, sort, order string) (statement, error) {
 	q := Query{qt, sort == sortNameField, order == "desc"}
 	query := queries[q]
+	if filter.Restricted() {
+		// restricted queries depend on user, not prepared
+		query = filter.apply(query)
+		log.Println(query)
+		return &filteredStatement{app.DB, query}, nil
+	}
 	log.Println(query)
 	stmt := stmts[q]
 	if stmt == nil {
@@ -259,6 +721,6 @@ func (app *Bouquins) psSort(sortNameField string, qt QueryType, sort, order stri
 }
 
 // prepared statement without sort
-func (app *Bouquins) ps(qt QueryType) (*sql.Stmt, error) {
-	return app.psSort("any", qt, "", "")
+func (app *Bouquins) ps(filter *BookFilter, qt QueryType) (statement, error) {
+	return app.psSort(filter, "any", qt, "", "")
 }
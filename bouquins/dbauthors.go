@@ -6,8 +6,8 @@ import (
 
 // SUB QUERIES //
 
-func (app *Bouquins) searchAuthors(limit int, terms []string, all bool) ([]*AuthorAdv, int, error) {
-	rows, err := app.searchHelper(all, terms, sqlAuthorsSearch, sqlAuthorsTerm, sqlAuthorsOrder)
+func (app *Bouquins) searchAuthors(filter *BookFilter, limit int, terms []string, all bool) ([]*AuthorAdv, int, error) {
+	rows, err := app.searchHelper(filter, all, terms, sqlAuthorsSearch, sqlAuthorsTerm, sqlAuthorsFilter, sqlAuthorsOrder)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -30,9 +30,9 @@ func (app *Bouquins) searchAuthors(limit int, terms []string, all bool) ([]*Auth
 	return authors, count, nil
 }
 
-func (app *Bouquins) queryAuthors(limit, offset int, sort, order string) ([]*AuthorAdv, bool, error) {
+func (app *Bouquins) queryAuthors(filter *BookFilter, limit, offset int, sort, order string) ([]*AuthorAdv, bool, error) {
 	authors := make([]*AuthorAdv, 0, limit)
-	stmt, err := app.psSortAuthors(qtAuthors, sort, order)
+	stmt, err := app.psSortAuthors(filter, qtAuthors, sort, order)
 	if err != nil {
 		return nil, false, err
 	}
@@ -59,8 +59,8 @@ func (app *Bouquins) queryAuthors(limit, offset int, sort, order string) ([]*Aut
 	return authors, more, nil
 }
 
-func (app *Bouquins) queryAuthorBooks(author *AuthorFull) error {
-	stmt, err := app.ps(qtAuthorBooks)
+func (app *Bouquins) queryAuthorBooks(filter *BookFilter, author *AuthorFull) error {
+	stmt, err := app.ps(filter, qtAuthorBooks)
 	if err != nil {
 		return err
 	}
@@ -95,8 +95,8 @@ func (app *Bouquins) queryAuthorBooks(author *AuthorFull) error {
 	return nil
 }
 
-func (app *Bouquins) queryAuthorAuthors(author *AuthorFull) error {
-	stmt, err := app.ps(qtAuthorCoauthors)
+func (app *Bouquins) queryAuthorAuthors(filter *BookFilter, author *AuthorFull) error {
+	stmt, err := app.ps(filter, qtAuthorCoauthors)
 	if err != nil {
 		return err
 	}
@@ -119,7 +119,7 @@ func (app *Bouquins) queryAuthorAuthors(author *AuthorFull) error {
 }
 
 func (app *Bouquins) queryAuthor(id int64) (*AuthorFull, error) {
-	stmt, err := app.ps(qtAuthor)
+	stmt, err := app.ps(nil, qtAuthor)
 	if err != nil {
 		return nil, err
 	}
@@ -136,12 +136,12 @@ func (app *Bouquins) queryAuthor(id int64) (*AuthorFull, error) {
 
 // AuthorsAdv loads a list of authors
 func (app *Bouquins) AuthorsAdv(params *ReqParams) ([]*AuthorAdv, int, bool, error) {
-	limit, offset, sort, order := params.Limit, params.Offset, params.Sort, params.Order
+	limit, offset, sort, order, filter := params.Limit, params.Offset, params.Sort, params.Order, params.Filter
 	if len(params.Terms) > 0 {
-		authors, count, err := app.searchAuthors(limit, params.Terms, params.AllWords)
+		authors, count, err := app.searchAuthors(filter, limit, params.Terms, params.AllWords)
 		return authors, count, count > limit, err
 	}
-	authors, more, err := app.queryAuthors(limit, offset, sort, order)
+	authors, more, err := app.queryAuthors(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
@@ -149,16 +149,20 @@ func (app *Bouquins) AuthorsAdv(params *ReqParams) ([]*AuthorAdv, int, bool, err
 }
 
 // AuthorFull loads an author
-func (app *Bouquins) AuthorFull(id int64) (*AuthorFull, error) {
+func (app *Bouquins) AuthorFull(filter *BookFilter, id int64) (*AuthorFull, error) {
 	author, err := app.queryAuthor(id)
 	if err != nil {
 		return nil, err
 	}
-	err = app.queryAuthorBooks(author)
+	err = app.queryAuthorBooks(filter, author)
 	if err != nil {
 		return nil, err
 	}
-	err = app.queryAuthorAuthors(author)
+	if filter.Restricted() && len(author.Books) == 0 {
+		// author of hidden books only
+		return nil, sql.ErrNoRows
+	}
+	err = app.queryAuthorAuthors(filter, author)
 	if err != nil {
 		return nil, err
 	}
@@ -2,8 +2,13 @@ package bouquins
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 )
 
+// maxQueryIDs is the maximum number of IDs in a query (SQLite variables limit)
+const maxQueryIDs = 500
+
 // MERGE SUB QUERIES //
 func assignAuthorsTagsBooks(books []*BookAdv, authors map[int64][]*Author, tags map[int64][]string) {
 	for _, b := range books {
@@ -14,8 +19,8 @@ func assignAuthorsTagsBooks(books []*BookAdv, authors map[int64][]*Author, tags
 
 // SUB QUERIES //
 
-func (app *Bouquins) searchBooks(limit int, terms []string, all bool) ([]*BookAdv, int, error) {
-	rows, err := app.searchHelper(all, terms, sqlBooks0+sqlWhere, sqlBooksTerm, sqlBooksOrder)
+func (app *Bouquins) searchBooks(filter *BookFilter, limit int, terms []string, all bool) ([]*BookAdv, int, error) {
+	rows, err := app.searchHelper(filter, all, terms, sqlBooks0+sqlWhere, sqlBooksTerm, sqlBooksFilter, sqlBooksOrder)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -27,9 +32,11 @@ func (app *Bouquins) searchBooks(limit int, terms []string, all bool) ([]*BookAd
 			book := new(BookAdv)
 			var seriesName sql.NullString
 			var seriesID sql.NullInt64
-			if err := rows.Scan(&book.ID, &book.Title, &book.SeriesIndex, &seriesName, &seriesID); err != nil {
+			var cover sql.NullBool
+			if err := rows.Scan(&book.ID, &book.Title, &book.SeriesIndex, &seriesName, &seriesID, &cover); err != nil {
 				return nil, 0, err
 			}
+			book.HasCover = cover.Bool
 			if seriesName.Valid && seriesID.Valid {
 				book.Series = &Series{
 					seriesID.Int64,
@@ -46,9 +53,9 @@ func (app *Bouquins) searchBooks(limit int, terms []string, all bool) ([]*BookAd
 	return books, count, nil
 }
 
-func (app *Bouquins) queryBooks(limit, offset int, sort, order string) ([]*BookAdv, bool, error) {
+func (app *Bouquins) queryBooks(filter *BookFilter, limit, offset int, sort, order string) ([]*BookAdv, bool, error) {
 	books := make([]*BookAdv, 0, limit)
-	stmt, err := app.psSortBooks(qtBooks, sort, order)
+	stmt, err := app.psSortBooks(filter, qtBooks, sort, order)
 	if err != nil {
 		return nil, false, err
 	}
@@ -65,9 +72,11 @@ func (app *Bouquins) queryBooks(limit, offset int, sort, order string) ([]*BookA
 			book := new(BookAdv)
 			var seriesName sql.NullString
 			var seriesID sql.NullInt64
-			if err := rows.Scan(&book.ID, &book.Title, &book.SeriesIndex, &seriesName, &seriesID); err != nil {
+			var cover sql.NullBool
+			if err := rows.Scan(&book.ID, &book.Title, &book.SeriesIndex, &seriesName, &seriesID, &cover); err != nil {
 				return nil, false, err
 			}
+			book.HasCover = cover.Bool
 			if seriesName.Valid && seriesID.Valid {
 				book.Series = &Series{
 					seriesID.Int64,
@@ -83,9 +92,9 @@ func (app *Bouquins) queryBooks(limit, offset int, sort, order string) ([]*BookA
 	return books, more, nil
 }
 
-func (app *Bouquins) queryBooksAuthors(limit, offset int, sort, order string) (map[int64][]*Author, error) {
+func (app *Bouquins) queryBooksAuthors(filter *BookFilter, limit, offset int, sort, order string) (map[int64][]*Author, error) {
 	authors := make(map[int64][]*Author)
-	stmt, err := app.psSortBooks(qtBooksAuthors, sort, order)
+	stmt, err := app.psSortBooks(filter, qtBooksAuthors, sort, order)
 	if err != nil {
 		return nil, err
 	}
@@ -112,8 +121,8 @@ func (app *Bouquins) queryBooksAuthors(limit, offset int, sort, order string) (m
 	return authors, nil
 }
 
-func (app *Bouquins) queryBooksTags(limit, offset int, sort, order string) (map[int64][]string, error) {
-	stmt, err := app.psSortBooks(qtBooksTags, sort, order)
+func (app *Bouquins) queryBooksTags(filter *BookFilter, limit, offset int, sort, order string) (map[int64][]string, error) {
+	stmt, err := app.psSortBooks(filter, qtBooksTags, sort, order)
 	if err != nil {
 		return nil, err
 	}
@@ -142,8 +151,8 @@ func (app *Bouquins) queryBooksTags(limit, offset int, sort, order string) (map[
 	return tags, nil
 }
 
-func (app *Bouquins) queryBook(id int64) (*BookFull, error) {
-	stmt, err := app.ps(qtBook)
+func (app *Bouquins) queryBook(filter *BookFilter, id int64) (*BookFull, error) {
+	stmt, err := app.ps(filter, qtBook)
 	if err != nil {
 		return nil, err
 	}
@@ -188,7 +197,7 @@ func (app *Bouquins) queryBook(id int64) (*BookFull, error) {
 	return book, nil
 }
 func (app *Bouquins) queryBookTags(book *BookFull) error {
-	stmt, err := app.ps(qtBookTags)
+	stmt, err := app.ps(nil, qtBookTags)
 	if err != nil {
 		return err
 	}
@@ -210,7 +219,7 @@ func (app *Bouquins) queryBookTags(book *BookFull) error {
 	return nil
 }
 func (app *Bouquins) queryBookData(book *BookFull) error {
-	stmt, err := app.ps(qtBookData)
+	stmt, err := app.ps(nil, qtBookData)
 	if err != nil {
 		return err
 	}
@@ -232,7 +241,7 @@ func (app *Bouquins) queryBookData(book *BookFull) error {
 	return nil
 }
 func (app *Bouquins) queryBookAuthors(book *BookFull) error {
-	stmt, err := app.ps(qtBookAuthors)
+	stmt, err := app.ps(nil, qtBookAuthors)
 	if err != nil {
 		return err
 	}
@@ -258,9 +267,9 @@ func (app *Bouquins) queryBookAuthors(book *BookFull) error {
 // DB LOADS //
 
 // BookCount counts books in database
-func (app *Bouquins) BookCount() (int64, error) {
+func (app *Bouquins) BookCount(filter *BookFilter) (int64, error) {
 	var count int64
-	stmt, err := app.ps(qtBookCount)
+	stmt, err := app.ps(filter, qtBookCount)
 	if err != nil {
 		return 0, err
 	}
@@ -270,8 +279,8 @@ func (app *Bouquins) BookCount() (int64, error) {
 }
 
 // BookFull loads a book
-func (app *Bouquins) BookFull(id int64) (*BookFull, error) {
-	book, err := app.queryBook(id)
+func (app *Bouquins) BookFull(filter *BookFilter, id int64) (*BookFull, error) {
+	book, err := app.queryBook(filter, id)
 	if err != nil {
 		return nil, err
 	}
@@ -292,23 +301,216 @@ func (app *Bouquins) BookFull(id int64) (*BookFull, error) {
 
 // BooksAdv loads a list of books
 func (app *Bouquins) BooksAdv(params *ReqParams) ([]*BookAdv, int, bool, error) {
-	limit, offset, sort, order := params.Limit, params.Offset, params.Sort, params.Order
+	limit, offset, sort, order, filter := params.Limit, params.Offset, params.Sort, params.Order, params.Filter
 	if len(params.Terms) > 0 {
-		books, count, err := app.searchBooks(limit, params.Terms, params.AllWords)
+		books, count, err := app.searchBooks(filter, limit, params.Terms, params.AllWords)
 		return books, count, count > limit, err
 	}
-	books, more, err := app.queryBooks(limit, offset, sort, order)
+	books, more, err := app.queryBooks(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
-	authors, err := app.queryBooksAuthors(limit, offset, sort, order)
+	authors, err := app.queryBooksAuthors(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
-	tags, err := app.queryBooksTags(limit, offset, sort, order)
+	tags, err := app.queryBooksTags(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
 	assignAuthorsTagsBooks(books, authors, tags)
 	return books, 0, more, nil
 }
+
+// inBatches calls query with IN list placeholders and arguments of IDs, in batches of maxQueryIDs
+func inBatches(ids []int64, query func(in string, args []interface{}) error) error {
+	for start := 0; start < len(ids); start += maxQueryIDs {
+		batch := ids[start:]
+		if len(batch) > maxQueryIDs {
+			batch = batch[:maxQueryIDs]
+		}
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		if err := query(strings.TrimSuffix(strings.Repeat("?,", len(batch)), ","), args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BooksByID loads books visible with filter from a list of IDs (e.g. stored in users.db), in list order
+func (app *Bouquins) BooksByID(filter *BookFilter, ids []int64) ([]*BookAdv, error) {
+	byID := make(map[int64]*BookAdv, len(ids))
+	authors := make(map[int64][]*Author)
+	tags := make(map[int64][]string)
+	err := inBatches(ids, func(in string, args []interface{}) error {
+		return app.booksByIDBatch(filter, in, args, byID, authors, tags)
+	})
+	if err != nil {
+		return nil, err
+	}
+	books := make([]*BookAdv, 0, len(byID))
+	for _, id := range ids {
+		if book, ok := byID[id]; ok {
+			books = append(books, book)
+		}
+	}
+	assignAuthorsTagsBooks(books, authors, tags)
+	return books, nil
+}
+
+// booksByIDBatch loads books, authors and tags of a batch of IDs
+func (app *Bouquins) booksByIDBatch(filter *BookFilter, in string, args []interface{},
+	byID map[int64]*BookAdv, authors map[int64][]*Author, tags map[int64][]string) error {
+	query := fmt.Sprintf(sqlBooksByID0, in)
+	if filter.Restricted() {
+		query = filter.apply(query)
+	}
+	rows, err := app.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		book := new(BookAdv)
+		var seriesName sql.NullString
+		var seriesID sql.NullInt64
+		var cover sql.NullBool
+		if err := rows.Scan(&book.ID, &book.Title, &book.SeriesIndex, &seriesName, &seriesID, &cover); err != nil {
+			return err
+		}
+		book.HasCover = cover.Bool
+		if seriesName.Valid && seriesID.Valid {
+			book.Series = &Series{
+				seriesID.Int64,
+				seriesName.String,
+			}
+		}
+		byID[book.ID] = book
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = app.DB.Query(fmt.Sprintf(sqlBooksByIDAuthors, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		author := new(Author)
+		var book int64
+		if err := rows.Scan(&author.ID, &author.Name, &book); err != nil {
+			return err
+		}
+		authors[book] = append(authors[book], author)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = app.DB.Query(fmt.Sprintf(sqlBooksByIDTags, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		var book int64
+		if err := rows.Scan(&tag, &book); err != nil {
+			return err
+		}
+		tags[book] = append(tags[book], tag)
+	}
+	return rows.Err()
+}
+
+// VisibleBooks returns books of a list visible with filter
+func (app *Bouquins) VisibleBooks(filter *BookFilter, ids []int64) (map[int64]bool, error) {
+	visible := make(map[int64]bool, len(ids))
+	err := inBatches(ids, func(in string, args []interface{}) error {
+		query := fmt.Sprintf(sqlBooksByIDVisible, in)
+		if filter.Restricted() {
+			query = filter.apply(query)
+		}
+		rows, err := app.DB.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			visible[id] = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return visible, nil
+}
+
+// BooksFullByID loads books with files (not reviews) from a list of IDs visible with filter, in list order
+func (app *Bouquins) BooksFullByID(filter *BookFilter, ids []int64) ([]*BookFull, error) {
+	books, err := app.BooksByID(filter, ids)
+	if err != nil {
+		return nil, err
+	}
+	full := make([]*BookFull, len(books))
+	byID := make(map[int64]*BookFull, len(books))
+	visible := make([]int64, len(books))
+	for i, b := range books {
+		full[i] = &BookFull{BookAdv: *b}
+		byID[b.ID] = full[i]
+		visible[i] = b.ID
+	}
+	err = inBatches(visible, func(in string, args []interface{}) error {
+		return app.booksFullBatch(in, args, byID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return full, nil
+}
+
+// booksFullBatch loads details and files of a batch of books
+func (app *Bouquins) booksFullBatch(in string, args []interface{}, byID map[int64]*BookFull) error {
+	rows, err := app.DB.Query(fmt.Sprintf(sqlBooksByIDDetails, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var timestamp, pubdate sql.NullInt64
+		var uuid, lang, publisher sql.NullString
+		if err := rows.Scan(&id, &timestamp, &pubdate, &uuid, &lang, &publisher); err != nil {
+			return err
+		}
+		byID[id].Timestamp = timestamp.Int64
+		byID[id].Pubdate = pubdate.Int64
+		byID[id].UUID = uuid.String
+		byID[id].Lang = lang.String
+		byID[id].Publisher = publisher.String
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = app.DB.Query(fmt.Sprintf(sqlBooksByIDData, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		data := new(BookData)
+		if err := rows.Scan(&id, &data.Name, &data.Format, &data.Size); err != nil {
+			return err
+		}
+		byID[id].Data = append(byID[id].Data, data)
+	}
+	return rows.Err()
+}
@@ -1,5 +1,9 @@
 package bouquins
 
+import (
+	"database/sql"
+)
+
 // MERGE SUB QUERIES //
 
 func assignAuthorsSeries(series []*SeriesAdv, authors map[int64][]*Author) {
@@ -10,8 +14,8 @@ func assignAuthorsSeries(series []*SeriesAdv, authors map[int64][]*Author) {
 
 // SUB QUERIES //
 
-func (app *Bouquins) searchSeries(limit int, terms []string, all bool) ([]*SeriesAdv, int, error) {
-	rows, err := app.searchHelper(all, terms, sqlSeriesSearch, sqlSeriesTerm, sqlSeriesOrder)
+func (app *Bouquins) searchSeries(filter *BookFilter, limit int, terms []string, all bool) ([]*SeriesAdv, int, error) {
+	rows, err := app.searchHelper(filter, all, terms, sqlSeriesSearch, sqlSeriesTerm, sqlSeriesFilter, sqlSeriesOrder)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -34,9 +38,9 @@ func (app *Bouquins) searchSeries(limit int, terms []string, all bool) ([]*Serie
 	return series, count, nil
 }
 
-func (app *Bouquins) querySeriesList(limit, offset int, sort, order string) ([]*SeriesAdv, bool, error) {
+func (app *Bouquins) querySeriesList(filter *BookFilter, limit, offset int, sort, order string) ([]*SeriesAdv, bool, error) {
 	series := make([]*SeriesAdv, 0, limit)
-	stmt, err := app.psSortSeries(qtSeries, sort, order)
+	stmt, err := app.psSortSeries(filter, qtSeries, sort, order)
 	if err != nil {
 		return nil, false, err
 	}
@@ -62,9 +66,9 @@ func (app *Bouquins) querySeriesList(limit, offset int, sort, order string) ([]*
 	}
 	return series, more, nil
 }
-func (app *Bouquins) querySeriesListAuthors(limit, offset int, sort, order string) (map[int64][]*Author, error) {
+func (app *Bouquins) querySeriesListAuthors(filter *BookFilter, limit, offset int, sort, order string) (map[int64][]*Author, error) {
 	authors := make(map[int64][]*Author)
-	stmt, err := app.psSortBooks(qtSeriesAuthors, sort, order)
+	stmt, err := app.psSortBooks(filter, qtSeriesAuthors, sort, order)
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +96,7 @@ func (app *Bouquins) querySeriesListAuthors(limit, offset int, sort, order strin
 }
 
 func (app *Bouquins) querySeries(id int64) (*SeriesFull, error) {
-	stmt, err := app.ps(qtSerie)
+	stmt, err := app.ps(nil, qtSerie)
 	if err != nil {
 		return nil, err
 	}
@@ -100,8 +104,8 @@ func (app *Bouquins) querySeries(id int64) (*SeriesFull, error) {
 	err = stmt.QueryRow(id).Scan(&series.ID, &series.Name)
 	return series, nil
 }
-func (app *Bouquins) querySeriesAuthors(series *SeriesFull) error {
-	stmt, err := app.ps(qtSerieAuthors)
+func (app *Bouquins) querySeriesAuthors(filter *BookFilter, series *SeriesFull) error {
+	stmt, err := app.ps(filter, qtSerieAuthors)
 	if err != nil {
 		return err
 	}
@@ -122,8 +126,8 @@ func (app *Bouquins) querySeriesAuthors(series *SeriesFull) error {
 	}
 	return nil
 }
-func (app *Bouquins) querySeriesBooks(series *SeriesFull) error {
-	stmt, err := app.ps(qtSerieBooks)
+func (app *Bouquins) querySeriesBooks(filter *BookFilter, series *SeriesFull) error {
+	stmt, err := app.ps(filter, qtSerieBooks)
 	if err != nil {
 		return err
 	}
@@ -148,16 +152,20 @@ func (app *Bouquins) querySeriesBooks(series *SeriesFull) error {
 // DB LOADS //
 
 // SeriesFull loads a series
-func (app *Bouquins) SeriesFull(id int64) (*SeriesFull, error) {
+func (app *Bouquins) SeriesFull(filter *BookFilter, id int64) (*SeriesFull, error) {
 	series, err := app.querySeries(id)
 	if err != nil {
 		return nil, err
 	}
-	err = app.querySeriesBooks(series)
+	err = app.querySeriesBooks(filter, series)
 	if err != nil {
 		return nil, err
 	}
-	err = app.querySeriesAuthors(series)
+	if filter.Restricted() && len(series.Books) == 0 {
+		// series of hidden books only
+		return nil, sql.ErrNoRows
+	}
+	err = app.querySeriesAuthors(filter, series)
 	if err != nil {
 		return nil, err
 	}
@@ -166,16 +174,16 @@ func (app *Bouquins) SeriesFull(id int64) (*SeriesFull, error) {
 
 // SeriesAdv loads a list of series
 func (app *Bouquins) SeriesAdv(params *ReqParams) ([]*SeriesAdv, int, bool, error) {
-	limit, offset, sort, order := params.Limit, params.Offset, params.Sort, params.Order
+	limit, offset, sort, order, filter := params.Limit, params.Offset, params.Sort, params.Order, params.Filter
 	if len(params.Terms) > 0 {
-		series, count, err := app.searchSeries(limit, params.Terms, params.AllWords)
+		series, count, err := app.searchSeries(filter, limit, params.Terms, params.AllWords)
 		return series, count, count > limit, err
 	}
-	series, more, err := app.querySeriesList(limit, offset, sort, order)
+	series, more, err := app.querySeriesList(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
-	authors, err := app.querySeriesListAuthors(limit, offset, sort, order)
+	authors, err := app.querySeriesListAuthors(filter, limit, offset, sort, order)
 	if err != nil {
 		return nil, 0, false, err
 	}
@@ -1,11 +1,1355 @@
 package bouquins
 
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const tokenLength = 32
+
 // Account returns user account from authentifier
 func Account(authentifier string) (*UserAccount, error) {
 	account := new(UserAccount)
-	err := stmtAccount.QueryRow(authentifier).Scan(&account.ID, &account.DisplayName)
+	err := userStmts[qtAccount].QueryRow(authentifier).Scan(&account.ID, &account.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// AccountByID returns user account from its ID
+func AccountByID(id string) (*UserAccount, error) {
+	account := new(UserAccount)
+	err := userStmts[qtAccountByID].QueryRow(id).Scan(&account.ID, &account.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Restrictions returns restrictions rules of an user account
+func Restrictions(account string) ([]*Restriction, error) {
+	rows, err := userStmts[qtRestrictions].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	restrictions := make([]*Restriction, 0)
+	for rows.Next() {
+		r := new(Restriction)
+		if err = rows.Scan(&r.Field, &r.Value, &r.Exclude); err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return restrictions, nil
+}
+
+// API TOKENS //
+
+// hash of an API token, as stored in users.db
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tokens returns API tokens of an user account
+func Tokens(account string) ([]*APIToken, error) {
+	rows, err := userStmts[qtTokens].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*APIToken, 0)
+	for rows.Next() {
+		token := new(APIToken)
+		if err = rows.Scan(&token.ID, &token.Name, &token.Created, &token.LastUsed); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken creates a new API token for an user account, only its hash is stored
+func CreateToken(account, name string) (string, error) {
+	token, err := securedRandString(tokenLength)
+	if err != nil {
+		return "", err
+	}
+	_, err = userStmts[qtTokenAdd].Exec(account, name, tokenHash(token), time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken deletes an API token of an user account
+func RevokeToken(account string, id int64) error {
+	_, err := userStmts[qtTokenRevoke].Exec(account, id)
+	return err
+}
+
+// TokenAccount returns user account owning an API token
+func TokenAccount(token string) (*UserAccount, error) {
+	account := new(UserAccount)
+	var id int64
+	err := userStmts[qtTokenAccount].QueryRow(tokenHash(token)).Scan(&account.ID, &account.DisplayName, &id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = userStmts[qtTokenUsed].Exec(time.Now().Unix(), id)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// LOCAL PASSWORDS //
+
+// HasPassword checks if an user account has a local password
+func HasPassword(account string) (bool, error) {
+	var hash string
+	err := userStmts[qtPassword].QueryRow(account).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetPassword sets local password of an user account
+func SetPassword(account, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = userStmts[qtPasswordSet].Exec(account, string(hash))
+	return err
+}
+
+// CheckPassword checks local password of an user account
+func CheckPassword(account, password string) error {
+	var hash string
+	err := userStmts[qtPassword].QueryRow(account).Scan(&hash)
+	if err != nil {
+		return err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// PasswordAccount returns user account from an authentifier and its local password
+func PasswordAccount(authentifier, password string) (*UserAccount, error) {
+	account, err := Account(authentifier)
 	if err != nil {
 		return nil, err
 	}
+	if err = CheckPassword(account.ID, password); err != nil {
+		return nil, err
+	}
 	return account, nil
 }
+
+// ROLES //
+
+// Roles returns roles of an user account
+func Roles(account string) ([]string, error) {
+	rows, err := userStmts[qtRoles].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make([]string, 0)
+	for rows.Next() {
+		var role string
+		if err = rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// HasRole checks if an user account has a role
+func HasRole(account, role string) (bool, error) {
+	roles, err := Roles(account)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddRole adds a role to an user account
+func AddRole(account, role string) error {
+	_, err := userStmts[qtRoleAdd].Exec(account, role)
+	return err
+}
+
+// RemoveRole removes a role of an user account
+func RemoveRole(account, role string) error {
+	_, err := userStmts[qtRoleDelete].Exec(account, role)
+	return err
+}
+
+// Accounts returns all user accounts, with count of active sessions
+func Accounts() ([]*AccountAdmin, error) {
+	rows, err := userStmts[qtAccounts].Query(time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := make([]*AccountAdmin, 0)
+	for rows.Next() {
+		account := new(AccountAdmin)
+		if err = rows.Scan(&account.ID, &account.DisplayName, &account.Sessions); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// SESSIONS //
+
+// LoadSession returns encoded data and last seen date of a session, if not expired
+func LoadSession(id string) (string, int64, error) {
+	var data string
+	var lastSeen int64
+	err := userStmts[qtSession].QueryRow(id, time.Now().Unix()).Scan(&data, &lastSeen)
+	return data, lastSeen, err
+}
+
+// SaveSession creates or updates a session
+func SaveSession(id, account, data string, maxAge int, userAgent, address string) error {
+	now := time.Now().Unix()
+	_, err := userStmts[qtSessionSave].Exec(id, account, data, now, now+int64(maxAge), now, userAgent, address)
+	return err
+}
+
+// SessionSeen updates last seen date of a session
+func SessionSeen(id string) error {
+	_, err := userStmts[qtSessionSeen].Exec(time.Now().Unix(), id)
+	return err
+}
+
+// DeleteSession deletes a session
+func DeleteSession(id string) error {
+	_, err := userStmts[qtSessionDelete].Exec(id)
+	return err
+}
+
+// DeleteExpiredSessions deletes all expired sessions
+func DeleteExpiredSessions() error {
+	_, err := userStmts[qtSessionsExpired].Exec(time.Now().Unix())
+	return err
+}
+
+// AccountSessions returns active sessions of an user account, current is the ID of request session
+func AccountSessions(account, current string) ([]*UserSession, error) {
+	rows, err := userStmts[qtAccountSessions].Query(account, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	userSessions := make([]*UserSession, 0)
+	for rows.Next() {
+		s := new(UserSession)
+		var id string
+		if err = rows.Scan(&s.ID, &id, &s.Created, &s.LastSeen, &s.UserAgent, &s.Address); err != nil {
+			return nil, err
+		}
+		s.Current = id == current
+		userSessions = append(userSessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return userSessions, nil
+}
+
+// RevokeSession deletes a session of an user account
+func RevokeSession(account string, id int64) error {
+	_, err := userStmts[qtSessionRevoke].Exec(account, id)
+	return err
+}
+
+// RevokeOtherSessions deletes sessions of an user account, except current session
+func RevokeOtherSessions(account, current string) error {
+	_, err := userStmts[qtSessionsRevokeOthers].Exec(account, current)
+	return err
+}
+
+// RevokeAllSessions deletes all sessions of an user account (force logout)
+func RevokeAllSessions(account string) error {
+	_, err := userStmts[qtSessionsRevokeAll].Exec(account)
+	return err
+}
+
+// INVITATIONS //
+
+// Invitations returns pending invitations
+func Invitations() ([]*Invitation, error) {
+	rows, err := userStmts[qtInvitations].Query(time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := make([]*Invitation, 0)
+	for rows.Next() {
+		i := new(Invitation)
+		if err = rows.Scan(&i.ID, &i.Note, &i.CreatedBy, &i.Created, &i.Expires); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// InvitationValid checks if an invitation code is pending
+func InvitationValid(code string) (bool, error) {
+	var count int
+	err := userStmts[qtInvitationValid].QueryRow(tokenHash(code), time.Now().Unix()).Scan(&count)
+	return count > 0, err
+}
+
+// CreateInvitation stores an invitation, only the hash of its code is stored
+func CreateInvitation(code, note, createdBy string, expires int64) error {
+	_, err := userStmts[qtInvitationAdd].Exec(tokenHash(code), note, createdBy, time.Now().Unix(), expires)
+	return err
+}
+
+// DeleteInvitation deletes an invitation
+func DeleteInvitation(id int64) error {
+	_, err := userStmts[qtInvitationDelete].Exec(id)
+	return err
+}
+
+// IDENTITIES //
+
+// Authentifiers returns identities (emails) of an user account
+func Authentifiers(account string) ([]string, error) {
+	rows, err := userStmts[qtAuthentifiers].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	authentifiers := make([]string, 0)
+	for rows.Next() {
+		var authentifier string
+		if err = rows.Scan(&authentifier); err != nil {
+			return nil, err
+		}
+		authentifiers = append(authentifiers, authentifier)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return authentifiers, nil
+}
+
+// AddAuthentifier adds an identity to an user account
+func AddAuthentifier(account, authentifier string) error {
+	_, err := userStmts[qtAuthentifierAdd].Exec(account, authentifier)
+	return err
+}
+
+// RemoveAuthentifier removes an identity of an user account, unless it is the last one
+func RemoveAuthentifier(account, authentifier string) (bool, error) {
+	res, err := userStmts[qtAuthentifierDelete].Exec(account, authentifier, account)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SHARE LINKS //
+
+// shares from query rows
+func scanShares(rows *sql.Rows) ([]*Share, error) {
+	defer rows.Close()
+	shares := make([]*Share, 0)
+	for rows.Next() {
+		s := new(Share)
+		if err := rows.Scan(&s.ID, &s.Account, &s.Book, &s.Format, &s.Title, &s.Created, &s.Expires, &s.MaxDownloads, &s.Downloads); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// Shares returns all active share links
+func Shares() ([]*Share, error) {
+	rows, err := userStmts[qtShares].Query(time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanShares(rows)
+}
+
+// AccountShares returns active share links of an user account
+func AccountShares(account string) ([]*Share, error) {
+	rows, err := userStmts[qtAccountShares].Query(account, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanShares(rows)
+}
+
+// CreateShare stores a share link, returns its ID
+func CreateShare(s *Share) (int64, error) {
+	s.Created = time.Now().Unix()
+	res, err := userStmts[qtShareAdd].Exec(s.Account, s.Book, s.Format, s.Title, s.Created, s.Expires, s.MaxDownloads)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ShareValid checks if a share link of a book file is active
+func ShareValid(id, book int64, format string, expires int64) (bool, error) {
+	var count int
+	err := userStmts[qtShareValid].QueryRow(id, book, format, expires, time.Now().Unix()).Scan(&count)
+	return count > 0, err
+}
+
+// ShareServed counts bytes of a book file sent with a share link: each file size sent is a download
+func ShareServed(id, size, bytes int64) error {
+	_, err := userStmts[qtShareServed].Exec(size, bytes, size, bytes, id)
+	return err
+}
+
+// RevokeShare deletes a share link of an user account
+func RevokeShare(account string, id int64) error {
+	_, err := userStmts[qtShareRevoke].Exec(account, id)
+	return err
+}
+
+// DeleteShare deletes a share link (administration)
+func DeleteShare(id int64) error {
+	_, err := userStmts[qtShareDelete].Exec(id)
+	return err
+}
+
+// DOWNLOADS //
+
+// AddDownload records a book file download
+func AddDownload(d *Download) error {
+	_, err := userStmts[qtDownloadAdd].Exec(d.Account, d.Book, d.Format, d.Name, d.Time, d.Client)
+	return err
+}
+
+// AccountDownloads returns last downloads of an user account
+func AccountDownloads(account string, limit int) ([]*Download, error) {
+	rows, err := userStmts[qtAccountDownloads].Query(account, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	downloads := make([]*Download, 0)
+	for rows.Next() {
+		d := &Download{Account: account}
+		if err = rows.Scan(&d.Book, &d.Format, &d.Name, &d.Time, &d.Client); err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return downloads, nil
+}
+
+// DownloadCounts returns downloads count of each book file since a date
+func DownloadCounts(since int64) ([]*DownloadCount, error) {
+	rows, err := userStmts[qtDownloadCounts].Query(since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]*DownloadCount, 0)
+	for rows.Next() {
+		c := new(DownloadCount)
+		if err = rows.Scan(&c.Book, &c.Format, &c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// SHELVES //
+
+// shelves from query rows
+func scanShelves(rows *sql.Rows) ([]*Shelf, error) {
+	defer rows.Close()
+	shelves := make([]*Shelf, 0)
+	for rows.Next() {
+		s := new(Shelf)
+		if err := rows.Scan(&s.ID, &s.Account, &s.Owner, &s.Name, &s.Shared, &s.Created, &s.Count); err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+// Shelves returns shelves of an user account and shelves shared by other accounts
+func Shelves(account string) ([]*Shelf, error) {
+	rows, err := userStmts[qtShelves].Query(account, account, account)
+	if err != nil {
+		return nil, err
+	}
+	return scanShelves(rows)
+}
+
+// ShelvesBooks returns books IDs of shelves of an user account and shelves shared with it, by shelf
+func ShelvesBooks(account string) (map[int64][]int64, error) {
+	rows, err := userStmts[qtShelvesBooks].Query(account, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make(map[int64][]int64)
+	for rows.Next() {
+		var shelf, book int64
+		if err = rows.Scan(&shelf, &book); err != nil {
+			return nil, err
+		}
+		books[shelf] = append(books[shelf], book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// ShelfByID returns a shelf of an user account or shared with it by another account
+func ShelfByID(account string, id int64) (*Shelf, error) {
+	rows, err := userStmts[qtShelf].Query(id, account, account)
+	if err != nil {
+		return nil, err
+	}
+	shelves, err := scanShelves(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(shelves) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return shelves[0], nil
+}
+
+// CreateShelf stores a new shelf, returns its ID
+func CreateShelf(s *Shelf) (int64, error) {
+	s.Created = time.Now().Unix()
+	res, err := userStmts[qtShelfAdd].Exec(s.Account, s.Name, s.Created)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// UpdateShelf renames a shelf of an user account
+func UpdateShelf(account string, id int64, name string) error {
+	_, err := userStmts[qtShelfUpdate].Exec(name, id, account)
+	return err
+}
+
+// ShelfShares returns accounts a shelf is shared with
+func ShelfShares(id int64) ([]*UserAccount, error) {
+	rows, err := userStmts[qtShelfShares].Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := make([]*UserAccount, 0)
+	for rows.Next() {
+		a := new(UserAccount)
+		if err = rows.Scan(&a.ID, &a.DisplayName); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// ShareShelf shares (read only) a shelf of an user account with another account
+func ShareShelf(account string, id int64, reader string) error {
+	_, err := userStmts[qtShelfShareAdd].Exec(reader, id, account, reader)
+	return err
+}
+
+// UnshareShelf stops sharing a shelf of an user account with another account
+func UnshareShelf(account string, id int64, reader string) error {
+	_, err := userStmts[qtShelfShareRemove].Exec(id, reader, account)
+	return err
+}
+
+// DeleteShelf deletes a shelf of an user account, its books list and shares
+func DeleteShelf(account string, id int64) error {
+	if _, err := userStmts[qtShelfBooksDelete].Exec(id, account); err != nil {
+		return err
+	}
+	if _, err := userStmts[qtShelfSharesDelete].Exec(id, account); err != nil {
+		return err
+	}
+	_, err := userStmts[qtShelfDelete].Exec(id, account)
+	return err
+}
+
+// ShelfBooks returns books IDs of a shelf, ordered by position
+func ShelfBooks(id int64) ([]*ShelfBook, error) {
+	rows, err := userStmts[qtShelfBooks].Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make([]*ShelfBook, 0)
+	for rows.Next() {
+		b := new(ShelfBook)
+		if err = rows.Scan(&b.BookID, &b.Position, &b.Added); err != nil {
+			return nil, err
+		}
+		books = append(books, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// AddShelfBook adds a book at the end of a shelf of an user account
+func AddShelfBook(account string, id, book int64) error {
+	_, err := userStmts[qtShelfBookAdd].Exec(book, time.Now().Unix(), id, account)
+	return err
+}
+
+// RemoveShelfBook removes a book from a shelf of an user account
+func RemoveShelfBook(account string, id, book int64) error {
+	_, err := userStmts[qtShelfBookRemove].Exec(id, book, account)
+	return err
+}
+
+// SetShelfBookPosition changes position of a book in a shelf
+func SetShelfBookPosition(id, book, position int64) error {
+	_, err := userStmts[qtShelfBookPosition].Exec(position, id, book)
+	return err
+}
+
+// BookShelves returns IDs of shelves of an user account containing a book
+func BookShelves(account string, book int64) (map[int64]bool, error) {
+	rows, err := userStmts[qtBookShelves].Query(account, book)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shelves := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		shelves[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+// READING STATUS //
+
+// reading statuses from query rows
+func scanReading(rows *sql.Rows) ([]*Reading, error) {
+	defer rows.Close()
+	statuses := make([]*Reading, 0)
+	for rows.Next() {
+		r := new(Reading)
+		if err := rows.Scan(&r.Book, &r.Status, &r.Started, &r.Finished, &r.Updated); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// ReadingStatus returns read status of a book for an user account, nil if none
+func ReadingStatus(account string, book int64) (*Reading, error) {
+	r := &Reading{Book: book}
+	err := userStmts[qtReadingStatus].QueryRow(account, book).Scan(&r.Book, &r.Status, &r.Started, &r.Finished, &r.Updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadingStatuses returns read status of all books of an user account, by book ID
+func ReadingStatuses(account string) (map[int64]*Reading, error) {
+	rows, err := userStmts[qtReadingStatuses].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := scanReading(rows)
+	if err != nil {
+		return nil, err
+	}
+	byBook := make(map[int64]*Reading, len(statuses))
+	for _, r := range statuses {
+		byBook[r.Book] = r
+	}
+	return byBook, nil
+}
+
+// BooksWithStatus returns IDs of books of an user account with a read status
+func BooksWithStatus(account, status string) ([]int64, error) {
+	rows, err := userStmts[qtReadingByStatus].Query(account, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		books = append(books, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// ReadingBetween returns read statuses of an user account with books started or finished between two dates
+func ReadingBetween(account string, from, to int64) ([]*Reading, error) {
+	rows, err := userStmts[qtReadingYear].Query(account, from, to, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanReading(rows)
+}
+
+// SetReadingStatus stores read status of a book for an user account
+func SetReadingStatus(account string, r *Reading) error {
+	r.Updated = time.Now().Unix()
+	_, err := userStmts[qtReadingSet].Exec(account, r.Book, r.Status, r.Started, r.Finished, r.Updated)
+	return err
+}
+
+// DeleteReadingStatus removes read status of a book for an user account
+func DeleteReadingStatus(account string, book int64) error {
+	_, err := userStmts[qtReadingDelete].Exec(account, book)
+	return err
+}
+
+// RATINGS AND REVIEWS //
+
+// reviews from query rows
+func scanReviews(rows *sql.Rows) ([]*Review, error) {
+	defer rows.Close()
+	reviews := make([]*Review, 0)
+	for rows.Next() {
+		r := new(Review)
+		if err := rows.Scan(&r.Book, &r.Account, &r.Author, &r.Rating, &r.Text, &r.Created, &r.Updated); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+// AccountReview returns rating and review of a book by an user account, nil if none
+func AccountReview(account string, book int64) (*Review, error) {
+	rows, err := userStmts[qtReview].Query(account, book)
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := scanReviews(rows)
+	if err != nil || len(reviews) == 0 {
+		return nil, err
+	}
+	return reviews[0], nil
+}
+
+// BookReviews returns ratings and reviews of a book by all user accounts, last updated first
+func BookReviews(book int64) ([]*Review, error) {
+	rows, err := userStmts[qtBookReviews].Query(book)
+	if err != nil {
+		return nil, err
+	}
+	return scanReviews(rows)
+}
+
+// SetReview stores rating and review of a book by an user account
+func SetReview(r *Review) error {
+	r.Updated = time.Now().Unix()
+	_, err := userStmts[qtReviewSet].Exec(r.Account, r.Book, r.Rating, r.Text, r.Updated, r.Updated)
+	return err
+}
+
+// DeleteReview removes rating and review of a book by an user account
+func DeleteReview(account string, book int64) error {
+	_, err := userStmts[qtReviewDelete].Exec(account, book)
+	return err
+}
+
+// books IDs from query rows
+func scanBookIDs(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+	books := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		books = append(books, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// RatedBooks returns IDs of rated books, ordered by average rating
+func RatedBooks(desc bool) ([]int64, error) {
+	qt := qtRatedBooksAsc
+	if desc {
+		qt = qtRatedBooksDesc
+	}
+	rows, err := userStmts[qt].Query()
+	if err != nil {
+		return nil, err
+	}
+	return scanBookIDs(rows)
+}
+
+// AccountRatedBooks returns IDs of books rated at least min by an user account
+func AccountRatedBooks(account string, min int) ([]int64, error) {
+	rows, err := userStmts[qtAccountRatedBooks].Query(account, min)
+	if err != nil {
+		return nil, err
+	}
+	return scanBookIDs(rows)
+}
+
+// assignRatings sets average ratings of all users, and ratings of an user account if not empty, on a list of books
+func (app *Bouquins) assignRatings(books []*BookAdv, account string) error {
+	ids := make([]int64, len(books))
+	byID := make(map[int64]*BookAdv, len(books))
+	for i, b := range books {
+		ids[i] = b.ID
+		byID[b.ID] = b
+	}
+	return inBatches(ids, func(in string, args []interface{}) error {
+		return app.ratingsBatch(in, args, byID, account)
+	})
+}
+
+// ratingsBatch sets ratings of a batch of books
+func (app *Bouquins) ratingsBatch(in string, args []interface{}, byID map[int64]*BookAdv, account string) error {
+	rows, err := app.UserDB.Query(fmt.Sprintf(sqlRatingsByBook, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var avg float64
+		var count int
+		if err = rows.Scan(&id, &avg, &count); err != nil {
+			return err
+		}
+		byID[id].AvgRating, byID[id].Ratings = avg, count
+	}
+	if err = rows.Err(); err != nil || account == "" {
+		return err
+	}
+	rows, err = app.UserDB.Query(fmt.Sprintf(sqlAccountRatingsBook, in), append([]interface{}{account}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var rating int
+		if err = rows.Scan(&id, &rating); err != nil {
+			return err
+		}
+		byID[id].Rating = rating
+	}
+	return rows.Err()
+}
+
+// KOREADER SYNC //
+
+// SetKosyncKey sets KOReader sync key (MD5 of local password) of an user account
+func SetKosyncKey(account, key string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = userStmts[qtKosyncKeySet].Exec(account, string(hash))
+	return err
+}
+
+// KosyncAccount returns user account from an authentifier and its KOReader sync key
+func KosyncAccount(authentifier, key string) (*UserAccount, error) {
+	account, err := Account(authentifier)
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	err = userStmts[qtKosyncKey].QueryRow(account.ID).Scan(&hash)
+	if err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// scanProgress reads a reading progress row, nil if none
+func scanProgress(row *sql.Row) (*Progress, error) {
+	p := new(Progress)
+	err := row.Scan(&p.Document, &p.Progress, &p.Percentage, &p.Device, &p.DeviceID, &p.Timestamp, &p.Book)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DocumentProgress returns reading progress of a document (KOReader hash) for an user account, nil if none
+func DocumentProgress(account, document string) (*Progress, error) {
+	return scanProgress(userStmts[qtProgress].QueryRow(account, document))
+}
+
+// BookProgress returns last reading progress of a book for an user account, nil if none
+func BookProgress(account string, book int64) (*Progress, error) {
+	return scanProgress(userStmts[qtBookProgress].QueryRow(account, book))
+}
+
+// SetProgress stores reading progress of a document for an user account, book is kept if unknown (0)
+func SetProgress(account string, p *Progress) error {
+	var book interface{}
+	if p.Book > 0 {
+		book = p.Book
+	}
+	_, err := userStmts[qtProgressSet].Exec(account, p.Document, p.Progress, p.Percentage, p.Device, p.DeviceID, p.Timestamp, book)
+	return err
+}
+
+// DocumentBook returns calibre book of a document hash, 0 if unknown
+func DocumentBook(hash string) (int64, error) {
+	var book int64
+	err := userStmts[qtDocument].QueryRow(hash).Scan(&book)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return book, err
+}
+
+// AddDocument stores the hash of a book file
+func AddDocument(hash string, book int64, format string) error {
+	_, err := userStmts[qtDocumentAdd].Exec(hash, book, format)
+	return err
+}
+
+// KOBO SYNC //
+
+// KoboShelves returns shelves synced to Kobo devices of an user account (whole library if none)
+func KoboShelves(account string) (map[int64]bool, error) {
+	rows, err := userStmts[qtKoboShelves].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shelves := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		shelves[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+// SetKoboShelves replaces shelves synced to Kobo devices of an user account
+func SetKoboShelves(account string, shelves []int64) error {
+	if _, err := userStmts[qtKoboShelvesDelete].Exec(account); err != nil {
+		return err
+	}
+	for _, shelf := range shelves {
+		if _, err := userStmts[qtKoboShelfAdd].Exec(account, shelf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KoboToken returns creation date of the Kobo sync token of an user account, 0 if none
+func KoboToken(account string) (int64, error) {
+	var created int64
+	err := userStmts[qtKoboToken].QueryRow(account).Scan(&created)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return created, err
+}
+
+// CreateKoboToken replaces the Kobo sync token of an user account, only its hash is stored
+func CreateKoboToken(account string) (string, error) {
+	token, err := securedRandString(tokenLength)
+	if err != nil {
+		return "", err
+	}
+	if _, err = userStmts[qtKoboTokenSet].Exec(account, tokenHash(token), time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeleteKoboToken revokes the Kobo sync token of an user account
+func DeleteKoboToken(account string) error {
+	_, err := userStmts[qtKoboTokenDelete].Exec(account)
+	return err
+}
+
+// KoboTokenAccount returns user account owning a Kobo sync token
+func KoboTokenAccount(token string) (*UserAccount, error) {
+	account := new(UserAccount)
+	err := userStmts[qtKoboTokenAccount].QueryRow(tokenHash(token)).Scan(&account.ID, &account.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// KoboShelfBooks returns books of shelves synced to Kobo devices with last date added, by book ID
+func KoboShelfBooks(account string) (map[int64]int64, error) {
+	rows, err := userStmts[qtKoboShelfBooks].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make(map[int64]int64)
+	for rows.Next() {
+		var book, added int64
+		if err = rows.Scan(&book, &added); err != nil {
+			return nil, err
+		}
+		books[book] = added
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// DEVICES AND DELIVERIES //
+
+// Devices returns e-reader email addresses of an user account
+func Devices(account string) ([]*Device, error) {
+	rows, err := userStmts[qtDevices].Query(account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]*Device, 0)
+	for rows.Next() {
+		d := new(Device)
+		if err = rows.Scan(&d.ID, &d.Name, &d.Email, &d.Created); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// DeviceByID returns an e-reader of an user account
+func DeviceByID(account string, id int64) (*Device, error) {
+	d := new(Device)
+	err := userStmts[qtDevice].QueryRow(account, id).Scan(&d.ID, &d.Name, &d.Email, &d.Created)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// AddDevice adds an e-reader email address to an user account
+func AddDevice(account, name, email string) error {
+	_, err := userStmts[qtDeviceAdd].Exec(account, name, email, time.Now().Unix())
+	return err
+}
+
+// DeleteDevice removes an e-reader of an user account
+func DeleteDevice(account string, id int64) error {
+	_, err := userStmts[qtDeviceDelete].Exec(account, id)
+	return err
+}
+
+// deliveries from query rows
+func scanDeliveries(rows *sql.Rows, err error) ([]*Delivery, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := make([]*Delivery, 0)
+	for rows.Next() {
+		d := new(Delivery)
+		if err = rows.Scan(&d.ID, &d.Account, &d.Book, &d.Format, &d.Name, &d.Email, &d.Status,
+			&d.Attempts, &d.Error, &d.Created, &d.Updated, &d.NextTry); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// PendingDeliveries returns deliveries ready to be sent
+func PendingDeliveries(now int64, limit int) ([]*Delivery, error) {
+	return scanDeliveries(userStmts[qtDeliveriesPending].Query(now, limit))
+}
+
+// AccountDeliveries returns last deliveries of an user account
+func AccountDeliveries(account string, limit int) ([]*Delivery, error) {
+	return scanDeliveries(userStmts[qtAccountDeliveries].Query(account, limit))
+}
+
+// BookDeliveries returns last deliveries of a book by an user account
+func BookDeliveries(account string, book int64, limit int) ([]*Delivery, error) {
+	return scanDeliveries(userStmts[qtBookDeliveries].Query(account, book, limit))
+}
+
+// AddDelivery queues a book file to send by email
+func AddDelivery(d *Delivery) error {
+	now := time.Now().Unix()
+	d.Created, d.Updated, d.NextTry = now, now, now
+	res, err := userStmts[qtDeliveryAdd].Exec(d.Account, d.Book, d.Format, d.Name, d.Email, d.Status, d.Error,
+		d.Created, d.Updated, d.NextTry)
+	if err != nil {
+		return err
+	}
+	d.ID, err = res.LastInsertId()
+	return err
+}
+
+// UpdateDelivery stores status of a delivery after an attempt
+func UpdateDelivery(d *Delivery) error {
+	d.Updated = time.Now().Unix()
+	_, err := userStmts[qtDeliveryUpdate].Exec(d.Status, d.Attempts, d.Error, d.Updated, d.NextTry, d.ID)
+	return err
+}
+
+// ANNOTATIONS //
+
+// annotations from query rows
+func scanAnnotations(rows *sql.Rows, err error) ([]*Annotation, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	annotations := make([]*Annotation, 0)
+	for rows.Next() {
+		a := new(Annotation)
+		if err = rows.Scan(&a.ID, &a.Book, &a.Location, &a.Text, &a.Note, &a.Colour, &a.Created, &a.Updated); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+// Annotations returns annotations of all books of an user account
+func Annotations(account string) ([]*Annotation, error) {
+	return scanAnnotations(userStmts[qtAnnotations].Query(account))
+}
+
+// BookAnnotations returns annotations of a book by an user account, oldest first
+func BookAnnotations(account string, book int64) ([]*Annotation, error) {
+	return scanAnnotations(userStmts[qtBookAnnotations].Query(account, book))
+}
+
+// AnnotationByID returns an annotation of an user account
+func AnnotationByID(account string, id int64) (*Annotation, error) {
+	a := new(Annotation)
+	err := userStmts[qtAnnotation].QueryRow(account, id).Scan(&a.ID, &a.Book, &a.Location, &a.Text, &a.Note, &a.Colour,
+		&a.Created, &a.Updated)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AnnotationExists checks if an user account has an annotation of the same text at a location of a book
+func AnnotationExists(account string, a *Annotation) (bool, error) {
+	var count int
+	err := userStmts[qtAnnotationExists].QueryRow(account, a.Book, a.Location, a.Text).Scan(&count)
+	return count > 0, err
+}
+
+// AddAnnotation stores a new annotation of an user account, creation date is kept if set (imports)
+func AddAnnotation(account string, a *Annotation) error {
+	a.Updated = time.Now().Unix()
+	if a.Created == 0 {
+		a.Created = a.Updated
+	}
+	res, err := userStmts[qtAnnotationAdd].Exec(account, a.Book, a.Location, a.Text, a.Note, a.Colour, a.Created, a.Updated)
+	if err != nil {
+		return err
+	}
+	a.ID, err = res.LastInsertId()
+	return err
+}
+
+// UpdateAnnotation changes note and colour of an annotation of an user account
+func UpdateAnnotation(account string, a *Annotation) error {
+	a.Updated = time.Now().Unix()
+	_, err := userStmts[qtAnnotationUpdate].Exec(a.Note, a.Colour, a.Updated, account, a.ID)
+	return err
+}
+
+// DeleteAnnotation removes an annotation of an user account
+func DeleteAnnotation(account string, id int64) error {
+	_, err := userStmts[qtAnnotationDelete].Exec(account, id)
+	return err
+}
+
+// LOANS //
+
+// loans from query rows
+func scanLoans(rows *sql.Rows, err error) ([]*Loan, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	loans := make([]*Loan, 0)
+	for rows.Next() {
+		l := new(Loan)
+		if err = rows.Scan(&l.ID, &l.Book, &l.Lender, &l.BorrowerAccount, &l.Borrower, &l.Lent, &l.Due, &l.Returned); err != nil {
+			return nil, err
+		}
+		loans = append(loans, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
+
+// CurrentLoans returns books on loan, next due first
+func CurrentLoans() ([]*Loan, error) {
+	return scanLoans(userStmts[qtCurrentLoans].Query())
+}
+
+// BookLoan returns the current loan of a book, nil if not on loan
+func BookLoan(book int64) (*Loan, error) {
+	loans, err := scanLoans(userStmts[qtBookLoan].Query(book))
+	if err != nil || len(loans) == 0 {
+		return nil, err
+	}
+	return loans[0], nil
+}
+
+// LentBooks returns IDs of books on loan, only overdue ones if overdue is set
+func LentBooks(overdue bool) ([]int64, error) {
+	var rows *sql.Rows
+	var err error
+	if overdue {
+		rows, err = userStmts[qtOverdueBooks].Query(overdueBefore())
+	} else {
+		rows, err = userStmts[qtLentBooks].Query()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanBookIDs(rows)
+}
+
+// AddLoan records a book lent by an user account, errBookLent if the book is already on loan
+func AddLoan(l *Loan) error {
+	l.Lent = time.Now().Unix()
+	res, err := userStmts[qtLoanAdd].Exec(l.Book, l.Lender, l.BorrowerAccount, l.Borrower, l.Lent, l.Due)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errBookLent
+		}
+		return err
+	}
+	l.ID, err = res.LastInsertId()
+	return err
+}
+
+// ReturnLoan records the return of a lent book
+func ReturnLoan(id int64) error {
+	_, err := userStmts[qtLoanReturn].Exec(time.Now().Unix(), id)
+	return err
+}
@@ -0,0 +1,135 @@
+package bouquins
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	recentDownloads  = 10
+	popularBooksSize = 50
+	maxClientLength  = 255
+)
+
+// DownloadWindows are time windows (days) of popular books report, 0 for all time
+var DownloadWindows = []int{7, 30, 365, 0}
+
+// Download is a book file download
+type Download struct {
+	Account string // empty for share links
+	Book    int64
+	Format  string
+	Name    string // download file name
+	Time    int64
+	Client  string // user agent
+}
+
+// DownloadCount is the number of downloads of a book file
+type DownloadCount struct {
+	Book   int64
+	Format string
+	Name   string
+	Count  int64
+}
+
+// BookDownloads is the number of downloads of a book, total and per format
+type BookDownloads struct {
+	Book    int64
+	Name    string
+	Count   int64
+	Formats []*DownloadCount
+}
+
+// DownloadsReport is the popular books report of administration page
+type DownloadsReport struct {
+	Days    int
+	Windows []int
+	Books   []*BookDownloads
+	Formats map[string]int64
+	Total   int64
+}
+
+// resumedDownload is true for a range request not starting at the beginning of the file
+func resumedDownload(req *http.Request) bool {
+	ranges := req.Header.Get("Range")
+	return ranges != "" && !strings.HasPrefix(ranges, "bytes=0-")
+}
+
+// countedDownload is false for requests not sending a whole new file: HEAD, resumed or conditional requests
+func countedDownload(req *http.Request) bool {
+	return req.Method == http.MethodGet && !resumedDownload(req) &&
+		req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == ""
+}
+
+// recordDownload stores a book file download in history, errors are only logged
+func (app *Bouquins) recordDownload(req *http.Request, id int64, format, name string) {
+	if !countedDownload(req) {
+		return
+	}
+	client := req.UserAgent()
+	if len(client) > maxClientLength {
+		client = client[:maxClientLength]
+	}
+	d := &Download{
+		Account: app.AccountID(req),
+		Book:    id,
+		Format:  format,
+		Name:    name,
+		Time:    time.Now().Unix(),
+		Client:  client,
+	}
+	if err := AddDownload(d); err != nil {
+		log.Println("Error recording download", err)
+	}
+}
+
+// downloadsReport counts downloads per book and per format in last days (all time if 0)
+func downloadsReport(days int) (*DownloadsReport, error) {
+	report := &DownloadsReport{Days: days, Windows: DownloadWindows, Formats: make(map[string]int64)}
+	var since int64
+	if days > 0 {
+		since = time.Now().AddDate(0, 0, -days).Unix()
+	}
+	counts, err := DownloadCounts(since)
+	if err != nil {
+		return nil, err
+	}
+	books := make(map[int64]*BookDownloads)
+	for _, c := range counts {
+		b, ok := books[c.Book]
+		if !ok {
+			b = &BookDownloads{Book: c.Book, Name: strings.TrimSuffix(c.Name, "."+strings.ToLower(c.Format))}
+			books[c.Book] = b
+			report.Books = append(report.Books, b)
+		}
+		b.Count += c.Count
+		b.Formats = append(b.Formats, c)
+		report.Formats[c.Format] += c.Count
+		report.Total += c.Count
+	}
+	sort.SliceStable(report.Books, func(i, j int) bool {
+		return report.Books[i].Count > report.Books[j].Count
+	})
+	if len(report.Books) > popularBooksSize {
+		report.Books = report.Books[:popularBooksSize]
+	}
+	return report, nil
+}
+
+// downloadsDays reads report time window parameter, default first window
+func downloadsDays(req *http.Request) int {
+	days, err := strconv.Atoi(req.URL.Query().Get(pDays))
+	if err != nil {
+		return DownloadWindows[0]
+	}
+	for _, d := range DownloadWindows {
+		if d == days {
+			return days
+		}
+	}
+	return DownloadWindows[0]
+}
@@ -0,0 +1,52 @@
+package bouquins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordDownload(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": []byte("epub"), "PDF": []byte("pdf")})
+	// file in calibre database, missing on disk
+	if err := os.Remove(filepath.Join(app.Conf.CalibrePath, "Author", "Book (1)", "Book - Author.pdf")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+	}{
+		{http.MethodGet, "/books/1/file/pdf", nil, http.StatusNotFound},
+		{http.MethodHead, "/books/1/file/epub", nil, http.StatusOK},
+		{http.MethodGet, "/books/1/file/epub", map[string]string{"Range": "bytes=2-"}, http.StatusPartialContent},
+		{http.MethodGet, "/books/1/file/epub", nil, http.StatusOK},
+		{http.MethodGet, "/books/1/file/epub", map[string]string{"If-Modified-Since": "Sat, 01 Jan 2050 00:00:00 GMT"}, http.StatusNotModified},
+	} {
+		req := sessionRequest(t, app, c.method, c.target, account)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		res := httptest.NewRecorder()
+		if err := app.BooksPage(res, req); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != c.status {
+			t.Errorf("%s %s %v: status %d, expected %d", c.method, c.target, c.headers, res.Code, c.status)
+		}
+	}
+
+	downloads, err := AccountDownloads("a1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(downloads) != 1 || downloads[0].Format != "EPUB" {
+		t.Fatalf("downloads %v, expected only the whole EPUB file", downloads)
+	}
+}
@@ -0,0 +1,273 @@
+package bouquins
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	urlFile  = "file"
+	urlCover = "cover"
+
+	coverFile = "cover.jpg"
+
+	maxDownloadName = 150
+)
+
+// errNoCover is returned for a visible book without cover in calibre
+var errNoCover = errors.New("book has no cover")
+
+// bookFileURL returns the download URL of a book file
+func bookFileURL(id int64, format string) string {
+	return URLBooks + strconv.FormatInt(id, 10) + "/" + urlFile + "/" + strings.ToLower(format)
+}
+
+// bookCoverURL returns the URL of a book cover
+func bookCoverURL(id int64) string {
+	return URLBooks + strconv.FormatInt(id, 10) + "/" + urlCover
+}
+
+// calibreFile returns the path of a file of a book directory (relative to calibre path),
+// which must stay in calibre path
+func (app *Bouquins) calibreFile(bookPath, name string) (string, error) {
+	root, err := filepath.Abs(app.Conf.CalibrePath)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(root, filepath.FromSlash(bookPath), name)
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") || filepath.Base(file) != name {
+		return "", fmt.Errorf("invalid book path '%s'", bookPath)
+	}
+	return file, nil
+}
+
+// bookFile returns the path of a book file in a format and its download name, if the book is visible with filter
+func (app *Bouquins) bookFile(filter *BookFilter, id int64, format string) (string, string, *BookData, error) {
+	stmt, err := app.ps(filter, qtBookFile)
+	if err != nil {
+		return "", "", nil, err
+	}
+	var bookPath, title string
+	var author sql.NullString
+	data := new(BookData)
+	err = stmt.QueryRow(id, strings.ToUpper(format)).Scan(&bookPath, &data.Name, &data.Format, &data.Size, &title, &author)
+	if err != nil {
+		return "", "", nil, err
+	}
+	ext := "." + strings.ToLower(data.Format)
+	file, err := app.calibreFile(bookPath, data.Name+ext)
+	return file, downloadName(title, author.String, data.Name) + ext, data, err
+}
+
+// downloadName builds a file name "author - title" without characters forbidden in file systems
+func downloadName(title, author, fallback string) string {
+	name := title
+	if author != "" {
+		name = author + " - " + title
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.Join(strings.Fields(name), " "), ". ")
+	if runes := []rune(name); len(runes) > maxDownloadName {
+		name = strings.TrimSpace(string(runes[:maxDownloadName]))
+	}
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// bookCoverFile returns the path of a book cover and book last modification date, if the book is visible with filter,
+// errNoCover (with last modification date) if the book has no cover
+func (app *Bouquins) bookCoverFile(filter *BookFilter, id int64) (string, int64, error) {
+	stmt, err := app.ps(filter, qtBookCover)
+	if err != nil {
+		return "", 0, err
+	}
+	var bookPath string
+	var hasCover sql.NullBool
+	var lastModified sql.NullInt64
+	err = stmt.QueryRow(id).Scan(&bookPath, &hasCover, &lastModified)
+	if err != nil {
+		return "", 0, err
+	}
+	if !hasCover.Bool {
+		return "", lastModified.Int64, errNoCover
+	}
+	file, err := app.calibreFile(bookPath, coverFile)
+	return file, lastModified.Int64, err
+}
+
+// serveFile sends a file, 404 if missing
+func serveFile(res http.ResponseWriter, req *http.Request, file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	http.ServeContent(res, req, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// serveBookFile sends a book file as an attachment, with validators allowing resumed downloads:
+// ServeContent handles byte ranges, If-Range and conditional requests
+func serveBookFile(res http.ResponseWriter, req *http.Request, file, name string, data *BookData) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	res.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, data.Size, info.ModTime().Unix()))
+	res.Header().Set("Cache-Control", "private, no-cache")
+	res.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(res, req, name, info.ModTime(), f)
+	return nil
+}
+
+// servedBytes counts bytes of a file sent in response body (200 or 206), not error messages
+type servedBytes struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *servedBytes) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *servedBytes) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if w.status == http.StatusOK || w.status == http.StatusPartialContent {
+		w.bytes += int64(n)
+	}
+	return n, err
+}
+
+// bookFilePage sends a book file to logged in user, or with a share link
+func (app *Bouquins) bookFilePage(id int64, format string, res http.ResponseWriter, req *http.Request) error {
+	var filter *BookFilter
+	var share int64
+	if req.URL.Query().Get(pShare) != "" {
+		// signed share link, without login and restrictions
+		var ok bool
+		if share, ok = app.sharedFile(id, format, req); !ok {
+			http.NotFound(res, req)
+			return nil
+		}
+	} else {
+		if app.Username(req) == "" {
+			unauthorized(res)
+			return nil
+		}
+		var err error
+		if filter, err = app.UserFilter(req); err != nil {
+			return err
+		}
+	}
+	file, name, data, err := app.bookFile(filter, id, format)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// only files actually sent are counted: missing files, HEAD and conditional requests send no bytes
+	served := &servedBytes{ResponseWriter: res}
+	if err = serveBookFile(served, req, file, name, data); err != nil || served.bytes == 0 {
+		return err
+	}
+	if share != 0 {
+		// share links count bytes sent, whatever the ranges requested
+		if info, statErr := os.Stat(file); statErr == nil && info.Size() > 0 {
+			if countErr := ShareServed(share, info.Size(), served.bytes); countErr != nil {
+				log.Println("Error counting share download", countErr)
+			}
+		}
+	}
+	app.recordDownload(req, id, data.Format, name)
+	if countedDownload(req) {
+		// KOReader progress sync identifies books by file hash
+		if err = addDocuments(id, data.Format, file, name); err != nil {
+			log.Println("Error hashing book file", id, data.Format, err)
+		}
+	}
+	return nil
+}
+
+// bookCoverPage sends a book cover, covers don't need login
+func (app *Bouquins) bookCoverPage(id int64, res http.ResponseWriter, req *http.Request) error {
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	file, lastModified, err := app.bookCoverFile(filter, id)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err == errNoCover {
+		return app.placeholderPage(filter, id, lastModified, placeholderWidth, res, req)
+	}
+	if err != nil {
+		return err
+	}
+	return serveFile(res, req, file)
+}
+
+// bookResource dispatches book URLs: /books/{id}, /books/{id}/file/{format}, /books/{id}/cover, /books/{id}/thumb/{size}
+func (app *Bouquins) bookResource(idParam string, res http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(idParam, "/")
+	if len(parts) == 1 {
+		return app.bookPage(idParam, res, req)
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		http.NotFound(res, req)
+		return nil
+	}
+	switch {
+	case len(parts) == 3 && parts[1] == urlFile && parts[2] != "":
+		return app.bookFilePage(id, parts[2], res, req)
+	case len(parts) == 2 && parts[1] == urlCover:
+		return app.bookCoverPage(id, res, req)
+	case len(parts) == 3 && parts[1] == urlThumb:
+		return app.bookThumbPage(id, parts[2], res, req)
+	}
+	log.Println("Unknown book resource", req.URL.Path)
+	http.NotFound(res, req)
+	return nil
+}
@@ -0,0 +1,107 @@
+package bouquins
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBookFilePage(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": []byte("epub")})
+	// calibre database pointing outside the library
+	outside := filepath.Join(filepath.Dir(app.Conf.CalibrePath), "outside.epub")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(outside) })
+	for _, query := range []string{
+		"INSERT INTO books (id, title, sort, path, uuid) VALUES (2, 'Escape', 'Escape', '..', 'uuid-2')",
+		"INSERT INTO data (book, format, uncompressed_size, name) VALUES (2, 'EPUB', 6, 'outside')",
+		"INSERT INTO data (book, format, uncompressed_size, name) VALUES (1, 'PDF', 6, '../../outside')",
+	} {
+		if _, err := app.DB.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/books/1/file/epub", http.StatusOK, "epub"},
+		{"/books/1/file/EPUB", http.StatusOK, "epub"},
+		{"/books/1/file/mobi", http.StatusNotFound, ""},
+		{"/books/3/file/epub", http.StatusNotFound, ""},
+		{"/books/1/file/..%2F..%2Foutside.epub", http.StatusNotFound, ""},
+		{"/books/1/file/epub/..", http.StatusNotFound, ""},
+		{"/books/x/file/epub", http.StatusNotFound, ""},
+	} {
+		res := httptest.NewRecorder()
+		if err := app.BooksPage(res, sessionRequest(t, app, http.MethodGet, c.target, account)); err != nil {
+			t.Errorf("%s: %v", c.target, err)
+			continue
+		}
+		if res.Code != c.status || (c.body != "" && res.Body.String() != c.body) {
+			t.Errorf("%s: status %d, body %q", c.target, res.Code, res.Body.String())
+		}
+	}
+
+	// book path or file name out of calibre library
+	for _, target := range []string{"/books/2/file/epub", "/books/1/file/pdf"} {
+		res := httptest.NewRecorder()
+		if err := app.BooksPage(res, sessionRequest(t, app, http.MethodGet, target, account)); err == nil || res.Body.Len() > 0 {
+			t.Errorf("%s: file out of library served (status %d, %v)", target, res.Code, err)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	if err := app.BooksPage(res, httptest.NewRequest(http.MethodGet, "/books/1/file/epub", nil)); err != nil || res.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous download: status %d (%v)", res.Code, err)
+	}
+}
+
+func TestBookFileResume(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": []byte("0123456789")})
+	if _, err := app.DB.Exec("UPDATE books SET title = 'Book: a/b?' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	if err := app.BooksPage(res, sessionRequest(t, app, http.MethodGet, "/books/1/file/epub", account)); err != nil {
+		t.Fatal(err)
+	}
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET: status %d, ETag %q", res.Code, etag)
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `attachment; filename="Author - Book_ a_b_.epub"` {
+		t.Errorf("Content-Disposition %q", disposition)
+	}
+
+	for _, c := range []struct {
+		ifRange string
+		status  int
+		body    string
+	}{
+		{etag, http.StatusPartialContent, "56789"},
+		{`"changed"`, http.StatusOK, "0123456789"},
+	} {
+		req := sessionRequest(t, app, http.MethodGet, "/books/1/file/epub", account)
+		req.Header.Set("Range", "bytes=5-")
+		req.Header.Set("If-Range", c.ifRange)
+		res = httptest.NewRecorder()
+		if err := app.BooksPage(res, req); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != c.status || res.Body.String() != c.body {
+			t.Errorf("If-Range %s: status %d, body %q", c.ifRange, res.Code, res.Body.String())
+		}
+	}
+}
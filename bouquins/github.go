@@ -57,15 +57,18 @@ func (p GithubProvider) Config(conf *Conf) *oauth2.Config {
 // GetUser returns github primary email
 func (p GithubProvider) GetUser(token *oauth2.Token) (string, error) {
 	apiReq, err := http.NewRequest("GET", "https://api.github.com/user/emails", nil)
+	if err != nil {
+		return "", err
+	}
 	apiReq.Header.Add("Accept", "application/vnd.github.v3+json")
 	apiReq.Header.Add("Authorization", "token "+token.AccessToken)
 	client := &http.Client{}
 	response, err := client.Do(apiReq)
-	defer response.Body.Close()
 	if err != nil {
 		log.Println("Auth error", err)
 		return "", fmt.Errorf("Authentification error")
 	}
+	defer response.Body.Close()
 
 	dec := json.NewDecoder(response.Body)
 	var emails []githubEmail
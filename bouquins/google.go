@@ -62,11 +62,11 @@ func (p GoogleProvider) Config(conf *Conf) *oauth2.Config {
 // GetUser returns github primary email
 func (p GoogleProvider) GetUser(token *oauth2.Token) (string, error) {
 	apiRes, err := http.Post("https://www.googleapis.com/oauth2/v2/tokeninfo?access_token="+token.AccessToken, "application/json", nil)
-	defer apiRes.Body.Close()
 	if err != nil {
 		log.Println("Auth error", err)
 		return "", fmt.Errorf("Authentification error")
 	}
+	defer apiRes.Body.Close()
 	dec := json.NewDecoder(apiRes.Body)
 	var tokenInfo googleTokenInfo
 	err = dec.Decode(&tokenInfo)
@@ -0,0 +1,150 @@
+package bouquins
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/oauth2"
+)
+
+// usersSchema returns users.db CREATE statements documented in README
+func usersSchema(t *testing.T) []string {
+	f, err := os.Open(filepath.Join("..", "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var schema []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "CREATE ") {
+			schema = append(schema, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+// calibreSchema returns CREATE statements of a minimal calibre library
+func calibreSchema(t *testing.T) []string {
+	data, err := os.ReadFile(filepath.Join("testdata", "metadata.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CREATE ") {
+			schema = append(schema, line)
+		}
+	}
+	return schema
+}
+
+// openTestDB creates a sqlite database file (not in memory: shared by all connections of the pool)
+func openTestDB(t *testing.T, path string, schema []string) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, stmt := range schema {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err, stmt)
+		}
+	}
+	return db
+}
+
+// newTestApp returns an application with templates, an empty calibre library and users database in a temporary directory
+func newTestApp(t *testing.T) *Bouquins {
+	dir := t.TempDir()
+	conf := &Conf{
+		CalibrePath:    dir,
+		ThumbnailsPath: filepath.Join(dir, "thumbnails"),
+		CookieSecret:   "test secret",
+		ExternalURL:    "http://bouquins.test",
+	}
+	tpl, err := TemplatesFunc(false).ParseGlob(filepath.Join("..", "templates", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSessionStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Bouquins{
+		Tpl:       tpl,
+		DB:        openTestDB(t, filepath.Join(dir, "metadata.db"), calibreSchema(t)),
+		UserDB:    openTestDB(t, filepath.Join(dir, "users.db"), usersSchema(t)),
+		Conf:      conf,
+		OAuthConf: make(map[string]*oauth2.Config),
+		Sessions:  store,
+	}
+	if err = app.PrepareAll(); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// testAccount creates an user account with an email authentifier
+func testAccount(t *testing.T, app *Bouquins, id, email string) *UserAccount {
+	if _, err := app.UserDB.Exec("INSERT INTO accounts (id, name) VALUES (?, ?)", id, email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.UserDB.Exec("INSERT INTO authentifiers (id, authentifier) VALUES (?, ?)", id, email); err != nil {
+		t.Fatal(err)
+	}
+	return &UserAccount{ID: id, DisplayName: email}
+}
+
+// testBook adds a book to calibre library, with files of formats
+func testBook(t *testing.T, app *Bouquins, id int64, title, author string, files map[string][]byte) {
+	bookPath := filepath.Join(author, fmt.Sprintf("%s (%d)", title, id))
+	name := title + " - " + author
+	exec := func(query string, args ...interface{}) {
+		if _, err := app.DB.Exec(query, args...); err != nil {
+			t.Fatal(err, query)
+		}
+	}
+	exec("INSERT INTO books (id, title, sort, path, uuid, last_modified) VALUES (?, ?, ?, ?, ?, '2024-01-02 03:04:05+00:00')",
+		id, title, title, bookPath, fmt.Sprintf("uuid-%d", id))
+	exec("INSERT OR IGNORE INTO authors (name, sort) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM authors WHERE name = ?)", author, author, author)
+	exec("INSERT INTO books_authors_link (book, author) SELECT ?, id FROM authors WHERE name = ?", id, author)
+	if err := os.MkdirAll(filepath.Join(app.Conf.CalibrePath, bookPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for format, content := range files {
+		exec("INSERT INTO data (book, format, uncompressed_size, name) VALUES (?, ?, ?, ?)", id, format, len(content), name)
+		file := filepath.Join(app.Conf.CalibrePath, bookPath, name+"."+strings.ToLower(format))
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sessionRequest returns a request with the session cookie of a logged in user account
+func sessionRequest(t *testing.T, app *Bouquins, method, target string, account *UserAccount) *http.Request {
+	login := httptest.NewRequest(http.MethodGet, URLIndex, nil)
+	res := httptest.NewRecorder()
+	session := app.Session(login)
+	session.Values[sessionUser] = account.DisplayName
+	session.Values[sessionAccount] = account.ID
+	if err := session.Save(login, res); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, nil)
+	for _, cookie := range res.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
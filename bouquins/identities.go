@@ -0,0 +1,60 @@
+package bouquins
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	sessionLink = "link"
+
+	pIdentity = "identity"
+)
+
+// startLink starts OAuth flow to link a new identity to logged in account
+func (app *Bouquins) startLink(res http.ResponseWriter, req *http.Request) error {
+	provider := req.PostFormValue(pProvider)
+	if app.OAuthConf[provider] == nil {
+		return fmt.Errorf("unknown provider '%s'", provider)
+	}
+	session := app.Session(req)
+	session.Values[sessionLink] = app.AccountID(req)
+	if err := session.Save(req, res); err != nil {
+		return err
+	}
+	http.Redirect(res, req, URLLogin+"?"+pProvider+"="+url.QueryEscape(provider), http.StatusSeeOther)
+	return nil
+}
+
+// linkIdentity adds an identity (email) to an account, at the end of OAuth flow
+func (app *Bouquins) linkIdentity(account, email string, res http.ResponseWriter, req *http.Request) error {
+	owner, err := Account(email)
+	if err == nil && owner.ID != account {
+		return fmt.Errorf("identity already used by another account")
+	}
+	if err != nil {
+		if err = AddAuthentifier(account, email); err != nil {
+			return err
+		}
+		log.Println("Identity linked", account, email)
+	}
+	if err = app.Session(req).Save(req, res); err != nil {
+		return err
+	}
+	http.Redirect(res, req, URLSettings, http.StatusSeeOther)
+	return nil
+}
+
+// unlinkIdentity removes an identity of logged in account, last identity can't be removed
+func (app *Bouquins) unlinkIdentity(model *SettingsModel, req *http.Request) error {
+	removed, err := RemoveAuthentifier(app.AccountID(req), req.PostFormValue(pIdentity))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		model.Message = "Impossible de supprimer la dernière identité"
+	}
+	return nil
+}
@@ -0,0 +1,615 @@
+package bouquins
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	urlKoboDownload = "download"
+	urlKoboImage    = "image.jpg"
+
+	koboSyncLimit   = 100
+	koboTimeFormat  = "2006-01-02T15:04:05Z"
+	koboSyncToken   = "X-Kobo-Synctoken"
+	koboSync        = "X-Kobo-Sync"
+	koboAPIToken    = "X-Kobo-Apitoken"
+	koboCategory    = "00000000-0000-0000-0000-000000000001"
+	koboDevice      = "Kobo"
+	koboDocument    = "kobo:" // prefix of progress documents synced by Kobo devices (book UUID)
+	koboMaxStateLen = 64 * kosyncMaxField
+
+	// Kobo read statuses
+	koboReadyToRead = "ReadyToRead"
+	koboReading     = "Reading"
+	koboFinished    = "Finished"
+)
+
+// koboJSON is a Kobo store API object
+type koboJSON map[string]interface{}
+
+// koboPosition is the position of a device in library sync, sent back by the device in a header
+type koboPosition struct {
+	Modified int64 `json:"modified"` // last modification or shelf addition date of synced books
+	Book     int64 `json:"book"`
+}
+
+// koboBook is a book synced to Kobo devices
+type koboBook struct {
+	ID       int64
+	UUID     string
+	Created  int64
+	Modified int64 // calibre modification or addition to a synced shelf
+}
+
+// after checks if a book is modified after a sync position
+func (b *koboBook) after(p *koboPosition) bool {
+	return b.Modified > p.Modified || (b.Modified == p.Modified && b.ID > p.Book)
+}
+
+// koboStates is a reading state update sent by Kobo devices
+type koboStates struct {
+	ReadingStates []struct {
+		EntitlementID string `json:"EntitlementId"`
+		StatusInfo    *struct {
+			Status string `json:"Status"`
+		} `json:"StatusInfo"`
+		CurrentBookmark *struct {
+			ProgressPercent float64         `json:"ProgressPercent"`
+			Location        json.RawMessage `json:"Location"`
+		} `json:"CurrentBookmark"`
+	} `json:"ReadingStates"`
+}
+
+// koboPath splits a Kobo API path in user token and API path
+func koboPath(req *http.Request) (string, string) {
+	path := strings.TrimPrefix(req.URL.Path, URLKobo)
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// koboAccount returns user account authenticated by the Kobo sync token of Kobo API path:
+// a token only valid for Kobo API, API tokens are refused
+func koboAccount(req *http.Request) (*UserAccount, bool) {
+	token, _ := koboPath(req)
+	if token == "" {
+		return nil, false
+	}
+	account, err := KoboTokenAccount(token)
+	return account, err == nil
+}
+
+// koboTime formats a date for Kobo API
+func koboTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(koboTimeFormat)
+}
+
+// koboStatus converts a read status to Kobo read status
+func koboStatus(r *Reading) string {
+	if r != nil {
+		switch r.Status {
+		case StatusReading:
+			return koboReading
+		case StatusFinished:
+			return koboFinished
+		}
+	}
+	return koboReadyToRead
+}
+
+// koboFormats returns Kobo download formats of a calibre format, nil if not supported by Kobo devices
+func koboFormats(format string) []string {
+	switch strings.ToUpper(format) {
+	case "KEPUB":
+		return []string{"KEPUB"}
+	case "EPUB":
+		return []string{"EPUB3", "EPUB"}
+	}
+	return nil
+}
+
+// readPosition decodes the sync position header, zero (full sync) if missing or from another store
+func readPosition(req *http.Request) *koboPosition {
+	p := new(koboPosition)
+	data, err := base64.RawURLEncoding.DecodeString(req.Header.Get(koboSyncToken))
+	if err == nil {
+		json.Unmarshal(data, p)
+	}
+	return p
+}
+
+// writePosition sends the sync position header
+func writePosition(res http.ResponseWriter, p *koboPosition) {
+	data, _ := json.Marshal(p)
+	res.Header().Set(koboSyncToken, base64.RawURLEncoding.EncodeToString(data))
+}
+
+// bookByUUID returns the ID of a book visible with filter from its calibre UUID
+func (app *Bouquins) bookByUUID(filter *BookFilter, uuid string) (int64, error) {
+	stmt, err := app.ps(filter, qtBookUUID)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = stmt.QueryRow(uuid).Scan(&id)
+	return id, err
+}
+
+// koboBooks lists books of synced shelves (whole library if none) modified after a sync position, oldest first
+func (app *Bouquins) koboBooks(filter *BookFilter, account string, since *koboPosition) ([]*koboBook, error) {
+	shelves, err := KoboShelves(account)
+	if err != nil {
+		return nil, err
+	}
+	var added map[int64]int64
+	if len(shelves) > 0 {
+		if added, err = KoboShelfBooks(account); err != nil {
+			return nil, err
+		}
+		ids := make([]int64, 0, len(added))
+		for id := range added {
+			ids = append(ids, id)
+		}
+		filter = filter.Only(ids)
+	}
+	stmt, err := app.ps(filter, qtKoboBooks)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books := make([]*koboBook, 0)
+	for rows.Next() {
+		b := new(koboBook)
+		var uuid sql.NullString
+		if err = rows.Scan(&b.ID, &uuid, &b.Created, &b.Modified); err != nil {
+			return nil, err
+		}
+		if !uuid.Valid {
+			continue
+		}
+		b.UUID = uuid.String
+		if added[b.ID] > b.Modified {
+			b.Modified = added[b.ID]
+		}
+		if b.after(since) {
+			books = append(books, b)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(books, func(i, j int) bool {
+		return books[j].after(&koboPosition{books[i].Modified, books[i].ID})
+	})
+	return books, nil
+}
+
+// koboMetadata builds Kobo metadata of a book, nil if it has no format readable by Kobo devices
+func koboMetadata(base string, book *BookFull) koboJSON {
+	urls := make([]koboJSON, 0)
+	for _, data := range book.Data {
+		for _, format := range koboFormats(data.Format) {
+			urls = append(urls, koboJSON{
+				"Format":   format,
+				"Size":     data.Size,
+				"Url":      base + "/" + urlKoboDownload + "/" + strconv.FormatInt(book.ID, 10) + "/" + strings.ToLower(data.Format),
+				"Platform": "Generic",
+			})
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	authors := make([]string, len(book.Authors))
+	roles := make([]koboJSON, len(book.Authors))
+	for i, a := range book.Authors {
+		authors[i] = a.Name
+		roles[i] = koboJSON{"Name": a.Name}
+	}
+	m := koboJSON{
+		"Categories":              []string{koboCategory},
+		"CoverImageId":            book.UUID,
+		"CrossRevisionId":         book.UUID,
+		"CurrentDisplayPrice":     koboJSON{"CurrencyCode": "EUR", "TotalAmount": 0},
+		"CurrentLoveDisplayPrice": koboJSON{"TotalAmount": 0},
+		"Description":             "",
+		"DownloadUrls":            urls,
+		"EntitlementId":           book.UUID,
+		"ExternalIds":             []string{},
+		"Genre":                   koboCategory,
+		"IsEligibleForKoboLove":   false,
+		"IsInternetArchive":       false,
+		"IsPreOrder":              false,
+		"IsSocialEnabled":         true,
+		"Language":                book.Lang,
+		"PhoneticPronunciations":  koboJSON{},
+		"PublicationDate":         koboTime(book.Pubdate),
+		"Publisher":               koboJSON{"Imprint": "", "Name": book.Publisher},
+		"RevisionId":              book.UUID,
+		"Title":                   book.Title,
+		"WorkId":                  book.UUID,
+		"Contributors":            authors,
+		"ContributorRoles":        roles,
+	}
+	if book.Series != nil {
+		m["Series"] = koboJSON{
+			"Name":        book.Series.Name,
+			"Number":      strconv.FormatFloat(book.SeriesIndex, 'f', -1, 64),
+			"NumberFloat": book.SeriesIndex,
+			"Id":          "series-" + strconv.FormatInt(book.Series.ID, 10),
+		}
+	}
+	return m
+}
+
+// koboReadingState builds Kobo reading state of a book from read status and position synced by Kobo devices
+func koboReadingState(uuid string, created int64, r *Reading, p *Progress) koboJSON {
+	updated := created
+	if r != nil {
+		updated = r.Updated
+	}
+	bookmark := koboJSON{"LastModified": koboTime(updated)}
+	if p != nil {
+		bookmark["LastModified"] = koboTime(p.Timestamp)
+		bookmark["ProgressPercent"] = p.Percentage * 100
+		if json.Valid([]byte(p.Progress)) {
+			bookmark["Location"] = json.RawMessage(p.Progress)
+		}
+		if p.Timestamp > updated {
+			updated = p.Timestamp
+		}
+	}
+	return koboJSON{
+		"EntitlementId":     uuid,
+		"Created":           koboTime(created),
+		"LastModified":      koboTime(updated),
+		"PriorityTimestamp": koboTime(updated),
+		"StatusInfo":        koboJSON{"LastModified": koboTime(updated), "Status": koboStatus(r)},
+		"Statistics":        koboJSON{"LastModified": koboTime(updated)},
+		"CurrentBookmark":   bookmark,
+	}
+}
+
+// koboBookState returns Kobo reading state of a book for an user account
+func koboBookState(account string, b *koboBook) (koboJSON, error) {
+	r, err := ReadingStatus(account, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	p, err := DocumentProgress(account, koboDocument+b.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return koboReadingState(b.UUID, b.Created, r, p), nil
+}
+
+// koboSyncPage sends books modified since the position of the device, by pages
+func (app *Bouquins) koboSyncPage(base, account string, res http.ResponseWriter, req *http.Request) error {
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	since := readPosition(req)
+	books, err := app.koboBooks(filter, account, since)
+	if err != nil {
+		return err
+	}
+	if len(books) > koboSyncLimit {
+		books = books[:koboSyncLimit]
+		res.Header().Set(koboSync, "continue")
+	}
+	ids := make([]int64, len(books))
+	for i, b := range books {
+		ids[i] = b.ID
+	}
+	full, err := app.BooksFullByID(filter, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]*BookFull, len(full))
+	for _, book := range full {
+		byID[book.ID] = book
+	}
+	entitlements := make([]koboJSON, 0, len(books))
+	position := since
+	for _, b := range books {
+		position = &koboPosition{b.Modified, b.ID}
+		book, ok := byID[b.ID]
+		if !ok {
+			continue
+		}
+		metadata := koboMetadata(base, book)
+		if metadata == nil {
+			continue
+		}
+		state, err := koboBookState(account, b)
+		if err != nil {
+			return err
+		}
+		kind := "ChangedEntitlement"
+		if since.Modified == 0 || b.Created > since.Modified {
+			kind = "NewEntitlement"
+		}
+		entitlements = append(entitlements, koboJSON{kind: koboJSON{
+			"BookEntitlement": koboJSON{
+				"Accessibility":       "Full",
+				"ActivePeriod":        koboJSON{"From": koboTime(time.Now().Unix())},
+				"Created":             koboTime(b.Created),
+				"CrossRevisionId":     b.UUID,
+				"Id":                  b.UUID,
+				"IsRemoved":           false,
+				"IsHiddenFromArchive": false,
+				"IsLocked":            false,
+				"LastModified":        koboTime(b.Modified),
+				"OriginCategory":      "Imported",
+				"RevisionId":          b.UUID,
+				"Status":              "Active",
+			},
+			"BookMetadata": metadata,
+			"ReadingState": state,
+		}})
+	}
+	writePosition(res, position)
+	return writeJSON(res, entitlements)
+}
+
+// koboBookResource finds a synced book from its UUID, responds 404 if not visible
+func (app *Bouquins) koboBookResource(uuid string, res http.ResponseWriter, req *http.Request) (*BookFull, error) {
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	id, err := app.bookByUUID(filter, uuid)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return app.BookFull(filter, id)
+}
+
+// koboMetadataPage sends metadata of a book
+func (app *Bouquins) koboMetadataPage(base, uuid string, res http.ResponseWriter, req *http.Request) error {
+	book, err := app.koboBookResource(uuid, res, req)
+	if err != nil || book == nil {
+		return err
+	}
+	metadata := koboMetadata(base, book)
+	if metadata == nil {
+		http.NotFound(res, req)
+		return nil
+	}
+	return writeJSON(res, []koboJSON{metadata})
+}
+
+// updateKoboState stores read status and position sent by a Kobo device
+func updateKoboState(account string, book *BookFull, states *koboStates) error {
+	now := time.Now().Unix()
+	for _, s := range states.ReadingStates {
+		if s.StatusInfo != nil && s.StatusInfo.Status != koboReadyToRead {
+			r, err := ReadingStatus(account, book.ID)
+			if err != nil {
+				return err
+			}
+			if r == nil {
+				r = &Reading{Book: book.ID}
+			}
+			switch s.StatusInfo.Status {
+			case koboReading:
+				if r.Status != StatusReading || r.Started == 0 {
+					r.Started = now
+				}
+				r.Status, r.Finished = StatusReading, 0
+			case koboFinished:
+				if r.Status != StatusFinished || r.Finished == 0 {
+					r.Finished = now
+				}
+				r.Status = StatusFinished
+			}
+			if err = SetReadingStatus(account, r); err != nil {
+				return err
+			}
+		}
+		if b := s.CurrentBookmark; b != nil {
+			percentage := b.ProgressPercent / 100
+			if percentage < 0 || percentage > 1 {
+				percentage = 0
+			}
+			location := string(b.Location)
+			if len(location) > kosyncMaxField {
+				location = ""
+			}
+			p := &Progress{
+				Document:   koboDocument + book.UUID,
+				Progress:   location,
+				Percentage: percentage,
+				Device:     koboDevice,
+				Timestamp:  now,
+				Book:       book.ID,
+			}
+			if err := SetProgress(account, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// koboStatePage sends (GET) or updates (PUT) reading state of a book
+func (app *Bouquins) koboStatePage(account, uuid string, res http.ResponseWriter, req *http.Request) error {
+	book, err := app.koboBookResource(uuid, res, req)
+	if err != nil || book == nil {
+		return err
+	}
+	if req.Method == http.MethodPut {
+		states := new(koboStates)
+		if err = json.NewDecoder(io.LimitReader(req.Body, koboMaxStateLen)).Decode(states); err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		if err = updateKoboState(account, book, states); err != nil {
+			return err
+		}
+		return writeJSON(res, koboJSON{
+			"RequestResult": "Success",
+			"UpdateResults": []koboJSON{{
+				"EntitlementId":         uuid,
+				"CurrentBookmarkResult": koboJSON{"Result": "Success"},
+				"StatisticsResult":      koboJSON{"Result": "Ignored"},
+				"StatusInfoResult":      koboJSON{"Result": "Success"},
+			}},
+		})
+	}
+	state, err := koboBookState(account, &koboBook{ID: book.ID, UUID: book.UUID, Created: book.Timestamp})
+	if err != nil {
+		return err
+	}
+	return writeJSON(res, []koboJSON{state})
+}
+
+// koboCoverPage sends the smallest thumbnail at least as wide as requested by the device
+func (app *Bouquins) koboCoverPage(uuid, width string, res http.ResponseWriter, req *http.Request) error {
+	book, err := app.koboBookResource(uuid, res, req)
+	if err != nil || book == nil {
+		return err
+	}
+	w, _ := strconv.Atoi(width)
+	size := ThumbnailSizes[len(ThumbnailSizes)-1]
+	for _, s := range ThumbnailSizes {
+		if s >= w {
+			size = s
+			break
+		}
+	}
+	return app.bookThumbPage(book.ID, strconv.Itoa(size), res, req)
+}
+
+// koboInitialization sends store resources: URLs used by the device
+func (app *Bouquins) koboInitialization(base string, res http.ResponseWriter) error {
+	res.Header().Set(koboAPIToken, "e30=")
+	return writeJSON(res, koboJSON{"Resources": koboJSON{
+		"image_host":                 app.Conf.ExternalURL,
+		"image_url_template":         base + "/{ImageId}/{Width}/{Height}/false/" + urlKoboImage,
+		"image_url_quality_template": base + "/{ImageId}/{Width}/{Height}/{Quality}/{IsGreyscale}/" + urlKoboImage,
+		"library_sync":               base + "/v1/library/sync",
+		"library_items":              base + "/v1/user/library",
+		"device_auth":                base + "/v1/auth/device",
+		"user_profile":               base + "/v1/user/profile",
+	}})
+}
+
+// koboDeviceAuth sends a dummy store access token: the device is authenticated by the URL token
+func koboDeviceAuth(res http.ResponseWriter, req *http.Request) error {
+	var auth struct {
+		UserKey string `json:"UserKey"`
+	}
+	json.NewDecoder(io.LimitReader(req.Body, kosyncMaxField)).Decode(&auth)
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.StdEncoding.EncodeToString(random)
+	return writeJSON(res, koboJSON{
+		"AccessToken":  token,
+		"RefreshToken": token,
+		"TokenType":    "Bearer",
+		"TrackingId":   hex.EncodeToString(random[:16]),
+		"UserKey":      auth.UserKey,
+	})
+}
+
+// koboSettings changes shelves synced to Kobo devices (settings page)
+func koboSettings(model *SettingsModel, account string, req *http.Request) error {
+	shelves, err := userShelves(account)
+	if err != nil {
+		return err
+	}
+	visible := make(map[int64]bool, len(shelves))
+	for _, s := range shelves {
+		visible[s.ID] = true
+	}
+	selected := make([]int64, 0)
+	for _, value := range req.PostForm[pShelf] {
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil && visible[id] {
+			selected = append(selected, id)
+		}
+	}
+	if err = SetKoboShelves(account, selected); err != nil {
+		return err
+	}
+	model.Message = "Synchronisation Kobo enregistrée"
+	return nil
+}
+
+// koboTokenSettings creates (replacing the previous one) or revokes the Kobo sync token (settings page)
+func (app *Bouquins) koboTokenSettings(model *SettingsModel, account string, req *http.Request) error {
+	if req.PostFormValue(pAction) == "kobo-revoke" {
+		if err := DeleteKoboToken(account); err != nil {
+			return err
+		}
+		model.Message = "Adresse de synchronisation Kobo révoquée"
+		return nil
+	}
+	token, err := CreateKoboToken(account)
+	if err != nil {
+		return err
+	}
+	model.NewKoboURL = app.Conf.ExternalURL + URLKobo + token
+	return nil
+}
+
+// KoboPage emulates Kobo store library sync for Kobo devices, authenticated by a Kobo sync token in URL
+func (app *Bouquins) KoboPage(res http.ResponseWriter, req *http.Request) error {
+	account := contextAccount(req)
+	if account == nil {
+		unauthorized(res)
+		return nil
+	}
+	token, path := koboPath(req)
+	base := app.Conf.ExternalURL + URLKobo + token
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "v1/initialization":
+		return app.koboInitialization(base, res)
+	case path == "v1/auth/device":
+		return koboDeviceAuth(res, req)
+	case path == "v1/library/sync":
+		return app.koboSyncPage(base, account.ID, res, req)
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "library" && parts[3] == "metadata":
+		return app.koboMetadataPage(base, parts[2], res, req)
+	case len(parts) == 4 && parts[0] == "v1" && parts[1] == "library" && parts[3] == "state":
+		return app.koboStatePage(account.ID, parts[2], res, req)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "library" && req.Method == http.MethodDelete:
+		// archived on device, kept in library
+		res.WriteHeader(http.StatusNoContent)
+		return nil
+	case len(parts) == 3 && parts[0] == urlKoboDownload:
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			http.NotFound(res, req)
+			return nil
+		}
+		return app.bookFilePage(id, parts[2], res, req)
+	case len(parts) >= 5 && parts[len(parts)-1] == urlKoboImage:
+		return app.koboCoverPage(parts[0], parts[1], res, req)
+	}
+	// other store services (profile, analytics, recommendations) are not emulated
+	return writeJSON(res, koboJSON{})
+}
@@ -0,0 +1,159 @@
+package bouquins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const koboTestUUID = "1f4b3e86-7c2a-4d55-9b1e-0a6f2c9d8e71"
+
+// koboServer returns Kobo API behind authentication and CSRF middlewares
+func koboServer(t *testing.T, app *Bouquins) http.Handler {
+	return app.WithAuth(app.CSRF(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := app.KoboPage(res, req); err != nil {
+			t.Error(err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+		}
+	})))
+}
+
+// serveKobo sends a recorded request, with its headers, and decodes JSON response
+func serveKobo(t *testing.T, server http.Handler, name, token string, header http.Header, result interface{}) *httptest.ResponseRecorder {
+	data, err := os.ReadFile(filepath.Join("testdata", "kobo", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("{token}"), []byte(token), 1)
+	recorded, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(recorded.Method, recorded.URL.String(), recorded.Body)
+	req.Header = recorded.Header
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if result != nil && res.Code == http.StatusOK {
+		if err = json.Unmarshal(res.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s: %v %s", name, err, res.Body.String())
+		}
+	}
+	return res
+}
+
+func TestKoboSync(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": []byte("epub")})
+	for _, query := range []string{
+		"UPDATE books SET uuid = '" + koboTestUUID + "' WHERE id = 1",
+		"INSERT INTO publishers (id, name) VALUES (1, 'Publisher')",
+		"INSERT INTO books_publishers_link (book, publisher) VALUES (1, 1)",
+		"INSERT INTO languages (id, lang_code) VALUES (1, 'fra')",
+		"INSERT INTO books_languages_link (book, lang_code) VALUES (1, 1)",
+	} {
+		if _, err := app.DB.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := CreateKoboToken(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := koboServer(t, app)
+	base := app.Conf.ExternalURL + URLKobo + token
+
+	var resources struct {
+		Resources map[string]string
+	}
+	res := serveKobo(t, server, "initialization.http", token, nil, &resources)
+	if res.Code != http.StatusOK || resources.Resources["library_sync"] != base+"/v1/library/sync" {
+		t.Fatalf("initialization: status %d, %s", res.Code, res.Body.String())
+	}
+
+	var entitlements []map[string]struct {
+		BookEntitlement struct{ Id string }
+		BookMetadata    struct {
+			Title        string
+			Language     string
+			Publisher    struct{ Name string }
+			DownloadUrls []struct{ Format, Url string }
+		}
+	}
+	res = serveKobo(t, server, "library_sync.http", token, nil, &entitlements)
+	if res.Code != http.StatusOK || len(entitlements) != 1 {
+		t.Fatalf("first sync: status %d, %s", res.Code, res.Body.String())
+	}
+	entitlement, ok := entitlements[0]["NewEntitlement"]
+	if !ok || entitlement.BookEntitlement.Id != koboTestUUID || entitlement.BookMetadata.Title != "Book" ||
+		entitlement.BookMetadata.Language != "fra" || entitlement.BookMetadata.Publisher.Name != "Publisher" {
+		t.Errorf("first sync: %s", res.Body.String())
+	}
+	if urls := entitlement.BookMetadata.DownloadUrls; len(urls) != 2 || urls[0].Format != "EPUB3" || urls[1].Url != base+"/download/1/epub" {
+		t.Errorf("download URLs %+v", urls)
+	}
+	position := res.Header().Get(koboSyncToken)
+	if position == "" {
+		t.Fatal("no sync position")
+	}
+	res = serveKobo(t, server, "library_sync.http", token, http.Header{koboSyncToken: {position}}, &entitlements)
+	if res.Code != http.StatusOK || len(entitlements) != 0 {
+		t.Errorf("second sync: status %d, %s", res.Code, res.Body.String())
+	}
+
+	var result struct{ RequestResult string }
+	res = serveKobo(t, server, "state_put.http", token, nil, &result)
+	if res.Code != http.StatusOK || result.RequestResult != "Success" {
+		t.Fatalf("state: status %d, %s", res.Code, res.Body.String())
+	}
+	reading, err := ReadingStatus(account.ID, 1)
+	if err != nil || reading == nil || reading.Status != StatusReading {
+		t.Errorf("read status %+v (%v)", reading, err)
+	}
+	progress, err := DocumentProgress(account.ID, koboDocument+koboTestUUID)
+	if err != nil || progress == nil || progress.Percentage != 0.18 || progress.Book != 1 {
+		t.Errorf("progress %+v (%v)", progress, err)
+	}
+}
+
+func TestKoboToken(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	apiToken, err := CreateToken(account.ID, "API")
+	if err != nil {
+		t.Fatal(err)
+	}
+	koboToken, err := CreateKoboToken(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := koboServer(t, app)
+
+	// API tokens are refused by Kobo API
+	if res := serveKobo(t, server, "initialization.http", apiToken, nil, nil); res.Code != http.StatusUnauthorized {
+		t.Errorf("API token in Kobo URL: status %d", res.Code)
+	}
+	// Kobo token is refused by other URLs
+	req := httptest.NewRequest(http.MethodGet, URLSettings, nil)
+	req.Header.Set("Authorization", authBearer+koboToken)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Kobo token as Bearer token: status %d", res.Code)
+	}
+	// replaced token is revoked
+	if _, err = CreateKoboToken(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	if res := serveKobo(t, server, "initialization.http", koboToken, nil, nil); res.Code != http.StatusUnauthorized {
+		t.Errorf("replaced Kobo token: status %d", res.Code)
+	}
+}
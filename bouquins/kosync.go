@@ -0,0 +1,176 @@
+package bouquins
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kosyncUser = "x-auth-user"
+	kosyncKey  = "x-auth-key"
+
+	kosyncMaxField    = 1024
+	kosyncSampleSize  = 1024
+	kosyncSampleCount = 10
+)
+
+// Progress is the reading position of a document (KOReader hash of a book file) synced by KOReader
+type Progress struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"`
+	Book       int64   `json:"-"` // calibre book, 0 if unknown
+}
+
+// Percent returns progress as an integer percentage
+func (p *Progress) Percent() int {
+	return int(p.Percentage*100 + 0.5)
+}
+
+// kosyncError is the error body of kosync API
+type kosyncError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// kosync API errors
+var (
+	kosyncUnauthorized = &kosyncError{2001, "Unauthorized"}
+	kosyncInvalid      = &kosyncError{2003, "Invalid request"}
+	kosyncNoDocument   = &kosyncError{2004, "Field 'document' not provided."}
+	kosyncNoSignup     = &kosyncError{2005, "User registration is disabled."}
+)
+
+// kosyncAccount returns user account authenticated by KOReader sync headers (authentifier and MD5 of local password)
+func kosyncAccount(req *http.Request) (*UserAccount, bool) {
+	user, key := req.Header.Get(kosyncUser), req.Header.Get(kosyncKey)
+	if user == "" || key == "" {
+		return nil, false
+	}
+	account, err := KosyncAccount(user, strings.ToLower(key))
+	return account, err == nil
+}
+
+// kosyncPassword stores KOReader sync key of a new local password: KOReader sends its MD5
+func kosyncPassword(account, password string) error {
+	sum := md5.Sum([]byte(password))
+	return SetKosyncKey(account, hex.EncodeToString(sum[:]))
+}
+
+// writeKosync writes a kosync API response
+func writeKosync(res http.ResponseWriter, status int, body interface{}) error {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	return json.NewEncoder(res).Encode(body)
+}
+
+// partialMD5 computes KOReader document hash: MD5 of 1KiB samples at growing offsets of the file
+func partialMD5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	buf := make([]byte, kosyncSampleSize)
+	for i := -1; i <= kosyncSampleCount; i++ {
+		var offset int64
+		if i >= 0 {
+			offset = kosyncSampleSize << uint(2*i)
+		}
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 {
+			break
+		}
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addDocuments stores KOReader hashes of a downloaded book file: file content and file name
+func addDocuments(id int64, format, file, name string) error {
+	hash, err := partialMD5(file)
+	if err != nil {
+		return err
+	}
+	if err = AddDocument(hash, id, format); err != nil {
+		return err
+	}
+	sum := md5.Sum([]byte(name))
+	return AddDocument(hex.EncodeToString(sum[:]), id, format)
+}
+
+// validKosyncField checks a string field of a progress update
+func validKosyncField(value string) bool {
+	return value != "" && len(value) <= kosyncMaxField
+}
+
+// updateProgress stores a progress update sent by KOReader
+func (app *Bouquins) updateProgress(res http.ResponseWriter, req *http.Request, account string) error {
+	p := new(Progress)
+	if err := json.NewDecoder(io.LimitReader(req.Body, 16*kosyncMaxField)).Decode(p); err != nil {
+		return writeKosync(res, http.StatusForbidden, kosyncInvalid)
+	}
+	if p.Document == "" {
+		return writeKosync(res, http.StatusForbidden, kosyncNoDocument)
+	}
+	if !validKosyncField(p.Document) || !validKosyncField(p.Progress) || p.Percentage < 0 || p.Percentage > 1 ||
+		len(p.Device) > kosyncMaxField || len(p.DeviceID) > kosyncMaxField {
+		return writeKosync(res, http.StatusForbidden, kosyncInvalid)
+	}
+	var err error
+	// book files are hashed when downloaded, documents of other files stay unknown
+	if p.Book, err = DocumentBook(p.Document); err != nil {
+		return err
+	}
+	p.Timestamp = time.Now().Unix()
+	if err = SetProgress(account, p); err != nil {
+		return err
+	}
+	return writeKosync(res, http.StatusOK, map[string]interface{}{"document": p.Document, "timestamp": p.Timestamp})
+}
+
+// KosyncPage implements KOReader progress sync server API (kosync) bound to user accounts
+func (app *Bouquins) KosyncPage(res http.ResponseWriter, req *http.Request) error {
+	path := strings.TrimPrefix(req.URL.Path, URLKosync)
+	if path == "users/create" {
+		return writeKosync(res, http.StatusPaymentRequired, kosyncNoSignup)
+	}
+	user := contextAccount(req)
+	if user == nil {
+		return writeKosync(res, http.StatusUnauthorized, kosyncUnauthorized)
+	}
+	account := user.ID
+	switch {
+	case path == "users/auth" && req.Method == http.MethodGet:
+		return writeKosync(res, http.StatusOK, map[string]string{"authorized": "OK"})
+	case path == "syncs/progress" && req.Method == http.MethodPut:
+		return app.updateProgress(res, req, account)
+	case strings.HasPrefix(path, "syncs/progress/") && req.Method == http.MethodGet:
+		p, err := DocumentProgress(account, strings.TrimPrefix(path, "syncs/progress/"))
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return writeKosync(res, http.StatusOK, struct{}{})
+		}
+		return writeKosync(res, http.StatusOK, p)
+	}
+	http.NotFound(res, req)
+	return nil
+}
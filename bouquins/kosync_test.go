@@ -0,0 +1,118 @@
+package bouquins
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartialMD5(t *testing.T) {
+	content := make([]byte, 5000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	file := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// samples at offsets 0, 1024, 4096 (end of file)
+	sum := md5.Sum(append(append(append([]byte{}, content[:1024]...), content[1024:2048]...), content[4096:]...))
+	hash, err := partialMD5(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hash %s, expected %s", hash, hex.EncodeToString(sum[:]))
+	}
+}
+
+func TestKosync(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": bytes.Repeat([]byte("epub"), 1024)})
+	if err := kosyncPassword(account.ID, "local password"); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("local password"))
+	key := strings.ToUpper(hex.EncodeToString(sum[:]))
+	server := app.WithAuth(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := app.KosyncPage(res, req); err != nil {
+			t.Errorf("%s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}))
+	request := func(method, path, user, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, URLKosync+path, strings.NewReader(body))
+		if user != "" {
+			req.Header.Set(kosyncUser, user)
+			req.Header.Set(kosyncKey, key)
+		}
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := request(http.MethodPost, "users/create", "", "", `{"username":"new","password":"x"}`); res.Code != http.StatusPaymentRequired {
+		t.Errorf("registration: status %d", res.Code)
+	}
+	for name, c := range map[string]struct {
+		user, key string
+		status    int
+	}{
+		"no headers":   {"", "", http.StatusUnauthorized},
+		"wrong key":    {"reader@example.org", "0123", http.StatusUnauthorized},
+		"unknown user": {"nobody@example.org", key, http.StatusUnauthorized},
+		"authorized":   {"reader@example.org", key, http.StatusOK},
+	} {
+		if res := request(http.MethodGet, "users/auth", c.user, c.key, ""); res.Code != c.status {
+			t.Errorf("%s: status %d, expected %d", name, res.Code, c.status)
+		}
+	}
+
+	// downloaded file is identified by its KOReader hash
+	res := httptest.NewRecorder()
+	if err := app.BooksPage(res, sessionRequest(t, app, http.MethodGet, "/books/1/file/epub", account)); err != nil || res.Code != http.StatusOK {
+		t.Fatalf("download: status %d (%v)", res.Code, err)
+	}
+	document, err := partialMD5(filepath.Join(app.Conf.CalibrePath, "Author", "Book (1)", "Book - Author.epub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{document, "unknown"} {
+		body := `{"document":"` + doc + `","progress":"/body/DocFragment[3]","percentage":0.25,"device":"Kobo","device_id":"k1"}`
+		if res = request(http.MethodPut, "syncs/progress", "reader@example.org", key, body); res.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status %d %s", doc, res.Code, res.Body.String())
+		}
+	}
+	if res = request(http.MethodPut, "syncs/progress", "reader@example.org", key, `{"progress":"x"}`); res.Code != http.StatusForbidden {
+		t.Errorf("PUT without document: status %d", res.Code)
+	}
+
+	res = request(http.MethodGet, "syncs/progress/"+document, "reader@example.org", key, "")
+	p := new(Progress)
+	if err = json.NewDecoder(res.Body).Decode(p); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusOK || p.Document != document || p.Percentage != 0.25 || p.Device != "Kobo" {
+		t.Errorf("GET progress: status %d, %+v", res.Code, p)
+	}
+	if res = request(http.MethodGet, "syncs/progress/other", "reader@example.org", key, ""); strings.TrimSpace(res.Body.String()) != "{}" {
+		t.Errorf("GET unknown progress: %s", res.Body.String())
+	}
+
+	if p, err = BookProgress(account.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Document != document || p.Percent() != 25 {
+		t.Errorf("book progress %+v, expected document of downloaded file", p)
+	}
+	if p, err = DocumentProgress(account.ID, "unknown"); err != nil || p == nil || p.Book != 0 {
+		t.Errorf("unknown document progress %+v (%v)", p, err)
+	}
+}
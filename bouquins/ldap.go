@@ -0,0 +1,161 @@
+package bouquins
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	providerLDAP = "ldap"
+
+	defaultLDAPEmail  = "mail"
+	defaultLDAPGroups = "memberOf"
+	ldapTimeout       = 10 * time.Second
+)
+
+// LDAPConf configures authentication by LDAP bind with user credentials
+type LDAPConf struct {
+	URL            string            `json:"url"`
+	StartTLS       bool              `json:"start-tls"`
+	BindDN         string            `json:"bind-dn"`
+	EmailAttribute string            `json:"email-attribute"`
+	GroupAttribute string            `json:"group-attribute"`
+	Groups         map[string]string `json:"groups"`
+	Label          string            `json:"label"`
+}
+
+// LDAPUser is an user authenticated by LDAP
+type LDAPUser struct {
+	Email  string
+	Groups []string
+}
+
+// ldapServerName returns host name of directory URL (without port and IPv6 brackets) for TLS certificate check
+func ldapServerName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in LDAP URL: %s", rawURL)
+	}
+	return u.Hostname(), nil
+}
+
+// ldapAuthenticate binds with user credentials and reads user email (or uid) and groups
+func (c *LDAPConf) ldapAuthenticate(login, password string) (*LDAPUser, error) {
+	if login == "" || password == "" {
+		// unauthenticated bind would succeed
+		return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("empty credentials"))
+	}
+	conn, err := ldap.DialURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if c.StartTLS {
+		host, err := ldapServerName(c.URL)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return nil, err
+		}
+	}
+	dn := fmt.Sprintf(c.BindDN, ldap.EscapeDN(login))
+	if err = conn.Bind(dn, password); err != nil {
+		return nil, err
+	}
+	emailAttr, groupAttr := c.EmailAttribute, c.GroupAttribute
+	if emailAttr == "" {
+		emailAttr = defaultLDAPEmail
+	}
+	if groupAttr == "" {
+		groupAttr = defaultLDAPGroups
+	}
+	search := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		"(objectClass=*)", []string{emailAttr, groupAttr}, nil)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("LDAP entry not found: %s", dn)
+	}
+	user := &LDAPUser{
+		Email:  result.Entries[0].GetAttributeValue(emailAttr),
+		Groups: result.Entries[0].GetAttributeValues(groupAttr),
+	}
+	if user.Email == "" {
+		user.Email = login
+	}
+	return user, nil
+}
+
+// ldapRoles returns roles mapped from LDAP groups
+func (c *LDAPConf) ldapRoles(groups []string) map[string]bool {
+	roles := make(map[string]bool)
+	for group, role := range c.Groups {
+		member := false
+		for _, g := range groups {
+			if strings.EqualFold(g, group) {
+				member = true
+			}
+		}
+		// a role can be mapped from several groups
+		roles[role] = roles[role] || member
+	}
+	return roles
+}
+
+// syncRoles adds and removes roles mapped from LDAP groups, other roles are unchanged
+func syncRoles(account string, roles map[string]bool) error {
+	for role, member := range roles {
+		var err error
+		if member {
+			err = AddRole(account, role)
+		} else {
+			err = RemoveRole(account, role)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ldapLogin authenticates user with login form
+func (app *Bouquins) ldapLogin(res http.ResponseWriter, req *http.Request) error {
+	model := app.NewLoginModel(req)
+	user, err := app.Conf.LDAP.ldapAuthenticate(strings.TrimSpace(req.PostFormValue(pName)), req.PostFormValue(pPassword))
+	if err != nil {
+		log.Println("LDAP authentication failed", err)
+		model.Message = "Identifiant ou mot de passe incorrect"
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			model.Message = "Annuaire LDAP indisponible"
+		}
+		return app.render(res, tplProvider, model)
+	}
+	account, err := app.loginAccount(user.Email, req)
+	if err == sql.ErrNoRows {
+		log.Println("Unknown LDAP user", user.Email)
+		model.Message = "Compte inconnu"
+		return app.render(res, tplProvider, model)
+	}
+	if err != nil {
+		return err
+	}
+	if err = syncRoles(account.ID, app.Conf.LDAP.ldapRoles(user.Groups)); err != nil {
+		return err
+	}
+	return app.startSession(account, res, req)
+}
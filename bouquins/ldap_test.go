@@ -0,0 +1,194 @@
+package bouquins
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testDirectory is a minimal in-process LDAP server: simple bind and base object search
+type testDirectory struct {
+	listener  net.Listener
+	passwords map[string]string
+	entries   map[string]map[string][]string
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{listener, make(map[string]string), make(map[string]map[string][]string)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *testDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+// LDAP message with an operation
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+// LDAPResult operation
+func ldapResult(application int, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(application), nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic message"))
+	return op
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if expected, ok := d.passwords[dn]; ok && password != "" && password == expected {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			dn := op.Children[0].Data.String()
+			if attributes, ok := d.entries[dn]; ok {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+				list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+				for name, values := range attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+					}
+					attribute.AppendChild(set)
+					list.AppendChild(attribute)
+				}
+				entry.AppendChild(list)
+				conn.Write(ldapMessage(id, entry))
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default:
+			// unbind
+			return
+		}
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	d := newTestDirectory(t)
+	d.passwords["uid=reader,ou=people,dc=example,dc=org"] = "secret"
+	d.entries["uid=reader,ou=people,dc=example,dc=org"] = map[string][]string{
+		"mail":     {"reader@example.org"},
+		"memberOf": {"cn=librarians,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"},
+	}
+	d.passwords["uid=nomail,ou=people,dc=example,dc=org"] = "secret"
+	d.entries["uid=nomail,ou=people,dc=example,dc=org"] = map[string][]string{}
+	conf := &LDAPConf{URL: d.URL(), BindDN: "uid=%s,ou=people,dc=example,dc=org"}
+
+	user, err := conf.ldapAuthenticate("reader", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "reader@example.org" || len(user.Groups) != 2 {
+		t.Errorf("user %+v", user)
+	}
+	for _, credentials := range [][2]string{{"reader", "wrong"}, {"unknown", "secret"}, {"reader", ""}} {
+		_, err = conf.ldapAuthenticate(credentials[0], credentials[1])
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			t.Errorf("bind %v: error %v, expected invalid credentials", credentials, err)
+		}
+	}
+	// no mail attribute: login is the authentifier
+	user, err = conf.ldapAuthenticate("nomail", "secret")
+	if err != nil || user.Email != "nomail" {
+		t.Errorf("without mail attribute: user %+v, error %v", user, err)
+	}
+}
+
+func TestLDAPLoginRoles(t *testing.T) {
+	d := newTestDirectory(t)
+	d.passwords["uid=reader,ou=people,dc=example,dc=org"] = "secret"
+	d.entries["uid=reader,ou=people,dc=example,dc=org"] = map[string][]string{
+		"mail":     {"reader@example.org"},
+		"memberOf": {"CN=Librarians,ou=groups,dc=example,dc=org"},
+	}
+	app := newTestApp(t)
+	app.Conf.LDAP = &LDAPConf{
+		URL:    d.URL(),
+		BindDN: "uid=%s,ou=people,dc=example,dc=org",
+		Groups: map[string]string{
+			"cn=librarians,ou=groups,dc=example,dc=org": "librarian",
+			"cn=admins,ou=groups,dc=example,dc=org":     "admin",
+		},
+	}
+	account := testAccount(t, app, "a1", "reader@example.org")
+	// admin role removed (not in admins group), other roles unchanged
+	for _, role := range []string{"admin", "kobo"} {
+		if err := AddRole(account.ID, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	form := url.Values{pName: {"reader"}, pPassword: {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, URLLogin, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	if err := app.ldapLogin(res, req); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusTemporaryRedirect && res.Code != http.StatusSeeOther && res.Code != http.StatusFound {
+		t.Errorf("login status %d, expected redirect", res.Code)
+	}
+	roles, err := Roles(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(roles, ",") != "kobo,librarian" {
+		t.Errorf("roles %v, expected kobo,librarian", roles)
+	}
+}
+
+func TestLDAPServerName(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"ldap://ldap.example.org":      "ldap.example.org",
+		"ldap://ldap.example.org:389":  "ldap.example.org",
+		"ldaps://ldap.example.org:636": "ldap.example.org",
+		"ldap://[2001:db8::1]:389":     "2001:db8::1",
+	} {
+		if host, err := ldapServerName(rawURL); err != nil || host != expected {
+			t.Errorf("%s: host %q (%v), expected %q", rawURL, host, err, expected)
+		}
+	}
+	if _, err := ldapServerName("ldap:///"); err == nil {
+		t.Error("URL without host accepted")
+	}
+}
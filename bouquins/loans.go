@@ -0,0 +1,204 @@
+package bouquins
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pLoan     = "loan"
+	pBorrower = "borrower"
+	pDue      = "due"
+
+	loansOut     = "out"
+	loansOverdue = "overdue"
+
+	maxBorrowerLength = 255
+	loanDayFormat     = "02/01/2006"
+)
+
+// errBookLent is returned when lending a book already on loan
+var errBookLent = errors.New("Livre déjà prêté")
+
+// Loan is a physical book lent to an user account or to someone without account
+type Loan struct {
+	ID              int64  `json:"id"`
+	Book            int64  `json:"book"`
+	Title           string `json:"title,omitempty"`
+	Lender          string `json:"-"`
+	BorrowerAccount string `json:"borrower_account,omitempty"`
+	Borrower        string `json:"borrower"` // account name or free text
+	Lent            int64  `json:"lent"`
+	Due             int64  `json:"due,omitempty"` // day, 0 if none
+	Returned        int64  `json:"returned,omitempty"`
+}
+
+// overdueBefore returns the limit of due days of overdue loans: due day is over
+func overdueBefore() int64 {
+	return time.Now().AddDate(0, 0, -1).Unix()
+}
+
+// Overdue checks if a book is not returned after its due day
+func (l *Loan) Overdue() bool {
+	return l.Returned == 0 && l.Due > 0 && l.Due < overdueBefore()
+}
+
+// LentDay returns the loan date as day
+func (l *Loan) LentDay() string {
+	return time.Unix(l.Lent, 0).Format(loanDayFormat)
+}
+
+// DueDay returns the due date as day, empty if none
+func (l *Loan) DueDay() string {
+	if l.Due == 0 {
+		return ""
+	}
+	return time.Unix(l.Due, 0).Format(loanDayFormat)
+}
+
+// loanFilter limits filter to books on loan (or overdue) requested in list parameters by an administrator
+func (app *Bouquins) loanFilter(filter *BookFilter, req *http.Request) (*BookFilter, error) {
+	loan := req.URL.Query().Get(pLoan)
+	if (loan != loansOut && loan != loansOverdue) || !app.IsAdmin(req) {
+		return filter, nil
+	}
+	books, err := LentBooks(loan == loansOverdue)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Only(books), nil
+}
+
+// currentLoans returns books on loan with their titles
+func (app *Bouquins) currentLoans(req *http.Request) ([]*Loan, error) {
+	loans, err := CurrentLoans()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(loans))
+	for i, l := range loans {
+		ids[i] = l.Book
+	}
+	books, err := app.BooksByID(filter, ids)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[int64]string, len(books))
+	for _, b := range books {
+		titles[b.ID] = b.Title
+	}
+	for _, l := range loans {
+		l.Title = titles[l.Book]
+	}
+	return loans, nil
+}
+
+// lendBook records a loan of a book to an account or a free text borrower,
+// returns the refusal message if the book is unknown or already on loan, or without borrower
+func (app *Bouquins) lendBook(lender string, req *http.Request) (int64, string, error) {
+	book, err := strconv.ParseInt(req.PostFormValue(pBook), 10, 64)
+	if err != nil {
+		return 0, "Livre inconnu", nil
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return book, "", err
+	}
+	books, err := app.BooksByID(filter, []int64{book})
+	if err != nil {
+		return book, "", err
+	}
+	if len(books) == 0 {
+		return 0, "Livre inconnu", nil
+	}
+	current, err := BookLoan(book)
+	if err != nil {
+		return book, "", err
+	}
+	if current != nil {
+		return book, "Livre déjà prêté à " + current.Borrower, nil
+	}
+	l := &Loan{
+		Book:            book,
+		Lender:          lender,
+		BorrowerAccount: req.PostFormValue(pAccount),
+		Borrower:        truncateRunes(strings.TrimSpace(req.PostFormValue(pBorrower)), maxBorrowerLength),
+		Due:             parseDay(req.PostFormValue(pDue)),
+	}
+	if l.BorrowerAccount != "" {
+		account, err := AccountByID(l.BorrowerAccount)
+		if err == sql.ErrNoRows {
+			return book, errUnknownReader.Error(), nil
+		}
+		if err != nil {
+			return book, "", err
+		}
+		l.Borrower = account.DisplayName
+	}
+	if l.Borrower == "" {
+		return book, "Emprunteur obligatoire : compte ou nom", nil
+	}
+	// concurrent loan of the same book
+	if err = AddLoan(l); err == errBookLent {
+		return book, err.Error(), nil
+	}
+	return book, "", err
+}
+
+// LoansPage lends and returns physical books (administrators, POST), lists books on loan as JSON
+func (app *Bouquins) LoansPage(res http.ResponseWriter, req *http.Request) error {
+	if !app.IsAdmin(req) {
+		http.Error(res, "403 Forbidden", http.StatusForbidden)
+		return nil
+	}
+	if req.Method != http.MethodPost {
+		if isJSON(req) {
+			loans, err := app.currentLoans(req)
+			if err != nil {
+				return err
+			}
+			return writeJSON(res, loans)
+		}
+		http.Redirect(res, req, URLAdmin+"#loans", http.StatusSeeOther)
+		return nil
+	}
+	var book int64
+	var message string
+	var err error
+	switch req.PostFormValue(pAction) {
+	case "return":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		if err = ReturnLoan(id); err != nil {
+			return err
+		}
+		book, _ = strconv.ParseInt(req.PostFormValue(pBook), 10, 64)
+	default:
+		if book, message, err = app.lendBook(app.AccountID(req), req); err != nil {
+			return err
+		}
+	}
+	if message != "" {
+		if isJSON(req) {
+			http.Error(res, message, http.StatusConflict)
+			return nil
+		}
+		return app.adminPage(res, req, &AdminModel{Model: *app.NewModel("Administration", "admin", req), Message: message})
+	}
+	if req.PostFormValue(pNext) == "book" && book > 0 {
+		http.Redirect(res, req, URLBooks+strconv.FormatInt(book, 10), http.StatusSeeOther)
+		return nil
+	}
+	http.Redirect(res, req, URLAdmin+"#loans", http.StatusSeeOther)
+	return nil
+}
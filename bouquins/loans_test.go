@@ -0,0 +1,78 @@
+package bouquins
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// lendRequest returns a lend form of an administrator, JSON response requested
+func lendRequest(admin *UserAccount, form url.Values) *http.Request {
+	form.Set(pAction, "lend")
+	req := httptest.NewRequest(http.MethodPost, URLLoans, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req.WithContext(context.WithValue(req.Context(), ctxAccount, admin))
+}
+
+func TestLendBook(t *testing.T) {
+	app := newTestApp(t)
+	admin := testAccount(t, app, "a1", "admin@example.org")
+	testAccount(t, app, "a2", "reader@example.org")
+	if _, err := app.UserDB.Exec("INSERT INTO roles (account, role) VALUES ('a1', ?)", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	testBook(t, app, 1, "Book", "Author", nil)
+
+	for name, c := range map[string]struct {
+		form    url.Values
+		message string
+	}{
+		"unknown book":    {url.Values{pBook: {"2"}, pBorrower: {"Paul"}}, "Livre inconnu"},
+		"invalid book":    {url.Values{pBook: {"x"}, pBorrower: {"Paul"}}, "Livre inconnu"},
+		"no borrower":     {url.Values{pBook: {"1"}, pBorrower: {" "}}, "Emprunteur obligatoire"},
+		"unknown account": {url.Values{pBook: {"1"}, pAccount: {"a3"}}, errUnknownReader.Error()},
+	} {
+		res := httptest.NewRecorder()
+		if err := app.LoansPage(res, lendRequest(admin, c.form)); err != nil {
+			t.Fatal(name, err)
+		}
+		if res.Code != http.StatusConflict || !strings.HasPrefix(res.Body.String(), c.message) {
+			t.Errorf("%s: status %d %q", name, res.Code, res.Body.String())
+		}
+	}
+
+	res := httptest.NewRecorder()
+	if err := app.LoansPage(res, lendRequest(admin, url.Values{pBook: {"1"}, pAccount: {"a2"}})); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusSeeOther {
+		t.Fatalf("loan: status %d %q", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	if err := app.LoansPage(res, lendRequest(admin, url.Values{pBook: {"1"}, pBorrower: {"Paul"}})); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusConflict || !strings.HasPrefix(res.Body.String(), "Livre déjà prêté à reader@example.org") {
+		t.Errorf("book on loan: status %d %q", res.Code, res.Body.String())
+	}
+
+	// concurrent loan refused by the unique index
+	err := AddLoan(&Loan{Book: 1, Lender: "a1", Borrower: "Paul"})
+	if err != errBookLent {
+		t.Errorf("second current loan: %v", err)
+	}
+	loans, err := CurrentLoans()
+	if err != nil || len(loans) != 1 || loans[0].Borrower != "reader@example.org" {
+		t.Fatalf("loans %v (%v)", loans, err)
+	}
+	if err = ReturnLoan(loans[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = AddLoan(&Loan{Book: 1, Lender: "a1", Borrower: "Paul"}); err != nil {
+		t.Errorf("loan of returned book: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package bouquins
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	pdfChunk        = 64 << 10 // bytes read at once when searching a PDF file
+	pdfMaxDict      = 4096     // bytes before a stream searched for its dictionary
+	minPDFPageWidth = 400      // smaller images are not scanned pages (logos, thumbnails)
+)
+
+var (
+	pdfStream    = []byte("stream")
+	pdfEndstream = []byte("endstream")
+	pdfObj       = []byte("obj")
+
+	pdfImage  = regexp.MustCompile(`/Subtype\s*/Image\b`)
+	pdfDCT    = regexp.MustCompile(`/Filter\s*(/DCTDecode|\[\s*/DCTDecode\s*\])`)
+	pdfWidth  = regexp.MustCompile(`/Width\s+(\d+)`)
+	pdfLength = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+)
+
+// indexAt returns the offset of the first occurrence of sep in r from offset from, -1 if none;
+// the file is read by chunks
+func indexAt(r io.ReaderAt, size, from int64, sep []byte) (int64, error) {
+	buf := make([]byte, pdfChunk+len(sep)-1)
+	for off := from; off < size; off += pdfChunk {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+		if i := bytes.Index(buf[:n], sep); i >= 0 {
+			return off + int64(i), nil
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return -1, nil
+}
+
+// pdfDictionary returns the dictionary of a stream: bytes between the object start and the stream keyword
+func pdfDictionary(r io.ReaderAt, stream int64) ([]byte, error) {
+	start := stream - pdfMaxDict
+	if start < 0 {
+		start = 0
+	}
+	dict := make([]byte, stream-start)
+	if _, err := r.ReadAt(dict, start); err != nil {
+		return nil, err
+	}
+	if i := bytes.LastIndex(dict, pdfObj); i >= 0 {
+		dict = dict[i+len(pdfObj):]
+	}
+	return dict, nil
+}
+
+// pdfStreamEnd returns the end of the data of a stream: start plus direct /Length if valid, else endstream keyword
+func pdfStreamEnd(r io.ReaderAt, size, start int64, dict []byte) (int64, error) {
+	if m := pdfLength.FindSubmatch(dict); m != nil && len(m[2]) == 0 {
+		if length, err := strconv.ParseInt(string(m[1]), 10, 64); err == nil && start+length <= size {
+			return start + length, nil
+		}
+	}
+	end, err := indexAt(r, size, start, pdfEndstream)
+	if err != nil || end < 0 {
+		return end, err
+	}
+	// end of line before endstream is not part of data
+	eol := make([]byte, 2)
+	if end >= start+2 {
+		if _, err = r.ReadAt(eol, end-2); err != nil {
+			return -1, err
+		}
+	}
+	switch {
+	case eol[0] == '\r' && eol[1] == '\n':
+		end -= 2
+	case eol[1] == '\n' || eol[1] == '\r':
+		end--
+	}
+	return end, nil
+}
+
+// pdfPages lists JPEG images of a PDF file wide enough to be scanned pages, in file order: names are byte ranges
+// of images in the file (start-end.jpg), other images and PDF content are ignored
+func pdfPages(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	pages := make([]string, 0)
+	for off := int64(0); off < size; {
+		stream, err := indexAt(f, size, off, pdfStream)
+		if err != nil {
+			return nil, err
+		}
+		if stream < 0 {
+			break
+		}
+		off = stream + int64(len(pdfStream))
+		if stream >= 3 {
+			// end of a stream without valid length (endstream keyword)
+			keyword := make([]byte, 3)
+			if _, err = f.ReadAt(keyword, stream-3); err != nil {
+				return nil, err
+			}
+			if string(keyword) == "end" {
+				continue
+			}
+		}
+		// stream keyword is followed by an end of line
+		eol := make([]byte, 2)
+		n, _ := f.ReadAt(eol, off)
+		var start int64
+		switch {
+		case n == 2 && eol[0] == '\r' && eol[1] == '\n':
+			start = off + 2
+		case n > 0 && eol[0] == '\n':
+			start = off + 1
+		default:
+			continue
+		}
+		dict, err := pdfDictionary(f, stream)
+		if err != nil {
+			return nil, err
+		}
+		end, err := pdfStreamEnd(f, size, start, dict)
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			break
+		}
+		off = end
+		if !pdfImage.Match(dict) || !pdfDCT.Match(dict) {
+			continue
+		}
+		if m := pdfWidth.FindSubmatch(dict); m == nil {
+			continue
+		} else if width, err := strconv.Atoi(string(m[1])); err != nil || width < minPDFPageWidth {
+			continue
+		}
+		pages = append(pages, fmt.Sprintf("%d-%d.jpg", start, end))
+	}
+	return pages, nil
+}
+
+// readPDFPage reads a JPEG image of a PDF file from its byte range name
+func readPDFPage(file, name string) ([]byte, time.Time, error) {
+	var start, end int64
+	if n, err := fmt.Sscanf(name, "%d-%d.jpg", &start, &end); err != nil || n != 2 || start < 0 || end <= start {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if end > info.Size() {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	if end-start > maxComicPage {
+		end = start + maxComicPage
+	}
+	data := make([]byte, end-start)
+	if _, err = f.ReadAt(data, start); err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, info.ModTime(), nil
+}
@@ -0,0 +1,100 @@
+package bouquins
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	placeholderWidth    = 400
+	placeholderHeight   = 600
+	placeholderLineLen  = 16
+	placeholderMaxLines = 6
+)
+
+// placeholderColor is a background hue derived from book title and authors, always the same for a book
+func placeholderColor(book *BookFull) int {
+	h := fnv.New32a()
+	h.Write([]byte(book.Title))
+	for _, author := range book.Authors {
+		h.Write([]byte(author.Name))
+	}
+	return int(h.Sum32() % 360)
+}
+
+// wrapText splits text in lines of about lineLen characters
+func wrapText(text string, lineLen, maxLines int) []string {
+	lines := make([]string, 0, maxLines)
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len([]rune(line))+1+len([]rune(word)) > lineLen {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines-1], lines[maxLines-1]+"…")
+	}
+	return lines
+}
+
+// svgText writes lines of text centered at y
+func svgText(b *bytes.Buffer, lines []string, y, size int, weight string) int {
+	for _, line := range lines {
+		fmt.Fprintf(b, `<text x="%d" y="%d" font-size="%d" font-weight="%s">%s</text>`,
+			placeholderWidth/2, y, size, weight, template.HTMLEscapeString(line))
+		y += size * 5 / 4
+	}
+	return y
+}
+
+// placeholderCover generates a SVG cover with book title, authors and series
+func placeholderCover(book *BookFull, width int) []byte {
+	var b bytes.Buffer
+	hue := placeholderColor(book)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		width, width*placeholderHeight/placeholderWidth, placeholderWidth, placeholderHeight)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="hsl(%d,45%%,35%%)"/>`, hue)
+	fmt.Fprintf(&b, `<rect x="20" y="20" width="%d" height="%d" fill="none" stroke="hsl(%d,45%%,75%%)" stroke-width="4"/>`,
+		placeholderWidth-40, placeholderHeight-40, hue)
+	b.WriteString(`<g fill="#fff" font-family="Georgia, serif" text-anchor="middle">`)
+	y := svgText(&b, wrapText(book.Title, placeholderLineLen, placeholderMaxLines), 150, 36, "bold")
+	names := make([]string, 0, len(book.Authors))
+	for _, author := range book.Authors {
+		names = append(names, author.Name)
+	}
+	svgText(&b, wrapText(strings.Join(names, ", "), placeholderLineLen*3/2, 3), y+50, 24, "normal")
+	if book.Series != nil {
+		series := book.Series.Name + " " + strconv.FormatFloat(book.SeriesIndex, 'f', -1, 64)
+		svgText(&b, wrapText(series, placeholderLineLen*3/2, 2), placeholderHeight-80, 22, "normal")
+	}
+	b.WriteString(`</g></svg>`)
+	return b.Bytes()
+}
+
+// placeholderPage sends generated cover of a book without cover
+func (app *Bouquins) placeholderPage(filter *BookFilter, id, lastModified int64, width int, res http.ResponseWriter, req *http.Request) error {
+	book, err := app.BookFull(filter, id)
+	if err != nil {
+		return err
+	}
+	res.Header().Set("Content-Type", "image/svg+xml")
+	res.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	res.Header().Set("ETag", fmt.Sprintf(`"placeholder-%d-%d-%d"`, id, lastModified, width))
+	res.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(res, req, "cover.svg", time.Unix(lastModified, 0), bytes.NewReader(placeholderCover(book, width)))
+	return nil
+}
@@ -0,0 +1,90 @@
+package bouquins
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// default headers containing user identity set by authenticating proxy
+var defaultProxyHeaders = []string{"Remote-Email", "X-Forwarded-Email", "X-Forwarded-User", "Remote-User"}
+
+// ProxyAuthConf configures authentication by a trusted reverse proxy (oauth2-proxy, Authelia...)
+type ProxyAuthConf struct {
+	Headers        []string `json:"headers"`
+	TrustedProxies []string `json:"trusted-proxies"`
+}
+
+// PrepareProxyAuth parses trusted proxies networks
+func (app *Bouquins) PrepareProxyAuth() error {
+	if app.Conf.ProxyAuth == nil {
+		return nil
+	}
+	if len(app.Conf.ProxyAuth.Headers) == 0 {
+		app.Conf.ProxyAuth.Headers = defaultProxyHeaders
+	}
+	app.trustedProxies = make([]*net.IPNet, 0, len(app.Conf.ProxyAuth.TrustedProxies))
+	for _, cidr := range app.Conf.ProxyAuth.TrustedProxies {
+		if !strings.Contains(cidr, "/") {
+			// single address
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		app.trustedProxies = append(app.trustedProxies, network)
+	}
+	return nil
+}
+
+// trustedProxy checks if request comes from a trusted proxy
+func (app *Bouquins) trustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range app.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyIdentity returns user identity set by a trusted proxy, headers from other clients are ignored
+func (app *Bouquins) proxyIdentity(req *http.Request) string {
+	if app.Conf.ProxyAuth == nil {
+		return ""
+	}
+	for _, header := range app.Conf.ProxyAuth.Headers {
+		if identity := strings.TrimSpace(req.Header.Get(header)); identity != "" {
+			if !app.trustedProxy(req) {
+				log.Println("Ignored proxy header", header, "from", req.RemoteAddr)
+				return ""
+			}
+			return identity
+		}
+	}
+	return ""
+}
+
+// proxyAccount returns user account authenticated by trusted proxy, mapped with authentifiers
+func (app *Bouquins) proxyAccount(identity string) (*UserAccount, error) {
+	account, err := Account(identity)
+	if err == sql.ErrNoRows {
+		// registration with allowed domain
+		account, err = app.register("", identity)
+	}
+	return account, err
+}
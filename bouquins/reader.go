@@ -0,0 +1,463 @@
+package bouquins
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	urlReadBook     = "book"
+	urlReadResource = "res/"
+	urlReadPosition = "position"
+
+	readerDocument    = "web:" // prefix of progress documents of in-browser reader (book ID)
+	readerDevice      = "Navigateur"
+	epubContainer     = "META-INF/container.xml"
+	maxReaderResource = 32 << 20
+	maxPositionLength = 4 * kosyncMaxField
+)
+
+// resource types missing from mime package
+var epubTypes = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".ncx":   "application/x-dtbncx+xml",
+	".opf":   "application/oebps-package+xml",
+	".otf":   "font/otf",
+	".ttf":   "font/ttf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// tags of table of contents labels
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// EpubItem is a content document of an EPUB book, in reading order
+type EpubItem struct {
+	Href   string `json:"href"` // resource URL
+	Linear bool   `json:"linear"`
+}
+
+// EpubTOCEntry is an entry of the table of contents of an EPUB book
+type EpubTOCEntry struct {
+	Label    string          `json:"label"`
+	Href     string          `json:"href"` // resource URL with fragment
+	Children []*EpubTOCEntry `json:"children,omitempty"`
+}
+
+// ReaderPosition is the reading position of in-browser reader
+type ReaderPosition struct {
+	Href       string  `json:"href"`       // resource URL of current page or chapter
+	Fraction   float64 `json:"fraction"`   // position in current resource
+	Percentage float64 `json:"percentage"` // position in book
+	Updated    int64   `json:"updated,omitempty"`
+}
+
+// EpubBook is the reading manifest of an EPUB book: spine and table of contents
+type EpubBook struct {
+	ID       int64           `json:"id"`
+	Title    string          `json:"title"`
+	Spine    []*EpubItem     `json:"spine"`
+	TOC      []*EpubTOCEntry `json:"toc"`
+	Position *ReaderPosition `json:"position,omitempty"`
+}
+
+// ReaderModel is the model of in-browser reader page
+type ReaderModel struct {
+	Model
+	ID int64
+}
+
+type epubContainerXML struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackageXML struct {
+	Titles []string `xml:"metadata>title"`
+	Items  []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type ncxPointXML struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Points []ncxPointXML `xml:"navPoint"`
+}
+
+type ncxXML struct {
+	Points []ncxPointXML `xml:"navMap>navPoint"`
+}
+
+type navListXML struct {
+	Items []struct {
+		A struct {
+			Href string `xml:"href,attr"`
+			Text string `xml:",innerxml"`
+		} `xml:"a"`
+		Span struct {
+			Text string `xml:",innerxml"`
+		} `xml:"span"`
+		List *navListXML `xml:"ol"`
+	} `xml:"li"`
+}
+
+// readerURL returns the URL of the reader page of a book
+func readerURL(id int64) string {
+	return URLRead + strconv.FormatInt(id, 10)
+}
+
+// resourceURL returns the URL of a file of a book archive
+func resourceURL(id int64, name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return readerURL(id) + "/" + urlReadResource + strings.Join(segments, "/")
+}
+
+// zipEntry returns a file of an archive, nil if missing
+func zipEntry(r *zip.ReadCloser, name string) *zip.File {
+	for _, f := range r.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// readZipEntry reads a file of an archive, up to max bytes
+func readZipEntry(f *zip.File, max int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, max))
+}
+
+// decodeZipEntry decodes an XML file of an archive
+func decodeZipEntry(r *zip.ReadCloser, name string, v interface{}) error {
+	f := zipEntry(r, name)
+	if f == nil {
+		return zip.ErrFormat
+	}
+	data, err := readZipEntry(f, maxReaderResource)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// resolveHref returns the archive path and fragment of a link relative to a file of the archive
+func resolveHref(base, href string) (string, string) {
+	fragment := ""
+	if i := strings.Index(href, "#"); i >= 0 {
+		href, fragment = href[:i], href[i:]
+	}
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	if href == "" {
+		return base, fragment
+	}
+	return path.Join(path.Dir(base), href), fragment
+}
+
+// tocLabel returns the text of a table of contents label
+func tocLabel(innerXML string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tagPattern.ReplaceAllString(innerXML, ""))), " ")
+}
+
+// ncxEntries converts NCX (EPUB 2) navigation points
+func ncxEntries(id int64, base string, points []ncxPointXML) []*EpubTOCEntry {
+	entries := make([]*EpubTOCEntry, 0, len(points))
+	for _, p := range points {
+		name, fragment := resolveHref(base, p.Content.Src)
+		entries = append(entries, &EpubTOCEntry{
+			Label:    tocLabel(p.Label),
+			Href:     resourceURL(id, name) + fragment,
+			Children: ncxEntries(id, base, p.Points),
+		})
+	}
+	return entries
+}
+
+// navEntries converts navigation document (EPUB 3) lists
+func navEntries(id int64, base string, list *navListXML) []*EpubTOCEntry {
+	if list == nil {
+		return nil
+	}
+	entries := make([]*EpubTOCEntry, 0, len(list.Items))
+	for _, item := range list.Items {
+		entry := &EpubTOCEntry{Label: tocLabel(item.A.Text), Children: navEntries(id, base, item.List)}
+		if item.A.Href != "" {
+			name, fragment := resolveHref(base, item.A.Href)
+			entry.Href = resourceURL(id, name) + fragment
+		} else {
+			entry.Label = tocLabel(item.Span.Text)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// navTOC reads the toc list of an EPUB 3 navigation document (XHTML)
+func navTOC(r *zip.ReadCloser, id int64, name string) ([]*EpubTOCEntry, error) {
+	f := zipEntry(r, name)
+	if f == nil {
+		return nil, zip.ErrFormat
+	}
+	data, err := readZipEntry(f, maxReaderResource)
+	if err != nil {
+		return nil, err
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "nav" {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "type" && strings.Contains(attr.Value, "toc") {
+				var nav struct {
+					List navListXML `xml:"ol"`
+				}
+				if err = d.DecodeElement(&nav, &start); err != nil {
+					return nil, err
+				}
+				return navEntries(id, name, &nav.List), nil
+			}
+		}
+	}
+}
+
+// readEpub reads spine and table of contents of an EPUB file
+func readEpub(id int64, file string) (*EpubBook, error) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var container epubContainerXML
+	if err = decodeZipEntry(r, epubContainer, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, zip.ErrFormat
+	}
+	opf := container.Rootfiles[0].FullPath
+	var pkg epubPackageXML
+	if err = decodeZipEntry(r, opf, &pkg); err != nil {
+		return nil, err
+	}
+	book := &EpubBook{ID: id, Spine: make([]*EpubItem, 0, len(pkg.Spine.Itemrefs))}
+	if len(pkg.Titles) > 0 {
+		book.Title = pkg.Titles[0]
+	}
+	hrefs := make(map[string]string, len(pkg.Items))
+	var nav string
+	for _, item := range pkg.Items {
+		name, _ := resolveHref(opf, item.Href)
+		hrefs[item.ID] = name
+		if strings.Contains(" "+item.Properties+" ", " nav ") {
+			nav = name
+		}
+	}
+	for _, ref := range pkg.Spine.Itemrefs {
+		if name, ok := hrefs[ref.IDRef]; ok {
+			book.Spine = append(book.Spine, &EpubItem{resourceURL(id, name), ref.Linear != "no"})
+		}
+	}
+	if nav != "" {
+		book.TOC, err = navTOC(r, id, nav)
+	}
+	if ncx, ok := hrefs[pkg.Spine.TOC]; ok && len(book.TOC) == 0 {
+		var toc ncxXML
+		if err = decodeZipEntry(r, ncx, &toc); err == nil {
+			book.TOC = ncxEntries(id, ncx, toc.Points)
+		}
+	}
+	if book.TOC == nil {
+		book.TOC = make([]*EpubTOCEntry, 0)
+	}
+	return book, nil
+}
+
+// readerPosition returns the position of in-browser reader of a book for an user account, nil if none
+func readerPosition(account string, id int64) (*ReaderPosition, error) {
+	p, err := DocumentProgress(account, readerDocument+strconv.FormatInt(id, 10))
+	if err != nil || p == nil {
+		return nil, err
+	}
+	pos := new(ReaderPosition)
+	if err = json.Unmarshal([]byte(p.Progress), pos); err != nil {
+		return nil, nil
+	}
+	pos.Percentage, pos.Updated = p.Percentage, p.Timestamp
+	return pos, nil
+}
+
+// saveReaderPosition stores the position of in-browser reader sent as JSON
+func saveReaderPosition(account string, id int64, req *http.Request) error {
+	pos := new(ReaderPosition)
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxPositionLength)).Decode(pos); err != nil {
+		return err
+	}
+	if pos.Fraction < 0 || pos.Fraction > 1 {
+		pos.Fraction = 0
+	}
+	if pos.Percentage < 0 || pos.Percentage > 1 {
+		pos.Percentage = 0
+	}
+	if len(pos.Href) > kosyncMaxField {
+		pos.Href = ""
+	}
+	data, err := json.Marshal(&ReaderPosition{Href: pos.Href, Fraction: pos.Fraction})
+	if err != nil {
+		return err
+	}
+	return SetProgress(account, &Progress{
+		Document:   readerDocument + strconv.FormatInt(id, 10),
+		Progress:   string(data),
+		Percentage: pos.Percentage,
+		Device:     readerDevice,
+		Timestamp:  time.Now().Unix(),
+		Book:       id,
+	})
+}
+
+// serveResource sends a file of a book archive, scripts are disabled in served documents
+func serveResource(file, name string, res http.ResponseWriter, req *http.Request) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f := zipEntry(r, path.Clean("/" + name)[1:])
+	if f == nil {
+		http.NotFound(res, req)
+		return nil
+	}
+	data, err := readZipEntry(f, maxReaderResource)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(path.Ext(f.Name))
+	contentType, ok := epubTypes[ext]
+	if !ok {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType != "" {
+		res.Header().Set("Content-Type", contentType)
+	}
+	res.Header().Set("Content-Security-Policy", "sandbox allow-same-origin; script-src 'none'")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(res, req, f.Name, f.Modified, bytes.NewReader(data))
+	return nil
+}
+
+// readerPath returns the book ID and action of a reader URL: {prefix}{id}/{action}
+func readerPath(req *http.Request, prefix string) (int64, string, bool) {
+	idParam, action := strings.TrimPrefix(req.URL.Path, prefix), ""
+	if i := strings.Index(idParam, "/"); i >= 0 {
+		idParam, action = idParam[:i], idParam[i+1:]
+	}
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	return id, action, err == nil
+}
+
+// ReadPage displays the in-browser reader of an EPUB book and serves its manifest, resources and position
+func (app *Bouquins) ReadPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		if isJSON(req) || req.Method != http.MethodGet {
+			unauthorized(res)
+			return nil
+		}
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	id, action, ok := readerPath(req, URLRead)
+	if !ok {
+		http.NotFound(res, req)
+		return nil
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	file, _, _, err := app.bookFile(filter, id, "EPUB")
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case action == "":
+		book, err := app.BookFull(filter, id)
+		if err != nil {
+			return err
+		}
+		return app.render(res, tplReader, &ReaderModel{*app.NewModel(book.Title, "reader", req), id})
+	case action == urlReadBook:
+		book, err := readEpub(id, file)
+		if err != nil {
+			return err
+		}
+		if book.Position, err = readerPosition(account, id); err != nil {
+			return err
+		}
+		return writeJSON(res, book)
+	case action == urlReadPosition && (req.Method == http.MethodPut || req.Method == http.MethodPost):
+		if err = saveReaderPosition(account, id, req); err != nil {
+			http.Error(res, "400 Bad Request", http.StatusBadRequest)
+			return nil
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return nil
+	case strings.HasPrefix(action, urlReadResource):
+		return serveResource(file, strings.TrimPrefix(action, urlReadResource), res, req)
+	}
+	http.NotFound(res, req)
+	return nil
+}
@@ -0,0 +1,287 @@
+package bouquins
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// StatusWant is the read status of books to read
+	StatusWant = "want"
+	// StatusReading is the read status of books being read
+	StatusReading = "reading"
+	// StatusFinished is the read status of read books
+	StatusFinished = "finished"
+	// StatusAbandoned is the read status of books not finished
+	StatusAbandoned = "abandoned"
+
+	pStatus   = "status"
+	pStarted  = "started"
+	pFinished = "finished"
+	pYear     = "year"
+
+	dayFormat = "2006-01-02"
+)
+
+// ReadStatus is a read status and its labels
+type ReadStatus struct {
+	ID    string
+	Label string
+	Class string // bootstrap label class
+}
+
+// ReadStatuses are available read statuses
+var ReadStatuses = []*ReadStatus{
+	{StatusWant, "A lire", "default"},
+	{StatusReading, "En cours", "info"},
+	{StatusFinished, "Lu", "success"},
+	{StatusAbandoned, "Abandonné", "warning"},
+}
+
+// Reading is the read status of a book for an user account
+type Reading struct {
+	Book     int64  `json:"book"`
+	Status   string `json:"status"`
+	Started  int64  `json:"started,omitempty"`
+	Finished int64  `json:"finished,omitempty"`
+	Updated  int64  `json:"updated,omitempty"`
+}
+
+// ReadingBook is a book with its read status
+type ReadingBook struct {
+	*BookAdv
+	Reading *Reading `json:"reading"`
+}
+
+// MonthCount is the number of books finished in a month
+type MonthCount struct {
+	Name    string `json:"-"`
+	Count   int    `json:"count"`
+	Percent int    `json:"-"` // of best month
+}
+
+// YearModel is the model of "my year in books" page
+type YearModel struct {
+	Model    `json:"-"`
+	Year     int            `json:"year"`
+	Prev     int            `json:"-"`
+	Next     int            `json:"-"`
+	Finished []*ReadingBook `json:"finished"`
+	Started  []*ReadingBook `json:"started"`
+	Months   []*MonthCount  `json:"months"`
+}
+
+// months names of year summary
+var monthNames = []string{"Janvier", "Février", "Mars", "Avril", "Mai", "Juin",
+	"Juillet", "Août", "Septembre", "Octobre", "Novembre", "Décembre"}
+
+// readStatus returns a read status from its ID, nil if unknown
+func readStatus(id string) *ReadStatus {
+	for _, s := range ReadStatuses {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Label returns the label of a read status
+func (r *Reading) Label() string {
+	if s := readStatus(r.Status); s != nil {
+		return s.Label
+	}
+	return r.Status
+}
+
+// Class returns the bootstrap label class of a read status
+func (r *Reading) Class() string {
+	if s := readStatus(r.Status); s != nil {
+		return s.Class
+	}
+	return "default"
+}
+
+// userReadings returns read statuses of logged in user by book ID, nil if not logged in
+func (app *Bouquins) userReadings(req *http.Request) (map[int64]*Reading, error) {
+	account := app.AccountID(req)
+	if account == "" {
+		return nil, nil
+	}
+	return ReadingStatuses(account)
+}
+
+// statusFilter limits filter to books with the read status requested in list parameters
+func (app *Bouquins) statusFilter(filter *BookFilter, req *http.Request) (*BookFilter, error) {
+	status := req.URL.Query().Get(pStatus)
+	account := app.AccountID(req)
+	if status == "" || account == "" {
+		return filter, nil
+	}
+	books, err := BooksWithStatus(account, status)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Only(books), nil
+}
+
+// parseDay reads a date form field (yyyy-mm-dd), 0 if empty or invalid
+func parseDay(value string) int64 {
+	day, err := time.ParseInLocation(dayFormat, value, time.Local)
+	if err != nil {
+		return 0
+	}
+	return day.Unix()
+}
+
+// formatDay formats a date for a date form field, empty if 0
+func formatDay(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(ts, 0).Format(dayFormat)
+}
+
+// setReading changes read status of a book of logged in user, dates default to today.
+// Returns sql.ErrNoRows for an unknown book or a book hidden by restrictions.
+func (app *Bouquins) setReading(req *http.Request) (int64, error) {
+	account := app.AccountID(req)
+	book, err := strconv.ParseInt(req.PostFormValue(pBook), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = app.BookFull(filter, book); err != nil {
+		return book, err
+	}
+	status := req.PostFormValue(pStatus)
+	if readStatus(status) == nil {
+		return book, DeleteReadingStatus(account, book)
+	}
+	r := &Reading{
+		Book:     book,
+		Status:   status,
+		Started:  parseDay(req.PostFormValue(pStarted)),
+		Finished: parseDay(req.PostFormValue(pFinished)),
+	}
+	now := time.Now().Unix()
+	switch status {
+	case StatusWant:
+		r.Started, r.Finished = 0, 0
+	case StatusReading:
+		if r.Started == 0 {
+			r.Started = now
+		}
+		r.Finished = 0
+	case StatusFinished, StatusAbandoned:
+		if r.Finished == 0 {
+			r.Finished = now
+		}
+	}
+	return book, SetReadingStatus(account, r)
+}
+
+// yearInBooks builds the summary of books started and finished in a year by an user account
+func (app *Bouquins) yearInBooks(model *YearModel, account string, filter *BookFilter) error {
+	from := time.Date(model.Year, time.January, 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(1, 0, 0)
+	readings, err := ReadingBetween(account, from.Unix(), to.Unix())
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, len(readings))
+	for i, r := range readings {
+		ids[i] = r.Book
+	}
+	books, err := app.BooksByID(filter, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]*BookAdv, len(books))
+	for _, b := range books {
+		byID[b.ID] = b
+	}
+	model.Finished = make([]*ReadingBook, 0)
+	model.Started = make([]*ReadingBook, 0)
+	model.Months = make([]*MonthCount, len(monthNames))
+	for i, name := range monthNames {
+		model.Months[i] = &MonthCount{Name: name}
+	}
+	best := 0
+	for _, r := range readings {
+		book, ok := byID[r.Book]
+		if !ok {
+			continue
+		}
+		rb := &ReadingBook{book, r}
+		finished := time.Unix(r.Finished, 0)
+		if r.Status == StatusFinished && !finished.Before(from) && finished.Before(to) {
+			model.Finished = append(model.Finished, rb)
+			month := model.Months[finished.Month()-1]
+			month.Count++
+			if month.Count > best {
+				best = month.Count
+			}
+		} else if r.Started >= from.Unix() && r.Started < to.Unix() {
+			model.Started = append(model.Started, rb)
+		}
+	}
+	for _, month := range model.Months {
+		if best > 0 {
+			month.Percent = month.Count * 100 / best
+		}
+	}
+	return nil
+}
+
+// ReadingPage changes read status of a book (POST), displays "my year in books" summary
+func (app *Bouquins) ReadingPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		if isJSON(req) {
+			unauthorized(res)
+			return nil
+		}
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	if req.Method == http.MethodPost {
+		book, err := app.setReading(req)
+		if err == sql.ErrNoRows {
+			http.NotFound(res, req)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isJSON(req) {
+			r, err := ReadingStatus(account, book)
+			if err != nil {
+				return err
+			}
+			return writeJSON(res, r)
+		}
+		http.Redirect(res, req, URLBooks+strconv.FormatInt(book, 10), http.StatusSeeOther)
+		return nil
+	}
+	model := &YearModel{Model: *app.NewModel("Mon année en livres", "reading", req), Year: time.Now().Year()}
+	if year, err := strconv.Atoi(req.URL.Query().Get(pYear)); err == nil && year > 0 {
+		model.Year = year
+	}
+	model.Prev, model.Next = model.Year-1, model.Year+1
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	if err = app.yearInBooks(model, account, filter); err != nil {
+		return err
+	}
+	if isJSON(req) {
+		return writeJSON(res, model)
+	}
+	return app.render(res, tplReading, model)
+}
@@ -0,0 +1,49 @@
+package bouquins
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// readingPost returns a POST of a read status form, authenticated as an user account
+func readingPost(book, status string, account *UserAccount) *http.Request {
+	form := url.Values{pBook: {book}, pStatus: {status}}
+	req := httptest.NewRequest(http.MethodPost, URLReading, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req.WithContext(context.WithValue(req.Context(), ctxAccount, account))
+}
+
+func TestSetReadingVisibleBooks(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	restrictedLibrary(t, app)
+	restrict(t, app, "a1", "tags", "adulte", true)
+
+	for _, c := range []struct {
+		book   string
+		status int
+	}{
+		{"1", http.StatusSeeOther},
+		{"2", http.StatusNotFound},
+		{"42", http.StatusNotFound},
+	} {
+		res := httptest.NewRecorder()
+		if err := app.ReadingPage(res, readingPost(c.book, StatusReading, account)); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != c.status {
+			t.Errorf("book %s: status %d, expected %d", c.book, res.Code, c.status)
+		}
+	}
+	statuses, err := ReadingStatuses("a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[1] == nil {
+		t.Errorf("read statuses %v, expected only book 1", statuses)
+	}
+}
@@ -0,0 +1,165 @@
+package bouquins
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionInvite = "invite"
+
+	inviteLength     = 16
+	defaultInviteTTL = 7
+	pDays            = "days"
+	pNote            = "note"
+)
+
+// Invitation allows an unknown user to create an account
+type Invitation struct {
+	ID        int64
+	Note      string
+	CreatedBy string
+	Created   int64
+	Expires   int64
+}
+
+// InviteModel is the model of invitation page
+type InviteModel struct {
+	LoginModel
+	Valid bool
+}
+
+// generates a random UUID (version 4), used as account ID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// display name of a new account
+func emailName(email string) string {
+	if i := strings.Index(email, "@"); i > 0 {
+		return email[:i]
+	}
+	return email
+}
+
+// checks if email domain is allowed for automatic registration
+func (app *Bouquins) domainAllowed(email string) bool {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[i+1:])
+	for _, d := range app.Conf.RegistrationDomains {
+		if strings.ToLower(d) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// register creates an account for an unknown email, with invitation code from session or allowed domain
+func (app *Bouquins) register(invite, email string) (*UserAccount, error) {
+	if invite != "" {
+		valid, err := InvitationValid(invite)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			// used or expired since the invitation page: allowed domains still register
+			log.Println("Invalid or expired invitation for", email)
+			invite = ""
+		}
+	}
+	if invite == "" && !app.domainAllowed(email) {
+		return nil, sql.ErrNoRows
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	account := &UserAccount{id, emailName(email)}
+	tx, err := app.UserDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if invite != "" {
+		res, err := tx.Stmt(userStmts[qtInvitationUse]).Exec(id, time.Now().Unix(), tokenHash(invite), time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); (err != nil || n != 1) && !app.domainAllowed(email) {
+			return nil, fmt.Errorf("invalid or expired invitation")
+		}
+	}
+	if _, err = tx.Stmt(userStmts[qtAccountAdd]).Exec(account.ID, account.DisplayName); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Stmt(userStmts[qtAuthentifierAdd]).Exec(account.ID, email); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	log.Println("New account", account.ID, email)
+	return account, nil
+}
+
+// InvitePage checks invitation code and displays login providers
+func (app *Bouquins) InvitePage(res http.ResponseWriter, req *http.Request) error {
+	code := strings.TrimPrefix(req.URL.Path, URLInvite)
+	valid, err := InvitationValid(code)
+	if err != nil {
+		return err
+	}
+	if valid {
+		session := app.Session(req)
+		session.Values[sessionInvite] = code
+		if err = session.Save(req, res); err != nil {
+			return err
+		}
+	}
+	model := &InviteModel{*app.NewLoginModel(req), valid}
+	model.Title = "Invitation"
+	return app.render(res, tplInvite, model)
+}
+
+// admin actions on invitations
+func (app *Bouquins) invitationAction(model *AdminModel, req *http.Request) error {
+	switch req.PostFormValue(pAction) {
+	case "invite":
+		days, err := strconv.Atoi(req.PostFormValue(pDays))
+		if err != nil || days <= 0 {
+			days = defaultInviteTTL
+		}
+		code, err := securedRandString(inviteLength)
+		if err != nil {
+			return err
+		}
+		expires := time.Now().AddDate(0, 0, days).Unix()
+		err = CreateInvitation(code, strings.TrimSpace(req.PostFormValue(pNote)), app.AccountID(req), expires)
+		if err != nil {
+			return err
+		}
+		model.InviteURL = app.Conf.ExternalURL + URLInvite + code
+	case "uninvite":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		return DeleteInvitation(id)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package bouquins
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterStaleInvitation(t *testing.T) {
+	app := newTestApp(t)
+	app.Conf.RegistrationDomains = []string{"example.org"}
+	if err := CreateInvitation("expired", "", "admin", time.Now().Add(-time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateInvitation("valid", "", "admin", time.Now().Add(time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.register("expired", "reader@example.org"); err != nil {
+		t.Errorf("expired invitation, allowed domain: %v", err)
+	}
+	if _, err := app.register("expired", "reader@other.org"); err == nil {
+		t.Error("expired invitation, other domain: account created")
+	}
+	if _, err := app.register("valid", "first@other.org"); err != nil {
+		t.Errorf("valid invitation: %v", err)
+	}
+	// single use
+	if _, err := app.register("valid", "second@other.org"); err == nil {
+		t.Error("used invitation, other domain: account created")
+	}
+	if _, err := app.register("valid", "second@example.org"); err != nil {
+		t.Errorf("used invitation, allowed domain: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package bouquins
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// restriction on calibre tags, other fields are custom columns labels (#label)
+	restrictionTags   = "tags"
+	customColumnStart = "#"
+
+	sqlRestrictTag = `SELECT books_tags_link.book FROM books_tags_link, tags
+    WHERE tags.id = books_tags_link.tag AND tags.name = %s`
+	sqlRestrictCustomNormalized = `SELECT books_custom_column_%[1]d_link.book
+    FROM books_custom_column_%[1]d_link, custom_column_%[1]d
+    WHERE custom_column_%[1]d.id = books_custom_column_%[1]d_link.value AND custom_column_%[1]d.value = %[2]s`
+	sqlRestrictCustom = "SELECT book FROM custom_column_%d WHERE value = %s"
+)
+
+// filterMarker matches SQL comments where book filter conditions are inserted:
+// and:<column>, where:<column> or nonempty:<column> (HAVING count)
+var filterMarker = regexp.MustCompile(`/\*(and|where|nonempty):([a-z_.]+)\*/`)
+
+// Restriction is a rule limiting books visible by an user account
+type Restriction struct {
+	Field   string // tags or custom column label (#label)
+	Value   string
+	Exclude bool // hide matching books instead of showing only matching books
+}
+
+// BookFilter limits visible books, nil filter shows all books
+type BookFilter struct {
+	allow []string // sub queries of allowed books
+	deny  []string // sub queries of hidden books
+	only  []int64  // list of books selected in users.db (e.g. read status), nil for no selection
+}
+
+// Restricted returns true if filter hides some books
+func (f *BookFilter) Restricted() bool {
+	return f != nil && (len(f.allow) > 0 || len(f.deny) > 0 || f.only != nil)
+}
+
+// Only returns a copy of filter also limited to a list of books (intersection with previous list)
+func (f *BookFilter) Only(books []int64) *BookFilter {
+	only := new(BookFilter)
+	if f != nil {
+		*only = *f
+	}
+	if only.only == nil {
+		only.only = books
+	} else {
+		selected := make(map[int64]bool, len(only.only))
+		for _, id := range only.only {
+			selected[id] = true
+		}
+		only.only = make([]int64, 0, len(books))
+		for _, id := range books {
+			if selected[id] {
+				only.only = append(only.only, id)
+			}
+		}
+	}
+	if only.only == nil {
+		only.only = make([]int64, 0)
+	}
+	return only
+}
+
+// condition on a book id column
+func (f *BookFilter) condition(column string) string {
+	conds := make([]string, 0, 3)
+	if len(f.allow) > 0 {
+		conds = append(conds, column+" IN ("+strings.Join(f.allow, " UNION ")+")")
+	}
+	if len(f.deny) > 0 {
+		conds = append(conds, column+" NOT IN ("+strings.Join(f.deny, " UNION ")+")")
+	}
+	if f.only != nil {
+		ids := make([]string, len(f.only))
+		for i, id := range f.only {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		conds = append(conds, column+" IN ("+strings.Join(ids, ",")+")")
+	}
+	return strings.Join(conds, sqlAnd)
+}
+
+// apply replaces filter markers in query
+func (f *BookFilter) apply(query string) string {
+	return filterMarker.ReplaceAllStringFunc(query, func(marker string) string {
+		m := filterMarker.FindStringSubmatch(marker)
+		switch m[1] {
+		case "and":
+			return sqlAnd + f.condition(m[2])
+		case "where":
+			return sqlWhere + f.condition(m[2])
+		default:
+			return " HAVING count(" + m[2] + ") > 0 "
+		}
+	})
+}
+
+// quote a string literal for SQLite
+func sqlQuote(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// sub query of books matching a restriction
+func (app *Bouquins) restrictionQuery(r *Restriction) (string, error) {
+	if r.Field == restrictionTags {
+		return fmt.Sprintf(sqlRestrictTag, sqlQuote(r.Value)), nil
+	}
+	if !strings.HasPrefix(r.Field, customColumnStart) {
+		return "", fmt.Errorf("invalid restriction field '%s'", r.Field)
+	}
+	stmt, err := app.ps(nil, qtCustomColumn)
+	if err != nil {
+		return "", err
+	}
+	var id int64
+	var normalized bool
+	err = stmt.QueryRow(strings.TrimPrefix(r.Field, customColumnStart)).Scan(&id, &normalized)
+	if err != nil {
+		return "", fmt.Errorf("unknown custom column '%s': %v", r.Field, err)
+	}
+	if normalized {
+		return fmt.Sprintf(sqlRestrictCustomNormalized, id, sqlQuote(r.Value)), nil
+	}
+	return fmt.Sprintf(sqlRestrictCustom, id, sqlQuote(r.Value)), nil
+}
+
+// NewBookFilter builds the filter for a list of restrictions
+func (app *Bouquins) NewBookFilter(restrictions []*Restriction) (*BookFilter, error) {
+	if len(restrictions) == 0 {
+		return nil, nil
+	}
+	filter := new(BookFilter)
+	for _, r := range restrictions {
+		query, err := app.restrictionQuery(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.Exclude {
+			filter.deny = append(filter.deny, query)
+		} else {
+			filter.allow = append(filter.allow, query)
+		}
+	}
+	return filter, nil
+}
+
+// UserFilter returns the filter of books visible by logged in user
+func (app *Bouquins) UserFilter(req *http.Request) (*BookFilter, error) {
+	account := app.AccountID(req)
+	if account == "" {
+		return nil, nil
+	}
+	restrictions, err := Restrictions(account)
+	if err != nil {
+		return nil, err
+	}
+	return app.NewBookFilter(restrictions)
+}
@@ -0,0 +1,218 @@
+package bouquins
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// restrictedLibrary adds books 1 (tag jeunesse), 2 (tag adulte) and 3 (tag jeunesse, #genre horreur),
+// with an EPUB file and a cover
+func restrictedLibrary(t *testing.T, app *Bouquins) {
+	books := []struct {
+		title, author, tag, genre string
+	}{
+		{"Public", "Alice", "jeunesse", ""},
+		{"Hidden", "Bob", "adulte", ""},
+		{"Scary", "Alice", "jeunesse", "horreur"},
+	}
+	exec := func(query string, args ...interface{}) {
+		if _, err := app.DB.Exec(query, args...); err != nil {
+			t.Fatal(err, query)
+		}
+	}
+	exec("CREATE TABLE custom_column_1 (id INTEGER PRIMARY KEY, value TEXT NOT NULL)")
+	exec("CREATE TABLE books_custom_column_1_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, value INTEGER NOT NULL)")
+	exec("INSERT INTO custom_columns (id, label, name, datatype, normalized) VALUES (1, 'genre', 'Genre', 'text', 1)")
+	exec("CREATE TABLE custom_column_2 (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, value TEXT NOT NULL)")
+	exec("INSERT INTO custom_columns (id, label, name, datatype, normalized) VALUES (2, 'note', 'Note', 'comments', 0)")
+	exec("INSERT INTO series (id, name, sort) VALUES (1, 'Secret', 'Secret')")
+	exec("INSERT INTO books_series_link (book, series) VALUES (2, 1)")
+	for i, b := range books {
+		id := int64(i + 1)
+		testBook(t, app, id, b.title, b.author, map[string][]byte{"EPUB": []byte(b.title)})
+		exec("INSERT OR IGNORE INTO tags (name) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM tags WHERE name = ?)", b.tag, b.tag)
+		exec("INSERT INTO books_tags_link (book, tag) SELECT ?, id FROM tags WHERE name = ?", id, b.tag)
+		if b.genre != "" {
+			exec("INSERT INTO custom_column_1 (value) VALUES (?)", b.genre)
+			exec("INSERT INTO books_custom_column_1_link (book, value) SELECT ?, id FROM custom_column_1 WHERE value = ?", id, b.genre)
+		}
+		exec("INSERT INTO custom_column_2 (book, value) VALUES (?, ?)", id, b.tag)
+		exec("UPDATE books SET has_cover = 1 WHERE id = ?", id)
+		cover := filepath.Join(app.Conf.CalibrePath, b.author, b.title+" ("+string(rune('0'+id))+")", "cover.jpg")
+		if err := os.WriteFile(cover, []byte("cover"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// restrict adds a restriction rule to an user account
+func restrict(t *testing.T, app *Bouquins, account, field, value string, exclude bool) {
+	if _, err := app.UserDB.Exec("INSERT INTO restrictions (account, field, value, exclude) VALUES (?, ?, ?, ?)",
+		account, field, value, exclude); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// visibleBooks returns IDs of books listed by a filter, or found by search terms
+func visibleBooks(t *testing.T, app *Bouquins, filter *BookFilter, terms ...string) []int64 {
+	books, _, _, err := app.BooksAdv(&ReqParams{Limit: 10, Filter: filter, Terms: terms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, len(books))
+	for i, b := range books {
+		ids[i] = b.ID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// jsonIDs sends a JSON request and returns the IDs of results
+func jsonIDs(t *testing.T, handler func(http.ResponseWriter, *http.Request) error, req *http.Request) []int64 {
+	req.Header.Set("Accept", "application/json")
+	res := httptest.NewRecorder()
+	if err := handler(res, req); err != nil {
+		t.Fatal(err)
+	}
+	var results struct {
+		Results []struct{ ID int64 }
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+		t.Fatal(err, res.Body.String())
+	}
+	ids := make([]int64, len(results.Results))
+	for i, r := range results.Results {
+		ids[i] = r.ID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRestrictedAccount(t *testing.T) {
+	app := newTestApp(t)
+	restrictedLibrary(t, app)
+	reader := testAccount(t, app, "a1", "reader@example.org")
+	restrict(t, app, reader.ID, restrictionTags, "adulte", true)
+	get := func(target string) *http.Request {
+		return sessionRequest(t, app, http.MethodGet, target, reader)
+	}
+
+	if ids := jsonIDs(t, app.BooksPage, get("/books/")); !equalIDs(ids, []int64{1, 3}) {
+		t.Errorf("books list %v", ids)
+	}
+	if ids := jsonIDs(t, app.AuthorsPage, get("/authors/")); len(ids) != 1 {
+		t.Errorf("authors list %v", ids)
+	}
+	if ids := jsonIDs(t, app.SeriesPage, get("/series/")); len(ids) != 0 {
+		t.Errorf("series list %v", ids)
+	}
+	// any of the terms: hidden book matching the first term stays hidden
+	if ids := jsonIDs(t, app.BooksPage, get("/books/?term=Hidden&term=Public")); !equalIDs(ids, []int64{1}) {
+		t.Errorf("books search %v", ids)
+	}
+	if ids := jsonIDs(t, app.AuthorsPage, get("/authors/?term=Bob&term=Alice")); len(ids) != 1 {
+		t.Errorf("authors search %v", ids)
+	}
+	if ids := jsonIDs(t, app.SeriesPage, get("/series/?term=Secret&term=Other")); len(ids) != 0 {
+		t.Errorf("series search %v", ids)
+	}
+
+	// hidden book page
+	req := get("/books/2")
+	req.Header.Set("Accept", "application/json")
+	if err := app.BooksPage(httptest.NewRecorder(), req); err == nil {
+		t.Error("hidden book page displayed")
+	}
+	req = get("/books/1")
+	req.Header.Set("Accept", "application/json")
+	if err := app.BooksPage(httptest.NewRecorder(), req); err != nil {
+		t.Error(err)
+	}
+
+	// files and covers
+	for target, status := range map[string]int{
+		"/books/2/file/epub": http.StatusNotFound,
+		"/books/2/cover":     http.StatusNotFound,
+		"/books/1/file/epub": http.StatusOK,
+		"/books/1/cover":     http.StatusOK,
+	} {
+		res := httptest.NewRecorder()
+		if err := app.BooksPage(res, get(target)); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != status {
+			t.Errorf("%s: status %d", target, res.Code)
+		}
+	}
+
+	filter, err := app.UserFilter(get("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := app.BookCount(filter); err != nil || count != 2 {
+		t.Errorf("count %d (%v)", count, err)
+	}
+}
+
+func TestRestrictionRules(t *testing.T) {
+	app := newTestApp(t)
+	restrictedLibrary(t, app)
+	jeunesse := &Restriction{"tags", "jeunesse", false}
+	for name, c := range map[string]struct {
+		rules []*Restriction
+		only  []int64 // nil: no selection
+		books []int64
+	}{
+		"none":           {nil, nil, []int64{1, 2, 3}},
+		"allow":          {[]*Restriction{jeunesse}, nil, []int64{1, 3}},
+		"allow both":     {[]*Restriction{jeunesse, {"tags", "adulte", false}}, nil, []int64{1, 2, 3}},
+		"deny":           {[]*Restriction{{"tags", "adulte", true}}, nil, []int64{1, 3}},
+		"allow and deny": {[]*Restriction{jeunesse, {"#genre", "horreur", true}}, nil, []int64{1}},
+		"custom column":  {[]*Restriction{{"#note", "adulte", false}}, nil, []int64{2}},
+		"only":           {nil, []int64{2, 3}, []int64{2, 3}},
+		"only none":      {nil, []int64{}, []int64{}},
+		"allow and only": {[]*Restriction{jeunesse}, []int64{2, 3}, []int64{3}},
+		"deny and only":  {[]*Restriction{{"tags", "adulte", true}}, []int64{1, 2}, []int64{1}},
+		"all combined":   {[]*Restriction{jeunesse, {"#genre", "horreur", true}}, []int64{1, 2, 3}, []int64{1}},
+	} {
+		filter, err := app.NewBookFilter(c.rules)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if c.only != nil {
+			filter = filter.Only(c.only)
+		}
+		if ids := visibleBooks(t, app, filter); !equalIDs(ids, c.books) {
+			t.Errorf("%s: books %v", name, ids)
+		}
+		// search terms are grouped: the filter applies to books matching any term
+		if ids := visibleBooks(t, app, filter, "Public", "Hidden", "Scary"); !equalIDs(ids, c.books) {
+			t.Errorf("%s: search %v", name, ids)
+		}
+		if count, err := app.BookCount(filter); err != nil || count != int64(len(c.books)) {
+			t.Errorf("%s: count %d (%v)", name, count, err)
+		}
+	}
+	for _, r := range []*Restriction{{"genre", "horreur", false}, {"#unknown", "x", false}} {
+		if _, err := app.NewBookFilter([]*Restriction{r}); err == nil {
+			t.Errorf("invalid restriction %+v accepted", r)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package bouquins
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxRating       = 5
+	maxReviewLength = 4000
+
+	pRating    = "rating"
+	pReview    = "review"
+	pMinRating = "minrating"
+
+	// sort on average rating of book lists
+	sortRating = "rating"
+)
+
+// Review is the rating (1 to 5, 0 if none) and short review of a book by an user account
+type Review struct {
+	Book    int64  `json:"-"`
+	Account string `json:"-"`
+	Author  string `json:"author,omitempty"` // display name of account
+	Rating  int    `json:"rating,omitempty"`
+	Text    string `json:"review,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+// Stars returns rating as stars (full and empty)
+func (r *Review) Stars() string {
+	return stars(r.Rating)
+}
+
+// stars returns a rating as full and empty stars
+func stars(rating int) string {
+	if rating < 0 || rating > maxRating {
+		return ""
+	}
+	return strings.Repeat("★", rating) + strings.Repeat("☆", maxRating-rating)
+}
+
+// ratingFilter limits filter to books rated at least the minimum requested in list parameters by logged in user
+func (app *Bouquins) ratingFilter(filter *BookFilter, req *http.Request) (*BookFilter, error) {
+	min, err := strconv.Atoi(req.URL.Query().Get(pMinRating))
+	account := app.AccountID(req)
+	if err != nil || min < 1 || account == "" {
+		return filter, nil
+	}
+	books, err := AccountRatedBooks(account, min)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Only(books), nil
+}
+
+// booksByRating loads a page of rated books visible with filter, sorted on average rating, and their count:
+// users.db returns sorted IDs only, calibre database checks visibility and loads the page
+func (app *Bouquins) booksByRating(params *ReqParams) ([]*BookAdv, int, bool, error) {
+	ids, err := RatedBooks(params.Order == "desc")
+	if err != nil {
+		return nil, 0, false, err
+	}
+	// visible and not deleted from calibre
+	visible, err := app.VisibleBooks(params.Filter, ids)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	rated := make([]int64, 0, len(visible))
+	for _, id := range ids {
+		if visible[id] {
+			rated = append(rated, id)
+		}
+	}
+	count := len(rated)
+	if params.Offset >= count {
+		return make([]*BookAdv, 0), count, false, nil
+	}
+	rated = rated[params.Offset:]
+	more := len(rated) > params.Limit
+	if more {
+		rated = rated[:params.Limit]
+	}
+	books, err := app.BooksByID(params.Filter, rated)
+	return books, count, more, err
+}
+
+// setReview changes rating and review of a book by logged in user, both empty removes it.
+// Returns sql.ErrNoRows for an unknown book or a book hidden by restrictions.
+func (app *Bouquins) setReview(req *http.Request) (int64, error) {
+	account := app.AccountID(req)
+	book, err := strconv.ParseInt(req.PostFormValue(pBook), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = app.BookFull(filter, book); err != nil {
+		return book, err
+	}
+	rating, _ := strconv.Atoi(req.PostFormValue(pRating))
+	if rating < 0 || rating > maxRating {
+		rating = 0
+	}
+	text := strings.TrimSpace(req.PostFormValue(pReview))
+	if r := []rune(text); len(r) > maxReviewLength {
+		text = string(r[:maxReviewLength])
+	}
+	if rating == 0 && text == "" {
+		return book, DeleteReview(account, book)
+	}
+	return book, SetReview(&Review{Book: book, Account: account, Rating: rating, Text: text})
+}
+
+// ReviewsPage changes rating and review of a book by logged in user (POST)
+func (app *Bouquins) ReviewsPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		unauthorized(res)
+		return nil
+	}
+	if req.Method != http.MethodPost {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	book, err := app.setReview(req)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isJSON(req) {
+		review, err := AccountReview(account, book)
+		if err != nil {
+			return err
+		}
+		return writeJSON(res, review)
+	}
+	http.Redirect(res, req, URLBooks+strconv.FormatInt(book, 10), http.StatusSeeOther)
+	return nil
+}
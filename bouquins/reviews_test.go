@@ -0,0 +1,105 @@
+package bouquins
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBooksByRating(t *testing.T) {
+	app := newTestApp(t)
+	testAccount(t, app, "a1", "reader@example.org")
+	for id := int64(1); id <= 4; id++ {
+		testBook(t, app, id, "Book", "Author", nil)
+	}
+	if _, err := app.DB.Exec("INSERT INTO tags (id, name) VALUES (1, 'adult')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.DB.Exec("INSERT INTO books_tags_link (book, tag) VALUES (3, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	// book 5 deleted from calibre
+	for book, rating := range map[int64]int{1: 2, 2: 5, 3: 4, 4: 1, 5: 3} {
+		if err := SetReview(&Review{Book: book, Account: "a1", Rating: rating}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restricted, err := app.NewBookFilter([]*Restriction{{Field: restrictionTags, Value: "adult", Exclude: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter *BookFilter
+		offset int
+		books  []int64
+		count  int
+		more   bool
+	}{
+		{nil, 0, []int64{2, 3}, 4, true},
+		{nil, 2, []int64{1, 4}, 4, false},
+		{restricted, 0, []int64{2, 1}, 3, true},
+		{restricted, 2, []int64{4}, 3, false},
+		{restricted, 4, []int64{}, 3, false},
+	}
+	for _, test := range tests {
+		books, count, more, err := app.booksByRating(&ReqParams{Limit: 2, Offset: test.offset, Order: "desc", Filter: test.filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, len(books))
+		for i, b := range books {
+			ids[i] = b.ID
+		}
+		if len(ids) != len(test.books) || count != test.count || more != test.more {
+			t.Errorf("offset %d (restricted %v): books %v, count %d, more %v, expected %v, %d, %v",
+				test.offset, test.filter != nil, ids, count, more, test.books, test.count, test.more)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.books[i] {
+				t.Errorf("offset %d (restricted %v): books %v, expected %v", test.offset, test.filter != nil, ids, test.books)
+				break
+			}
+		}
+	}
+}
+
+func TestSetReviewVisibleBooks(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	restrictedLibrary(t, app)
+	restrict(t, app, "a1", "tags", "adulte", true)
+
+	for _, c := range []struct {
+		book   string
+		status int
+	}{
+		{"1", http.StatusSeeOther},
+		{"2", http.StatusNotFound},
+		{"42", http.StatusNotFound},
+	} {
+		form := url.Values{pBook: {c.book}, pRating: {"4"}, pReview: {"Bien"}}
+		req := httptest.NewRequest(http.MethodPost, URLReviews, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		if err := app.ReviewsPage(res, req.WithContext(context.WithValue(req.Context(), ctxAccount, account))); err != nil {
+			t.Fatal(err)
+		}
+		if res.Code != c.status {
+			t.Errorf("book %s: status %d, expected %d", c.book, res.Code, c.status)
+		}
+	}
+	for book, reviewed := range map[int64]bool{1: true, 2: false, 42: false} {
+		review, err := AccountReview("a1", book)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (review != nil) != reviewed {
+			t.Errorf("book %d: review %v", book, review)
+		}
+	}
+}
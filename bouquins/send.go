@@ -0,0 +1,374 @@
+package bouquins
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DeliveryPending is the status of a book file waiting to be sent
+	DeliveryPending = "pending"
+	// DeliverySent is the status of a book file sent to a device
+	DeliverySent = "sent"
+	// DeliveryFailed is the status of a book file not sent after all attempts
+	DeliveryFailed = "failed"
+
+	pDevice = "device"
+
+	defaultSMTPPort    = 587
+	defaultMaxSendSize = 25 // MB
+	smtpTimeout        = 30 * time.Second
+	mailQueueInterval  = time.Minute
+	mailQueueBatch     = 10
+	maxSendAttempts    = 5
+	recentDeliveries   = 5
+	maxDeliveryError   = 255
+	base64LineLength   = 76
+)
+
+// SMTPConf configures the mail server sending book files to e-readers
+type SMTPConf struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	TLS      bool   `json:"tls"`      // implicit TLS (port 465), otherwise STARTTLS when available
+	MaxSize  int64  `json:"max-size"` // MB
+}
+
+// Device is an e-reader email address of an user account (Kindle, PocketBook...)
+type Device struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Created int64  `json:"created"`
+}
+
+// Delivery is a book file sent by email to a device
+type Delivery struct {
+	ID       int64  `json:"id"`
+	Account  string `json:"-"`
+	Book     int64  `json:"book"`
+	Format   string `json:"format"`
+	Name     string `json:"name"` // attachment file name
+	Email    string `json:"email"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+	NextTry  int64  `json:"-"`
+}
+
+// Label returns the label of a delivery status
+func (d *Delivery) Label() string {
+	switch d.Status {
+	case DeliverySent:
+		return "Envoyé"
+	case DeliveryFailed:
+		return "Échec"
+	}
+	if d.Attempts > 0 {
+		return "Nouvel essai"
+	}
+	return "En attente"
+}
+
+// Class returns the bootstrap label class of a delivery status
+func (d *Delivery) Class() string {
+	switch d.Status {
+	case DeliverySent:
+		return "success"
+	case DeliveryFailed:
+		return "danger"
+	}
+	return "default"
+}
+
+// sendEnabled checks if book files can be sent by email
+func (app *Bouquins) sendEnabled() bool {
+	return app.Conf.SMTP != nil && app.Conf.SMTP.Host != ""
+}
+
+// maxSize returns the maximum size of an attachment in bytes
+func (c *SMTPConf) maxSize() int64 {
+	if c.MaxSize > 0 {
+		return c.MaxSize << 20
+	}
+	return defaultMaxSendSize << 20
+}
+
+// mailMessage builds a message with a book file attachment
+func (c *SMTPConf) mailMessage(d *Delivery, file string) ([]byte, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	parts := multipart.NewWriter(&msg)
+	title := strings.TrimSuffix(d.Name, "."+strings.ToLower(d.Format))
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		c.From, d.Email, mime.QEncoding.Encode("utf-8", title), time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	text, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "%s\r\n\r\nEnvoyé depuis Bouquins.\r\n", title)
+	attachment, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(mimeType(d.Format), map[string]string{"name": d.Name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": d.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > base64LineLength {
+		attachment.Write([]byte(encoded[:base64LineLength] + "\r\n"))
+		encoded = encoded[base64LineLength:]
+	}
+	attachment.Write([]byte(encoded + "\r\n"))
+	if err = parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// send sends a message to a recipient: implicit TLS or STARTTLS if available, authentication if configured
+func (c *SMTPConf) send(to string, msg []byte) error {
+	port := c.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if c.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: c.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * smtpTimeout))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && !c.TLS {
+		if err = client.StartTLS(&tls.Config{ServerName: c.Host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(c.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// sendDelivery makes an attempt to send a book file, schedules a retry or fails after last attempt
+func (app *Bouquins) sendDelivery(d *Delivery) error {
+	file, _, _, err := app.bookFile(nil, d.Book, d.Format)
+	if err == nil {
+		var msg []byte
+		if msg, err = app.Conf.SMTP.mailMessage(d, file); err == nil {
+			err = app.Conf.SMTP.send(d.Email, msg)
+		}
+	}
+	d.Attempts++
+	if err == nil {
+		d.Status, d.Error = DeliverySent, ""
+		return UpdateDelivery(d)
+	}
+	log.Println("Error sending book", d.Book, d.Format, "to", d.Email, err)
+	d.Error = err.Error()
+	if len(d.Error) > maxDeliveryError {
+		d.Error = d.Error[:maxDeliveryError]
+	}
+	if d.Attempts >= maxSendAttempts {
+		d.Status = DeliveryFailed
+	} else {
+		// 1, 4, 9, 16 minutes
+		d.NextTry = time.Now().Add(time.Duration(d.Attempts*d.Attempts) * time.Minute).Unix()
+	}
+	return UpdateDelivery(d)
+}
+
+// sendPending sends deliveries ready to be sent
+func (app *Bouquins) sendPending() {
+	for {
+		deliveries, err := PendingDeliveries(time.Now().Unix(), mailQueueBatch)
+		if err != nil {
+			log.Println("Error reading mail queue", err)
+			return
+		}
+		for _, d := range deliveries {
+			if err = app.sendDelivery(d); err != nil {
+				log.Println("Error updating delivery", d.ID, err)
+				return
+			}
+		}
+		if len(deliveries) < mailQueueBatch {
+			return
+		}
+	}
+}
+
+// StartMailQueue starts the background sender of book files by email, if SMTP is configured
+func (app *Bouquins) StartMailQueue() {
+	if !app.sendEnabled() {
+		return
+	}
+	app.mailWake = make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(mailQueueInterval)
+		for {
+			app.sendPending()
+			select {
+			case <-ticker.C:
+			case <-app.mailWake:
+			}
+		}
+	}()
+}
+
+// wakeMailQueue sends new deliveries without waiting for next queue tick
+func (app *Bouquins) wakeMailQueue() {
+	select {
+	case app.mailWake <- struct{}{}:
+	default:
+	}
+}
+
+// queueDelivery checks a book file request and queues it, too big files fail immediately
+func (app *Bouquins) queueDelivery(req *http.Request, account string) (*Delivery, error) {
+	book, err := strconv.ParseInt(req.PostFormValue(pBook), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	device, err := strconv.ParseInt(req.PostFormValue(pDevice), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	d, err := DeviceByID(account, device)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	_, name, data, err := app.bookFile(filter, book, req.PostFormValue(pFormat))
+	if err != nil {
+		return nil, err
+	}
+	delivery := &Delivery{
+		Account: account,
+		Book:    book,
+		Format:  data.Format,
+		Name:    name,
+		Email:   d.Email,
+		Status:  DeliveryPending,
+	}
+	if data.Size > app.Conf.SMTP.maxSize() {
+		delivery.Status, delivery.Error = DeliveryFailed, "Fichier trop volumineux"
+	}
+	if err = AddDelivery(delivery); err != nil {
+		return nil, err
+	}
+	if delivery.Status == DeliveryPending {
+		app.wakeMailQueue()
+	}
+	return delivery, nil
+}
+
+// deviceAction adds or removes an e-reader email address (settings page)
+func deviceAction(model *SettingsModel, account string, req *http.Request) error {
+	if req.PostFormValue(pAction) == "device-delete" {
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		return DeleteDevice(account, id)
+	}
+	name := strings.TrimSpace(req.PostFormValue(pName))
+	address, err := mail.ParseAddress(strings.TrimSpace(req.PostFormValue(pEmail)))
+	if err != nil || name == "" {
+		model.Message = "Nom et adresse email de la liseuse obligatoires"
+		return nil
+	}
+	if err = AddDevice(account, name, address.Address); err != nil {
+		return err
+	}
+	model.Message = "Liseuse ajoutée"
+	return nil
+}
+
+// SendPage sends a book file to an e-reader of logged in user by email (POST)
+func (app *Bouquins) SendPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		unauthorized(res)
+		return nil
+	}
+	if req.Method != http.MethodPost {
+		http.Error(res, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !app.sendEnabled() {
+		http.NotFound(res, req)
+		return nil
+	}
+	delivery, err := app.queueDelivery(req, account)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isJSON(req) {
+		return writeJSON(res, delivery)
+	}
+	http.Redirect(res, req, URLBooks+strconv.FormatInt(delivery.Book, 10)+"#send", http.StatusSeeOther)
+	return nil
+}
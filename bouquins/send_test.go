@@ -0,0 +1,270 @@
+package bouquins
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubMail is a message received by smtpStub
+type stubMail struct {
+	from, to string
+	data     []byte
+}
+
+// smtpStub is an in-process SMTP server keeping received messages
+type smtpStub struct {
+	port     int
+	username string
+	password string
+	mu       sync.Mutex
+	reject   bool // recipients refused with a temporary error
+	mails    []stubMail
+}
+
+// newSMTPStub listens on a local port, closed at the end of the test
+func newSMTPStub(t *testing.T, username, password string) *smtpStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &smtpStub{port: l.Addr().(*net.TCPAddr).Port, username: username, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) setReject(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reject
+}
+
+func (s *smtpStub) received() []stubMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubMail(nil), s.mails...)
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	c.PrintfLine("220 stub ESMTP")
+	authenticated := s.username == ""
+	var mail stubMail
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if s.username != "" {
+				c.PrintfLine("250-stub")
+				c.PrintfLine("250 AUTH PLAIN")
+			} else {
+				c.PrintfLine("250 stub")
+			}
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if authenticated = string(credentials) == "\x00"+s.username+"\x00"+s.password; authenticated {
+				c.PrintfLine("235 authenticated")
+			} else {
+				c.PrintfLine("535 invalid credentials")
+			}
+		case "MAIL":
+			if !authenticated {
+				c.PrintfLine("530 authentication required")
+				continue
+			}
+			mail = stubMail{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.reject
+			s.mu.Unlock()
+			if reject {
+				c.PrintfLine("451 mailbox unavailable")
+				continue
+			}
+			mail.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 end with .")
+			if mail.data, err = c.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		case "RSET", "NOOP":
+			c.PrintfLine("250 ok")
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	app := newTestApp(t)
+	content := bytes.Repeat([]byte("epub content "), 20)
+	testBook(t, app, 1, "Élégie", "Auteur", map[string][]byte{"EPUB": content})
+	file, name, _, err := app.bookFile(nil, 1, "epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &SMTPConf{From: "bouquins@example.org"}
+	data, err := conf.mailMessage(&Delivery{Format: "EPUB", Name: name, Email: "reader@kindle.com"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Auteur - Élégie" {
+		t.Errorf("subject %q (%v)", subject, err)
+	}
+	if msg.Header.Get("From") != conf.From || msg.Header.Get("To") != "reader@kindle.com" {
+		t.Errorf("headers %v", msg.Header)
+	}
+	if _, err = msg.Header.Date(); err != nil {
+		t.Error(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q (%v)", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := parts.NextPart()
+	if err != nil || !strings.HasPrefix(text.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("text part %v (%v)", text, err)
+	}
+	attachment, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != "Auteur - Élégie.epub" || !strings.HasPrefix(attachment.Header.Get("Content-Type"), mimeType("EPUB")) {
+		t.Errorf("attachment headers %v", attachment.Header)
+	}
+	encoded, err := io.ReadAll(attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+		if len(line) > base64LineLength {
+			t.Errorf("base64 line of %d characters", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("attachment content %q (%v)", decoded, err)
+	}
+	if _, err = parts.NextPart(); err != io.EOF {
+		t.Errorf("unexpected part (%v)", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	stub := newSMTPStub(t, "bouquins", "secret")
+	conf := &SMTPConf{Host: "127.0.0.1", Port: stub.port, Username: "bouquins", Password: "secret", From: "bouquins@example.org"}
+	msg := []byte("Subject: test\r\n\r\nbody\r\n")
+	if err := conf.send("reader@kindle.com", msg); err != nil {
+		t.Fatal(err)
+	}
+	// DATA read by the stub with LF line endings
+	mails := stub.received()
+	if len(mails) != 1 || mails[0].from != conf.From || mails[0].to != "reader@kindle.com" ||
+		!bytes.Equal(mails[0].data, bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))) {
+		t.Fatalf("received %+v", mails)
+	}
+	conf.Password = "wrong"
+	if err := conf.send("reader@kindle.com", msg); err == nil {
+		t.Error("sent with wrong password")
+	}
+}
+
+func TestSendDelivery(t *testing.T) {
+	app := newTestApp(t)
+	stub := newSMTPStub(t, "", "")
+	app.Conf.SMTP = &SMTPConf{Host: "127.0.0.1", Port: stub.port, From: "bouquins@example.org"}
+	testAccount(t, app, "a1", "reader@example.org")
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": []byte("epub")})
+	d := &Delivery{Account: "a1", Book: 1, Format: "EPUB", Name: "Author - Book.epub", Email: "reader@kindle.com", Status: DeliveryPending}
+	if err := AddDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() *Delivery {
+		deliveries, err := AccountDeliveries("a1", 1)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("deliveries %v (%v)", deliveries, err)
+		}
+		return deliveries[0]
+	}
+
+	// temporary failures are retried with growing delays, then the delivery fails
+	stub.setReject(true)
+	for attempt := 1; attempt <= maxSendAttempts; attempt++ {
+		before := time.Now().Unix()
+		if err := app.sendDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		s := stored()
+		if s.Attempts != attempt || !strings.Contains(s.Error, "451") {
+			t.Fatalf("attempt %d: %+v", attempt, s)
+		}
+		if attempt < maxSendAttempts {
+			delay := int64(attempt * attempt * 60)
+			if s.Status != DeliveryPending || s.NextTry < before+delay || s.NextTry > time.Now().Unix()+delay {
+				t.Errorf("attempt %d: %+v", attempt, s)
+			}
+		} else if s.Status != DeliveryFailed {
+			t.Errorf("last attempt: %+v", s)
+		}
+	}
+	if pending, err := PendingDeliveries(time.Now().Add(time.Hour).Unix(), mailQueueBatch); err != nil || len(pending) != 0 {
+		t.Errorf("failed delivery pending %v (%v)", pending, err)
+	}
+
+	// retry after a failure clears the error
+	d = &Delivery{Account: "a1", Book: 1, Format: "EPUB", Name: "Author - Book.epub", Email: "reader@kindle.com", Status: DeliveryPending}
+	if err := AddDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.sendDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	stub.setReject(false)
+	if err := app.sendDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if s := stored(); s.Status != DeliverySent || s.Attempts != 2 || s.Error != "" {
+		t.Errorf("sent delivery %+v", s)
+	}
+	if mails := stub.received(); len(mails) != 1 || mails[0].to != "reader@kindle.com" {
+		t.Errorf("received %+v", mails)
+	}
+}
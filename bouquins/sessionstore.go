@@ -0,0 +1,197 @@
+package bouquins
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionIDLength = 32
+	// anonymous sessions (OAuth state) expire sooner
+	anonymousSessionMaxAge = 24 * 3600
+	// last seen date of a session is updated at most once per interval
+	lastSeenInterval = 5 * 60
+)
+
+// SessionStore is a sessions.Store keeping sessions in users.db:
+// cookie contains only the session ID, sessions can be listed and revoked
+type SessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// UserSession is an active session of an user account
+type UserSession struct {
+	ID        int64
+	Created   int64
+	LastSeen  int64
+	UserAgent string
+	Address   string
+	Current   bool
+}
+
+// SessionsModel is the model of active sessions page
+type SessionsModel struct {
+	Model
+	Sessions []*UserSession
+}
+
+// NewSessionStore creates the session store: signing and encryption keys are derived from cookie secret,
+// cookies are HttpOnly, SameSite and Secure if external URL uses https
+func NewSessionStore(conf *Conf) (*SessionStore, error) {
+	secret := []byte(conf.CookieSecret)
+	if len(secret) == 0 {
+		log.Println("no cookie-secret, using a random secret: sessions will not survive restart")
+		random, err := securedRandString(32)
+		if err != nil {
+			return nil, err
+		}
+		// other keys (CSRF cookie, share links) are derived from the same secret
+		conf.CookieSecret = random
+		secret = []byte(random)
+	}
+	store := &SessionStore{
+		Codecs: securecookie.CodecsFromPairs(deriveKey(secret, keySigning), deriveKey(secret, keyEncryption)),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   sessionMaxAge,
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(conf.ExternalURL, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+	// session values size is not limited by cookie size
+	for _, codec := range store.Codecs {
+		if c, ok := codec.(*securecookie.SecureCookie); ok {
+			c.MaxLength(0)
+		}
+	}
+	return store, nil
+}
+
+// Get returns a cached session
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns session from cookie ID, or a new session
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err == nil {
+		err = s.load(session)
+	}
+	if err != nil {
+		// expired, revoked or invalid session
+		session.ID = ""
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores session in users.db and its ID in cookie
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if err := DeleteSession(session.ID); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		id, err := securedRandString(sessionIDLength)
+		if err != nil {
+			return err
+		}
+		session.ID = id
+		if err = DeleteExpiredSessions(); err != nil {
+			log.Println("Error deleting expired sessions", err)
+		}
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	account, _ := session.Values[sessionAccount].(string)
+	maxAge := session.Options.MaxAge
+	if account == "" && maxAge > anonymousSessionMaxAge {
+		maxAge = anonymousSessionMaxAge
+	}
+	err = SaveSession(session.ID, account, data, maxAge, r.UserAgent(), r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew changes session ID (on login), previous session is deleted
+func (s *SessionStore) Renew(session *sessions.Session) error {
+	err := DeleteSession(session.ID)
+	session.ID = ""
+	return err
+}
+
+// load session values from users.db
+func (s *SessionStore) load(session *sessions.Session) error {
+	data, lastSeen, err := LoadSession(session.ID)
+	if err != nil {
+		return err
+	}
+	if err = securecookie.DecodeMulti(session.Name(), data, &session.Values, s.Codecs...); err != nil {
+		return err
+	}
+	if time.Now().Unix()-lastSeen > lastSeenInterval {
+		return SessionSeen(session.ID)
+	}
+	return nil
+}
+
+// SessionsPage lists active sessions of logged in user, and allows to revoke them
+func (app *Bouquins) SessionsPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	current := app.Session(req).ID
+	if req.Method == http.MethodPost {
+		var err error
+		switch req.PostFormValue(pAction) {
+		case "revoke":
+			var id int64
+			id, err = strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+			if err == nil {
+				err = RevokeSession(account, id)
+			}
+		case "others":
+			err = RevokeOtherSessions(account, current)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	userSessions, err := AccountSessions(account, current)
+	if err != nil {
+		return err
+	}
+	return app.render(res, tplSessions, &SessionsModel{*app.NewModel("Sessions", "sessions", req), userSessions})
+}
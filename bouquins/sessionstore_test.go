@@ -0,0 +1,57 @@
+package bouquins
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessionStore(t *testing.T) {
+	app := newTestApp(t)
+	account := testAccount(t, app, "a1", "reader@example.org")
+	first := sessionRequest(t, app, http.MethodGet, URLIndex, account)
+	second := sessionRequest(t, app, http.MethodGet, URLIndex, account)
+	if id := app.AccountID(first); id != "a1" {
+		t.Fatalf("session account %q, expected a1", id)
+	}
+
+	userSessions, err := AccountSessions("a1", app.Session(first).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userSessions) != 2 {
+		t.Fatalf("%d sessions listed, expected 2", len(userSessions))
+	}
+	var revoked *UserSession
+	for _, s := range userSessions {
+		if !s.Current {
+			revoked = s
+		}
+	}
+	if revoked == nil {
+		t.Fatal("no other session than current")
+	}
+	if err = RevokeSession("other", revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	if id := app.AccountID(sessionCopy(second)); id != "a1" {
+		t.Errorf("session revoked by another account")
+	}
+	if err = RevokeSession("a1", revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	if id := app.AccountID(sessionCopy(second)); id != "" {
+		t.Errorf("revoked session still logged in as %q", id)
+	}
+	if id := app.AccountID(sessionCopy(first)); id != "a1" {
+		t.Errorf("current session logged out by revocation of another session")
+	}
+}
+
+// sessionCopy returns a new request with cookies of req (session is cached per request)
+func sessionCopy(req *http.Request) *http.Request {
+	copied, _ := http.NewRequest(req.Method, req.URL.String(), nil)
+	for _, c := range req.Cookies() {
+		copied.AddCookie(c)
+	}
+	return copied
+}
@@ -0,0 +1,179 @@
+package bouquins
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// label to derive share links signing key from cookie secret
+	keyShare = "bouquins share links"
+
+	defaultShareTTL = 7
+
+	pBook      = "book"
+	pFormat    = "format"
+	pDownloads = "downloads"
+
+	// share link query parameters
+	pShare       = "share"
+	pShareExpiry = "expires"
+	pShareSig    = "sig"
+)
+
+// Share is a signed link to download a book file without login
+type Share struct {
+	ID           int64
+	Account      string
+	Book         int64
+	Format       string
+	Title        string // book title when shared
+	Created      int64
+	Expires      int64
+	MaxDownloads int64 // 0: unlimited
+	Downloads    int64
+	URL          string
+}
+
+// ShareModel is the model of share links page
+type ShareModel struct {
+	Model
+	Book     *BookFull
+	Shares   []*Share
+	ShareURL string
+	Message  string
+}
+
+// shareSignature signs share ID, book file and expiry date
+func (app *Bouquins) shareSignature(id, book int64, format string, expires int64) string {
+	mac := hmac.New(sha256.New, deriveKey([]byte(app.Conf.CookieSecret), keyShare))
+	fmt.Fprintf(mac, "%d\n%d\n%s\n%d", id, book, format, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareURL returns the signed download link of a share
+func (app *Bouquins) shareURL(share *Share) string {
+	params := url.Values{}
+	params.Set(pShare, strconv.FormatInt(share.ID, 10))
+	params.Set(pShareExpiry, strconv.FormatInt(share.Expires, 10))
+	params.Set(pShareSig, app.shareSignature(share.ID, share.Book, share.Format, share.Expires))
+	return app.Conf.ExternalURL + bookFileURL(share.Book, share.Format) + "?" + params.Encode()
+}
+
+// sharedFile checks share link of request for a book file (revoked or download limit reached), returns share ID
+func (app *Bouquins) sharedFile(book int64, format string, req *http.Request) (int64, bool) {
+	query := req.URL.Query()
+	id, err := strconv.ParseInt(query.Get(pShare), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(query.Get(pShareExpiry), 10, 64)
+	if err != nil || expires <= time.Now().Unix() {
+		return 0, false
+	}
+	format = strings.ToUpper(format)
+	sig := app.shareSignature(id, book, format, expires)
+	if !hmac.Equal([]byte(sig), []byte(query.Get(pShareSig))) {
+		return 0, false
+	}
+	ok, err := ShareValid(id, book, format, expires)
+	if err != nil {
+		log.Println("Error checking share", err)
+	}
+	return id, err == nil && ok
+}
+
+// shareAction creates or revokes a share link of logged in user
+func (app *Bouquins) shareAction(model *ShareModel, req *http.Request) error {
+	account := app.AccountID(req)
+	switch req.PostFormValue(pAction) {
+	case "share":
+		if model.Book == nil {
+			return fmt.Errorf("missing book")
+		}
+		format := req.PostFormValue(pFormat)
+		var data *BookData
+		for _, d := range model.Book.Data {
+			if d.Format == format {
+				data = d
+			}
+		}
+		if data == nil {
+			model.Message = "Format inconnu"
+			return nil
+		}
+		days, err := strconv.Atoi(req.PostFormValue(pDays))
+		if err != nil || days <= 0 {
+			days = defaultShareTTL
+		}
+		downloads, err := strconv.ParseInt(req.PostFormValue(pDownloads), 10, 64)
+		if err != nil || downloads < 0 {
+			downloads = 0
+		}
+		share := &Share{
+			Account:      account,
+			Book:         model.Book.ID,
+			Format:       data.Format,
+			Title:        model.Book.Title,
+			Expires:      time.Now().AddDate(0, 0, days).Unix(),
+			MaxDownloads: downloads,
+		}
+		if share.ID, err = CreateShare(share); err != nil {
+			return err
+		}
+		model.ShareURL = app.shareURL(share)
+	case "unshare":
+		id, err := strconv.ParseInt(req.PostFormValue(pID), 10, 64)
+		if err != nil {
+			return err
+		}
+		return RevokeShare(account, id)
+	}
+	return nil
+}
+
+// SharePage creates share links for a book (?book=id) and lists share links of logged in user
+func (app *Bouquins) SharePage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if account == "" {
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	model := &ShareModel{Model: *app.NewModel("Partages", "share", req)}
+	if bookParam := req.FormValue(pBook); bookParam != "" {
+		id, err := strconv.ParseInt(bookParam, 10, 64)
+		if err != nil {
+			return err
+		}
+		filter, err := app.UserFilter(req)
+		if err != nil {
+			return err
+		}
+		// only visible books can be shared
+		if model.Book, err = app.BookFull(filter, id); err != nil {
+			return err
+		}
+	}
+	if req.Method == http.MethodPost {
+		if err := app.shareAction(model, req); err != nil {
+			return err
+		}
+	}
+	var err error
+	model.Shares, err = AccountShares(account)
+	if err != nil {
+		return err
+	}
+	for _, share := range model.Shares {
+		share.URL = app.shareURL(share)
+	}
+	return app.render(res, tplShare, model)
+}
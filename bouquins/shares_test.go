@@ -0,0 +1,71 @@
+package bouquins
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// shareRequest sends a request of a share link, returns response status
+func shareRequest(t *testing.T, app *Bouquins, share *Share, method string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, app.shareURL(share), nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res := httptest.NewRecorder()
+	if err := app.bookFilePage(share.Book, share.Format, res, req); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// newTestShare creates a share link of EPUB file of book 1 limited to one download
+func newTestShare(t *testing.T, app *Bouquins) *Share {
+	share := &Share{Account: "a1", Book: 1, Format: "EPUB", Title: "Book", Expires: time.Now().Add(time.Hour).Unix(), MaxDownloads: 1}
+	var err error
+	if share.ID, err = CreateShare(share); err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	app := newTestApp(t)
+	testAccount(t, app, "a1", "reader@example.org")
+	content := bytes.Repeat([]byte("epub"), 1024)
+	testBook(t, app, 1, "Book", "Author", map[string][]byte{"EPUB": content})
+
+	// ranges: whole file sent in two parts is one download
+	share := newTestShare(t, app)
+	if res := shareRequest(t, app, share, http.MethodGet, map[string]string{"Range": "bytes=1-"}); res.Code != http.StatusPartialContent {
+		t.Fatalf("range bytes=1-: status %d", res.Code)
+	}
+	if res := shareRequest(t, app, share, http.MethodGet, map[string]string{"Range": "bytes=0-0"}); res.Code != http.StatusPartialContent {
+		t.Fatalf("range bytes=0-0: status %d", res.Code)
+	}
+	if res := shareRequest(t, app, share, http.MethodGet, map[string]string{"Range": "bytes=0-0"}); res.Code != http.StatusNotFound {
+		t.Errorf("whole file sent in ranges: status %d, expected limit reached", res.Code)
+	}
+
+	// HEAD and not modified responses don't count
+	share = newTestShare(t, app)
+	res := shareRequest(t, app, share, http.MethodHead, nil)
+	modified := res.Header().Get("Last-Modified")
+	if res.Code != http.StatusOK || modified == "" {
+		t.Fatalf("HEAD: status %d, Last-Modified %q", res.Code, modified)
+	}
+	for i := 0; i < 2; i++ {
+		if res = shareRequest(t, app, share, http.MethodGet, map[string]string{"If-Modified-Since": modified}); res.Code != http.StatusNotModified {
+			t.Fatalf("If-Modified-Since: status %d", res.Code)
+		}
+	}
+	res = shareRequest(t, app, share, http.MethodGet, nil)
+	if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), content) {
+		t.Fatalf("GET: status %d, %d bytes", res.Code, res.Body.Len())
+	}
+	if res = shareRequest(t, app, share, http.MethodGet, nil); res.Code != http.StatusNotFound {
+		t.Errorf("second GET: status %d, expected limit reached", res.Code)
+	}
+}
@@ -0,0 +1,482 @@
+package bouquins
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	urlOPDS = "opds"
+
+	pShelf = "shelf"
+	pNext  = "next"
+	pEmail = "email"
+
+	// next value redirecting to book page after a shelf action
+	nextBook = "book"
+
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	relAcquisition  = "http://opds-spec.org/acquisition"
+	relImage        = "http://opds-spec.org/image"
+	relThumbnail    = "http://opds-spec.org/image/thumbnail"
+)
+
+// errUnknownReader is the error of sharing a shelf with an unknown email
+var errUnknownReader = errors.New("Compte inconnu")
+
+// Shelf is a personal list of books of an user account, private or shared with chosen accounts
+type Shelf struct {
+	ID         int64          `json:"id"`
+	Account    string         `json:"-"`
+	Owner      string         `json:"owner,omitempty"` // display name of account
+	Name       string         `json:"name"`
+	Shared     bool           `json:"shared"` // shared with at least one account
+	Created    int64          `json:"created"`
+	Count      int64          `json:"count"` // books visible by current user
+	Own        bool           `json:"own"`
+	HasBook    bool           `json:"-"` // shelf contains current book (book page)
+	Books      []*ShelfBook   `json:"books,omitempty"`
+	SharedWith []*UserAccount `json:"-"` // owner only
+}
+
+// ShelfBook is a book of a shelf
+type ShelfBook struct {
+	*BookAdv
+	BookID   int64 `json:"-"`
+	Position int64 `json:"position"`
+	Added    int64 `json:"added"`
+}
+
+// ShelvesModel is the model of shelves list page
+type ShelvesModel struct {
+	Model
+	Shelves []*Shelf
+}
+
+// ShelfModel is the model of a shelf page
+type ShelfModel struct {
+	Model
+	*Shelf
+	Sort    string
+	Message string
+}
+
+// shelfURL returns the URL of a shelf page
+func shelfURL(id int64) string {
+	return URLShelves + strconv.FormatInt(id, 10)
+}
+
+// userShelves returns shelves visible by an user account
+func userShelves(account string) ([]*Shelf, error) {
+	shelves, err := Shelves(account)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range shelves {
+		s.Own = s.Account == account
+	}
+	return shelves, nil
+}
+
+// visibleShelves returns shelves visible by an user account, with count of books visible with filter
+func (app *Bouquins) visibleShelves(filter *BookFilter, account string) ([]*Shelf, error) {
+	shelves, err := userShelves(account)
+	if err != nil || !filter.Restricted() {
+		return shelves, err
+	}
+	books, err := ShelvesBooks(account)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0)
+	for _, shelfBooks := range books {
+		ids = append(ids, shelfBooks...)
+	}
+	visible, err := app.VisibleBooks(filter, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range shelves {
+		s.Count = 0
+		for _, b := range books[s.ID] {
+			if visible[b] {
+				s.Count++
+			}
+		}
+	}
+	return shelves, nil
+}
+
+// bookShelves returns shelves of an user account, marking those containing a book
+func bookShelves(account string, book int64) ([]*Shelf, error) {
+	shelves, err := userShelves(account)
+	if err != nil {
+		return nil, err
+	}
+	contains, err := BookShelves(account, book)
+	if err != nil {
+		return nil, err
+	}
+	own := make([]*Shelf, 0, len(shelves))
+	for _, s := range shelves {
+		if s.Own {
+			s.HasBook = contains[s.ID]
+			own = append(own, s)
+		}
+	}
+	return own, nil
+}
+
+// loadShelfBooks loads books of a shelf visible with filter, sorted by position, title or date added
+func (app *Bouquins) loadShelfBooks(shelf *Shelf, filter *BookFilter, sortBy string) error {
+	entries, err := ShelfBooks(shelf.ID)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.BookID
+	}
+	books, err := app.BooksByID(filter, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]*BookAdv, len(books))
+	for _, b := range books {
+		byID[b.ID] = b
+	}
+	shelf.Books = make([]*ShelfBook, 0, len(books))
+	for _, e := range entries {
+		if b, ok := byID[e.BookID]; ok {
+			e.BookAdv = b
+			shelf.Books = append(shelf.Books, e)
+		}
+	}
+	switch sortBy {
+	case "title":
+		sort.SliceStable(shelf.Books, func(i, j int) bool {
+			return strings.ToLower(shelf.Books[i].Title) < strings.ToLower(shelf.Books[j].Title)
+		})
+	case "added":
+		sort.SliceStable(shelf.Books, func(i, j int) bool {
+			return shelf.Books[i].Added > shelf.Books[j].Added
+		})
+	}
+	return nil
+}
+
+// moveShelfBook moves a book one position up (delta -1) or down (delta 1), positions are renumbered
+func moveShelfBook(id, book int64, delta int) error {
+	entries, err := ShelfBooks(id)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.BookID == book {
+			j := i + delta
+			if j < 0 || j >= len(entries) {
+				return nil
+			}
+			entries[i], entries[j] = entries[j], entries[i]
+			break
+		}
+	}
+	for i, e := range entries {
+		if e.Position != int64(i+1) {
+			if err = SetShelfBookPosition(id, e.BookID, int64(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shelfAction changes a shelf of logged in user, returns redirection URL
+func (app *Bouquins) shelfAction(shelf *Shelf, req *http.Request) (string, error) {
+	account := app.AccountID(req)
+	redirect := shelfURL(shelf.ID)
+	var book int64
+	if param := req.PostFormValue(pBook); param != "" {
+		var err error
+		if book, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return "", err
+		}
+		if req.PostFormValue(pNext) == nextBook {
+			redirect = URLBooks + param
+		}
+	}
+	switch req.PostFormValue(pAction) {
+	case "add":
+		filter, err := app.UserFilter(req)
+		if err != nil {
+			return "", err
+		}
+		// only visible books can be added
+		books, err := app.BooksByID(filter, []int64{book})
+		if err != nil {
+			return "", err
+		}
+		if len(books) == 0 {
+			return "", sql.ErrNoRows
+		}
+		return redirect, AddShelfBook(account, shelf.ID, book)
+	case "remove":
+		return redirect, RemoveShelfBook(account, shelf.ID, book)
+	case "up":
+		return redirect, moveShelfBook(shelf.ID, book, -1)
+	case "down":
+		return redirect, moveShelfBook(shelf.ID, book, 1)
+	case "update":
+		name := strings.TrimSpace(req.PostFormValue(pName))
+		if name == "" {
+			name = shelf.Name
+		}
+		return redirect, UpdateShelf(account, shelf.ID, name)
+	case "share":
+		reader, err := Account(strings.TrimSpace(req.PostFormValue(pEmail)))
+		if err == sql.ErrNoRows {
+			return "", errUnknownReader
+		}
+		if err != nil {
+			return "", err
+		}
+		return redirect, ShareShelf(account, shelf.ID, reader.ID)
+	case "unshare":
+		return redirect, UnshareShelf(account, shelf.ID, req.PostFormValue(pAccount))
+	case "delete":
+		return URLShelves, DeleteShelf(account, shelf.ID)
+	}
+	return redirect, nil
+}
+
+// shelvesListPage lists shelves of logged in user and shared shelves, creates shelves or changes a selected shelf
+func (app *Bouquins) shelvesListPage(res http.ResponseWriter, req *http.Request) error {
+	account := app.AccountID(req)
+	if shelf := req.PostFormValue(pShelf); req.Method == http.MethodPost && shelf != "" {
+		// book page form: shelf selected in a list
+		return app.shelfResource(shelf, res, req)
+	}
+	if req.Method == http.MethodPost && req.PostFormValue(pAction) == "create" {
+		name := strings.TrimSpace(req.PostFormValue(pName))
+		if name != "" {
+			shelf := &Shelf{Account: account, Name: name}
+			id, err := CreateShelf(shelf)
+			if err != nil {
+				return err
+			}
+			if !isJSON(req) {
+				http.Redirect(res, req, shelfURL(id), http.StatusSeeOther)
+				return nil
+			}
+		}
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	shelves, err := app.visibleShelves(filter, account)
+	if err != nil {
+		return err
+	}
+	if isJSON(req) {
+		return writeJSON(res, shelves)
+	}
+	return app.render(res, tplShelves, &ShelvesModel{*app.NewModel("Etagères", "shelves", req), shelves})
+}
+
+// shelfResource dispatches shelf URLs: /shelves/{id}, /shelves/{id}/opds
+func (app *Bouquins) shelfResource(idParam string, res http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(idParam, "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != urlOPDS) {
+		http.NotFound(res, req)
+		return nil
+	}
+	shelf, err := ShelfByID(app.AccountID(req), id)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	shelf.Own = shelf.Account == app.AccountID(req)
+	if len(parts) == 2 {
+		return app.shelfFeed(shelf, res, req)
+	}
+	return app.shelfPage(shelf, res, req)
+}
+
+// shelfPage displays a shelf, its owner can change it
+func (app *Bouquins) shelfPage(shelf *Shelf, res http.ResponseWriter, req *http.Request) error {
+	var message string
+	if req.Method == http.MethodPost {
+		if !shelf.Own {
+			http.Error(res, "403 Forbidden", http.StatusForbidden)
+			return nil
+		}
+		redirect, err := app.shelfAction(shelf, req)
+		switch {
+		case err == errUnknownReader && isJSON(req):
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return nil
+		case err == errUnknownReader:
+			// shelf page with message
+			message = err.Error()
+		case err != nil:
+			return err
+		case !isJSON(req):
+			http.Redirect(res, req, redirect, http.StatusSeeOther)
+			return nil
+		case redirect == URLShelves:
+			// deleted
+			res.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		if shelf, err = ShelfByID(shelf.Account, shelf.ID); err != nil {
+			return err
+		}
+		shelf.Own = true
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	sortBy := req.URL.Query().Get(pSort)
+	if err = app.loadShelfBooks(shelf, filter, sortBy); err != nil {
+		return err
+	}
+	shelf.Count = int64(len(shelf.Books))
+	if isJSON(req) {
+		return writeJSON(res, shelf)
+	}
+	if shelf.Own {
+		if shelf.SharedWith, err = ShelfShares(shelf.ID); err != nil {
+			return err
+		}
+	}
+	return app.render(res, tplShelf, &ShelfModel{*app.NewModel(shelf.Name, "shelves", req), shelf, sortBy, message})
+}
+
+// OPDS //
+
+type opdsLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsEntry struct {
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Authors []opdsAuthor `xml:"author"`
+	Links   []opdsLink   `xml:"link"`
+}
+
+type opdsFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []opdsLink  `xml:"link"`
+	Entries []opdsEntry `xml:"entry"`
+}
+
+// opdsEntry builds the acquisition entry of a book
+func (app *Bouquins) opdsEntry(book *BookFull) opdsEntry {
+	entry := opdsEntry{
+		Title:   book.Title,
+		ID:      "urn:uuid:" + book.UUID,
+		Updated: time.Unix(book.Timestamp, 0).UTC().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: relImage, Href: app.Conf.ExternalURL + bookCoverURL(book.ID)},
+			{Rel: relThumbnail, Href: app.Conf.ExternalURL + bookThumbURL(book.ID, ThumbnailSizes[0])},
+		},
+	}
+	for _, author := range book.Authors {
+		entry.Authors = append(entry.Authors, opdsAuthor{author.Name})
+	}
+	for _, data := range book.Data {
+		href := app.Conf.ExternalURL + bookFileURL(book.ID, data.Format)
+		entry.Links = append(entry.Links, opdsLink{relAcquisition, href, mimeType(data.Format)})
+	}
+	return entry
+}
+
+// shelfFeed sends a shelf as an OPDS acquisition feed (API clients authenticate with a token)
+func (app *Bouquins) shelfFeed(shelf *Shelf, res http.ResponseWriter, req *http.Request) error {
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	entries, err := ShelfBooks(shelf.ID)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.BookID
+	}
+	books, err := app.BooksFullByID(filter, ids)
+	if err != nil {
+		return err
+	}
+	feed := opdsFeed{
+		ID:      "urn:bouquins:shelf:" + strconv.FormatInt(shelf.ID, 10),
+		Title:   shelf.Name,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: "self", Href: app.Conf.ExternalURL + shelfURL(shelf.ID) + "/" + urlOPDS, Type: opdsAcquisition},
+		},
+		Entries: make([]opdsEntry, 0, len(books)),
+	}
+	for _, book := range books {
+		feed.Entries = append(feed.Entries, app.opdsEntry(book))
+	}
+	res.Header().Set("Content-Type", opdsAcquisition)
+	res.Write([]byte(xml.Header))
+	return xml.NewEncoder(res).Encode(feed)
+}
+
+// mimeType returns the MIME type of a calibre book format
+func mimeType(format string) string {
+	switch strings.ToUpper(format) {
+	case "EPUB":
+		return "application/epub+zip"
+	case "PDF":
+		return "application/pdf"
+	case "MOBI", "AZW", "AZW3":
+		return "application/x-mobipocket-ebook"
+	case "CBZ":
+		return "application/vnd.comicbook+zip"
+	case "CBR":
+		return "application/vnd.comicbook-rar"
+	case "TXT":
+		return "text/plain"
+	}
+	return "application/octet-stream"
+}
+
+// ShelvesPage lists shelves or displays a shelf of logged in user
+func (app *Bouquins) ShelvesPage(res http.ResponseWriter, req *http.Request) error {
+	if app.AccountID(req) == "" {
+		if isJSON(req) || strings.HasSuffix(req.URL.Path, "/"+urlOPDS) {
+			unauthorized(res)
+			return nil
+		}
+		http.Redirect(res, req, URLLogin, http.StatusTemporaryRedirect)
+		return nil
+	}
+	return listOrID(res, req, URLShelves, app.shelvesListPage, app.shelfResource)
+}
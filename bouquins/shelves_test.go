@@ -0,0 +1,140 @@
+package bouquins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// accountRequest returns a request authenticated as an user account
+func accountRequest(method, target string, account *UserAccount) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	return req.WithContext(context.WithValue(req.Context(), ctxAccount, account))
+}
+
+func TestShelfSharesAndRestrictions(t *testing.T) {
+	app := newTestApp(t)
+	owner := testAccount(t, app, "a1", "owner@example.org")
+	reader := testAccount(t, app, "a2", "reader@example.org")
+	other := testAccount(t, app, "a3", "other@example.org")
+	for id, title := range map[int64]string{1: "Public", 2: "Hidden", 3: "Other"} {
+		testBook(t, app, id, title, "Author", map[string][]byte{"EPUB": []byte(title)})
+	}
+	// book 2 hidden from reader
+	if _, err := app.DB.Exec("INSERT INTO tags (id, name) VALUES (1, 'adult')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.DB.Exec("INSERT INTO books_tags_link (book, tag) VALUES (2, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.UserDB.Exec("INSERT INTO restrictions (account, field, value, exclude) VALUES ('a2', 'tags', 'adult', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := CreateShelf(&Shelf{Account: owner.ID, Name: "Shelf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, book := range []int64{1, 2, 3} {
+		if err = AddShelfBook(owner.ID, id, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ShareShelf(owner.ID, id, reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	// only the owner shares a shelf
+	if err = ShareShelf(reader.ID, id, other.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ShelfByID(other.ID, id); err != sql.ErrNoRows {
+		t.Errorf("shelf not shared with account: error %v", err)
+	}
+	shelves, err := userShelves(other.ID)
+	if err != nil || len(shelves) != 0 {
+		t.Errorf("shelves of account without shares: %d (%v)", len(shelves), err)
+	}
+
+	counts := map[*UserAccount]int64{owner: 3, reader: 2}
+	for account, expected := range counts {
+		req := accountRequest(http.MethodGet, URLShelves, account)
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		if err = app.ShelvesPage(res, req); err != nil {
+			t.Fatal(err)
+		}
+		var listed []*Shelf
+		if err = json.Unmarshal(res.Body.Bytes(), &listed); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 1 || listed[0].Count != expected || !listed[0].Shared {
+			t.Errorf("%s: shelves %s, expected 1 shared shelf with %d books", account.ID, res.Body.String(), expected)
+		}
+	}
+
+	// OPDS feed of visible books, loaded in batch
+	res := httptest.NewRecorder()
+	if err = app.ShelvesPage(res, accountRequest(http.MethodGet, shelfURL(id)+"/"+urlOPDS, reader)); err != nil {
+		t.Fatal(err)
+	}
+	var feed opdsFeed
+	if err = xml.Unmarshal(res.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err, res.Body.String())
+	}
+	if len(feed.Entries) != 2 || feed.Entries[0].Title != "Public" || feed.Entries[1].Title != "Other" {
+		t.Fatalf("feed entries %+v", feed.Entries)
+	}
+	entry := feed.Entries[0]
+	if entry.ID != "urn:uuid:uuid-1" || len(entry.Authors) != 1 || entry.Authors[0].Name != "Author" {
+		t.Errorf("entry %+v", entry)
+	}
+	acquisition := false
+	for _, l := range entry.Links {
+		acquisition = acquisition || (l.Rel == relAcquisition && l.Type == "application/epub+zip")
+	}
+	if !acquisition {
+		t.Errorf("entry without EPUB acquisition link: %+v", entry.Links)
+	}
+
+	if err = UnshareShelf(owner.ID, id, reader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ShelfByID(reader.ID, id); err != sql.ErrNoRows {
+		t.Errorf("unshared shelf: error %v", err)
+	}
+}
+
+func TestBooksByIDBatches(t *testing.T) {
+	app := newTestApp(t)
+	testBook(t, app, 1, "First", "Author", map[string][]byte{"EPUB": []byte("first")})
+	testBook(t, app, 2*maxQueryIDs+1, "Last", "Author", map[string][]byte{"EPUB": []byte("last")})
+	// more IDs than SQLite variables limit, last ones first
+	ids := make([]int64, 0, 3*maxQueryIDs)
+	for id := int64(3 * maxQueryIDs); id > 0; id-- {
+		ids = append(ids, id)
+	}
+	filter := new(BookFilter)
+	books, err := app.BooksFullByID(filter, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[0].ID != 2*maxQueryIDs+1 || books[1].ID != 1 {
+		t.Fatalf("%d books loaded, expected last and first", len(books))
+	}
+	for _, book := range books {
+		if len(book.Authors) != 1 || len(book.Data) != 1 {
+			t.Errorf("book %d: %d authors, %d files", book.ID, len(book.Authors), len(book.Data))
+		}
+	}
+	visible, err := app.VisibleBooks(filter, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visible) != 2 || !visible[1] || !visible[2*maxQueryIDs+1] {
+		t.Errorf("visible books %v", visible)
+	}
+}
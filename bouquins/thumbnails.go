@@ -0,0 +1,156 @@
+package bouquins
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // calibre covers may be PNG
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	urlThumb     = "thumb"
+	thumbQuality = 85
+)
+
+// ThumbnailSizes are allowed thumbnail widths (pixels)
+var ThumbnailSizes = []int{120, 300, 600}
+
+// bookThumbURL returns the URL of a book cover thumbnail
+func bookThumbURL(id int64, size int) string {
+	return URLBooks + strconv.FormatInt(id, 10) + "/" + urlThumb + "/" + strconv.Itoa(size)
+}
+
+// thumbnailSize checks requested thumbnail width
+func thumbnailSize(param string) (int, bool) {
+	size, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, false
+	}
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// thumbnailFile returns the path of a cached thumbnail, cover changes update book last_modified
+func (app *Bouquins) thumbnailFile(id, lastModified int64, size int) string {
+	return filepath.Join(app.Conf.ThumbnailsPath, fmt.Sprintf("%d-%d-%d.jpg", id, lastModified, size))
+}
+
+// createThumbnail scales cover to width (no upscaling) and writes it in cache
+func createThumbnail(cover, thumb string, width int) error {
+	in, err := os.Open(cover)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	src, _, err := image.Decode(in)
+	if err != nil {
+		return err
+	}
+	return writeScaled(src, thumb, width)
+}
+
+// writeScaled scales an image to width (no upscaling) and writes it as JPEG in cache
+func writeScaled(src image.Image, thumb string, width int) error {
+	bounds := src.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	if err := os.MkdirAll(filepath.Dir(thumb), 0755); err != nil {
+		return err
+	}
+	// write then rename: concurrent requests never read a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(thumb), ".thumb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: thumbQuality})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), thumb)
+}
+
+// bookThumbPage sends a cover thumbnail, generated on first request
+func (app *Bouquins) bookThumbPage(id int64, sizeParam string, res http.ResponseWriter, req *http.Request) error {
+	size, ok := thumbnailSize(sizeParam)
+	if !ok {
+		http.NotFound(res, req)
+		return nil
+	}
+	filter, err := app.UserFilter(req)
+	if err != nil {
+		return err
+	}
+	cover, lastModified, err := app.bookCoverFile(filter, id)
+	if err == sql.ErrNoRows {
+		http.NotFound(res, req)
+		return nil
+	}
+	if err == errNoCover {
+		// SVG scales without cache
+		return app.placeholderPage(filter, id, lastModified, size, res, req)
+	}
+	if err != nil {
+		return err
+	}
+	thumb := app.thumbnailFile(id, lastModified, size)
+	if _, err = os.Stat(thumb); os.IsNotExist(err) {
+		if err = createThumbnail(cover, thumb, size); err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(res, req)
+				return nil
+			}
+			return err
+		}
+		app.removeOldThumbnails(id, thumb, size)
+	}
+	f, err := os.Open(thumb)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// conditional requests are handled by ServeContent
+	res.Header().Set("ETag", fmt.Sprintf(`"%d-%d-%d"`, id, lastModified, size))
+	res.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(res, req, filepath.Base(thumb), time.Unix(lastModified, 0), f)
+	return nil
+}
+
+// removeOldThumbnails deletes cached thumbnails of previous covers of a book
+func (app *Bouquins) removeOldThumbnails(id int64, current string, size int) {
+	old, err := filepath.Glob(filepath.Join(app.Conf.ThumbnailsPath, fmt.Sprintf("%d-*-%d.jpg", id, size)))
+	if err != nil {
+		return
+	}
+	for _, file := range old {
+		if file != current {
+			if err = os.Remove(file); err != nil {
+				log.Println("Error removing thumbnail", err)
+			}
+		}
+	}
+}
@@ -9,7 +9,6 @@ import (
 
 	"golang.org/x/oauth2"
 
-	"github.com/gorilla/sessions"
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/chazu/go-bouquins/bouquins"
@@ -40,6 +39,9 @@ func ReadConfig() (*bouquins.Conf, error) {
 	if conf.UserDbPath == "" {
 		conf.UserDbPath = "./users.db"
 	}
+	if conf.ThumbnailsPath == "" {
+		conf.ThumbnailsPath = "./thumbnails"
+	}
 	if conf.BindAddress == "" {
 		conf.BindAddress = ":9000"
 	}
@@ -66,13 +68,18 @@ func initApp() *bouquins.Bouquins {
 		log.Fatalln(err)
 	}
 
+	store, err := bouquins.NewSessionStore(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	app := &bouquins.Bouquins{
 		Tpl:       tpl,
 		DB:        db,
 		UserDB:    userdb,
 		Conf:      conf,
 		OAuthConf: make(map[string]*oauth2.Config),
-		Cookies:   sessions.NewCookieStore([]byte(conf.CookieSecret)),
+		Sessions:  store,
 	}
 	for _, provider := range bouquins.Providers {
 		app.OAuthConf[provider.Name()] = provider.Config(conf)
@@ -81,7 +88,12 @@ func initApp() *bouquins.Bouquins {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	err = app.PrepareProxyAuth()
+	if err != nil {
+		log.Fatalln(err)
+	}
 	router(app)
+	app.StartMailQueue()
 	return app
 }
 
@@ -107,7 +119,6 @@ func handleURL(url string, f func(res http.ResponseWriter, req *http.Request) er
 
 func router(app *bouquins.Bouquins) {
 	assets(app.Conf.CalibrePath)
-	http.Handle(bouquins.URLCalibre, app.CalibreFileServer())
 	handleURL(bouquins.URLIndex, app.IndexPage)
 	handleURL(bouquins.URLLogin, app.LoginPage)
 	handleURL(bouquins.URLLogout, app.LogoutPage)
@@ -117,11 +128,26 @@ func router(app *bouquins.Bouquins) {
 	handleURL(bouquins.URLSeries, app.SeriesPage)
 	handleURL(bouquins.URLSearch, app.SearchPage)
 	handleURL(bouquins.URLAbout, app.AboutPage)
+	handleURL(bouquins.URLSettings, app.SettingsPage)
+	handleURL(bouquins.URLSessions, app.SessionsPage)
+	handleURL(bouquins.URLAdmin, app.AdminPage)
+	handleURL(bouquins.URLInvite, app.InvitePage)
+	handleURL(bouquins.URLShare, app.SharePage)
+	handleURL(bouquins.URLShelves, app.ShelvesPage)
+	handleURL(bouquins.URLReading, app.ReadingPage)
+	handleURL(bouquins.URLReviews, app.ReviewsPage)
+	handleURL(bouquins.URLKosync, app.KosyncPage)
+	handleURL(bouquins.URLKobo, app.KoboPage)
+	handleURL(bouquins.URLSend, app.SendPage)
+	handleURL(bouquins.URLRead, app.ReadPage)
+	handleURL(bouquins.URLComic, app.ComicPage)
+	handleURL(bouquins.URLAnnotations, app.AnnotationsPage)
+	handleURL(bouquins.URLLoans, app.LoansPage)
 }
 
 func main() {
 	app := initApp()
 	defer app.DB.Close()
 	defer app.UserDB.Close()
-	http.ListenAndServe(app.Conf.BindAddress, nil)
+	http.ListenAndServe(app.Conf.BindAddress, app.WithAuth(app.CSRF(http.DefaultServeMux)))
 }